@@ -0,0 +1,295 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/zhemao/glisp/interpreter"
+)
+
+// Modified buffers are written to #file# after autoSaveInterval keystrokes,
+// or when no key has been pressed for autoSaveTimeout. 0 turns either off.
+var autoSaveInterval = 300
+var autoSaveTimeout = 30 * time.Second
+
+var autoSaveKeys = 0
+var autoSaveTimer *time.Timer
+
+// The auto-save files written by this process, keyed by the file they're
+// for. They're listed in the session file so that recover-session can find
+// them if we die.
+var autoSaved = map[string]string{}
+
+func autoSaveName(fn string) string {
+	dir, base := filepath.Split(fn)
+	return filepath.Join(dir, "#"+base+"#")
+}
+
+// Reports whether fn has an auto-save file newer than itself.
+func hasNewerAutoSave(fn string) bool {
+	as, err := os.Stat(autoSaveName(fn))
+	if err != nil {
+		return false
+	}
+	fi, err := os.Stat(fn)
+	return err != nil || as.ModTime().After(fi.ModTime())
+}
+
+// Called after every key.
+func autoSaveAfterKey() {
+	autoSaveKeys++
+	if autoSaveInterval > 0 && autoSaveKeys >= autoSaveInterval {
+		doAutoSave()
+	}
+	if autoSaveTimeout > 0 {
+		if autoSaveTimer == nil {
+			autoSaveTimer = time.AfterFunc(autoSaveTimeout, func() { runOnMainLoop(doAutoSave) })
+		} else {
+			autoSaveTimer.Reset(autoSaveTimeout)
+		}
+	}
+}
+
+// Writes every buffer that has changed since it was last saved or
+// auto-saved to its auto-save file.
+func doAutoSave() {
+	autoSaveKeys = 0
+	wrote := false
+	for _, buf := range Global.Buffers {
+		if buf.Filename == "" || buf.large != nil || !buf.Dirty || (buf.autoSaveDone && buf.autoSaveUndo == buf.Undo) {
+			continue
+		}
+		name := autoSaveName(buf.Filename)
+		fi, err := os.Stat(buf.Filename)
+		if err != nil {
+			fi = nil
+		}
+		data, _, err := bufferBytes(buf)
+		if err == nil {
+			err = writeFileAtomic(name, data, fi)
+		}
+		if err != nil {
+			AddErrorMessage("Auto-saving " + buf.getRenderName() + ": " + err.Error())
+			continue
+		}
+		buf.autoSaveDone = true
+		buf.autoSaveUndo = buf.Undo
+		autoSaved[buf.Filename] = name
+		wrote = true
+	}
+	if wrote {
+		writeAutoSaveSession()
+	}
+}
+
+// Deletes the auto-save file for buf once its file has been saved.
+func removeAutoSave(buf *EditorBuffer) {
+	buf.autoSaveDone = false
+	if name, ok := autoSaved[buf.Filename]; ok {
+		os.Remove(name)
+		delete(autoSaved, buf.Filename)
+		writeAutoSaveSession()
+	}
+}
+
+func autoSaveSessionDir() (string, error) {
+	return AbsPath("~/.gomacs.d/auto-save-list")
+}
+
+func autoSaveSessionFile() (string, error) {
+	dir, err := autoSaveSessionDir()
+	if err != nil {
+		return "", err
+	}
+	host, _ := os.Hostname()
+	return filepath.Join(dir, fmt.Sprintf(".saves-%d-%s", os.Getpid(), host)), nil
+}
+
+// Lists the files we've auto-saved, a line with the file's name followed by a
+// line with its auto-save file's.
+func writeAutoSaveSession() {
+	fn, err := autoSaveSessionFile()
+	if err != nil {
+		return
+	}
+	if len(autoSaved) == 0 {
+		os.Remove(fn)
+		return
+	}
+	lines := []string{}
+	for file, as := range autoSaved {
+		lines = append(lines, file, as)
+	}
+	os.MkdirAll(filepath.Dir(fn), 0700)
+	if err := writeFileAtomic(fn, []byte(strings.Join(lines, "\n")+"\n"), nil); err != nil {
+		AddErrorMessage(err.Error())
+	}
+}
+
+// Called when the editor exits normally; there's nothing to recover.
+func removeAutoSaveSession() {
+	if fn, err := autoSaveSessionFile(); err == nil {
+		os.Remove(fn)
+	}
+}
+
+// Replaces the text of fn's buffer (opening it if need be) with what's in its
+// auto-save file. The buffer is left modified, so C-x C-s keeps it and undo
+// takes it back.
+func recoverFile(fn string, env *glisp.Glisp) error {
+	name := autoSaveName(fn)
+	lines, _, _, err := readFileLines(name)
+	if err != nil {
+		return err
+	}
+	if buf := findFileBuffer(fn); buf != nil {
+		switchToBuffer(buf)
+	} else {
+		openFile(fn, env)
+	}
+	bufReplaceText(strings.Join(lines, "\n"))
+	Global.CurrentB.Dirty = true
+	// It's ours now, to be deleted when the file is saved.
+	autoSaved[fn] = name
+	Global.Input = "Recovered " + fn + " from " + filepath.Base(name) + "; C-x C-s to keep it"
+	return nil
+}
+
+func doRecoverFile(env *glisp.Glisp) {
+	def := Global.CurrentB.Filename
+	fn := tabCompletedEditorPrompt("Recover file (blank for "+def+")", tabCompleteFilename)
+	if fn == "" {
+		fn = def
+	}
+	if fn == "" {
+		Global.Input = "Cancelled."
+		return
+	}
+	fn, err := AbsPath(fn)
+	if err == nil {
+		err = recoverFile(fn, env)
+	}
+	if err != nil {
+		Global.Input = err.Error()
+		AddErrorMessage(err.Error())
+	}
+}
+
+// Offers to recover the files auto-saved by an editor that didn't exit
+// cleanly.
+func doRecoverSession(env *glisp.Glisp) {
+	dir, err := autoSaveSessionDir()
+	if err != nil {
+		Global.Input = err.Error()
+		return
+	}
+	ours, _ := autoSaveSessionFile()
+	files, _ := ioutil.ReadDir(dir)
+	sessions := []os.FileInfo{}
+	for _, f := range files {
+		if strings.HasPrefix(f.Name(), ".saves-") && filepath.Join(dir, f.Name()) != ours {
+			sessions = append(sessions, f)
+		}
+	}
+	if len(sessions) == 0 {
+		Global.Input = "No previous sessions to recover"
+		return
+	}
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].ModTime().After(sessions[j].ModTime()) })
+	choices := []string{}
+	for _, s := range sessions {
+		choices = append(choices, s.ModTime().Format(time.ANSIC)+"  "+s.Name())
+	}
+	i := editorChoiceIndex("Recover session", choices, 0)
+	if i < 0 || i >= len(sessions) {
+		Global.Input = "Cancelled."
+		return
+	}
+	session := filepath.Join(dir, sessions[i].Name())
+	data, err := ioutil.ReadFile(session)
+	if err != nil {
+		Global.Input = err.Error()
+		return
+	}
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	recovered := 0
+	for j := 0; j+1 < len(lines); j += 2 {
+		if _, err := os.Stat(lines[j+1]); err != nil {
+			continue
+		}
+		ok, err := editorYesNoPrompt("Recover "+lines[j]+"?", false)
+		if err != nil {
+			return
+		}
+		if !ok {
+			continue
+		}
+		if err := recoverFile(lines[j], env); err != nil {
+			AddErrorMessage(err.Error())
+			continue
+		}
+		recovered++
+	}
+	os.Remove(session)
+	Global.Input = fmt.Sprintf("Recovered %d files", recovered)
+}
+
+// Auto-saves if the editor panics, so that
+// recover-session can get the work back. Deferred by main.
+func autoSaveOnCrash() {
+	if r := recover(); r != nil {
+		doAutoSave()
+		dumpCrashLog(fmt.Sprint(r))
+		panic(r)
+	}
+}
+
+func catchFatalSignals() {
+	if len(fatalSignals) == 0 {
+		return
+	}
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, fatalSignals...)
+	go func() {
+		sig := <-c
+		runOnMainLoop(func() {
+			doAutoSave()
+			screen.Close()
+			fmt.Fprintln(os.Stderr, "gomacs: "+sig.String()+"; modified buffers were auto-saved")
+			os.Exit(1)
+		})
+	}()
+}
+
+func lispSetAutoSaveInterval(env *glisp.Glisp, name string, args []glisp.Sexp) (glisp.Sexp, error) {
+	if len(args) != 1 {
+		return glisp.SexpNull, glisp.WrongNargs
+	}
+	switch t := args[0].(type) {
+	case glisp.SexpInt:
+		autoSaveInterval = int(t)
+	default:
+		return glisp.SexpNull, errors.New("Arg 1 needs to be an int")
+	}
+	return glisp.SexpNull, nil
+}
+
+func lispSetAutoSaveTimeout(env *glisp.Glisp, name string, args []glisp.Sexp) (glisp.Sexp, error) {
+	if len(args) != 1 {
+		return glisp.SexpNull, glisp.WrongNargs
+	}
+	switch t := args[0].(type) {
+	case glisp.SexpInt:
+		autoSaveTimeout = time.Duration(t) * time.Second
+	default:
+		return glisp.SexpNull, errors.New("Arg 1 needs to be an int")
+	}
+	return glisp.SexpNull, nil
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// How a file's text is stored on disk: the character encoding, whether it
+// starts with a byte order mark, and the line endings ("unix" for \n, "dos"
+// for \r\n and "mac" for \r). Buffers hold UTF-8 with the line endings
+// taken out, and are converted back on save.
+type codingSystem struct {
+	encoding string // "utf-8", "latin-1", "utf-16le" or "utf-16be"
+	bom      bool
+	eol      string
+}
+
+var defaultCoding = codingSystem{"utf-8", false, "unix"}
+
+var codingEncodings = []string{"utf-8", "utf-8-with-signature", "latin-1",
+	"utf-16le-with-signature", "utf-16be-with-signature", "utf-16le", "utf-16be"}
+var codingEOLs = []string{"unix", "dos", "mac"}
+
+// The name of the coding system, in the style of Emacs: utf-8-dos,
+// utf-16le-with-signature-unix and so on.
+func (c codingSystem) String() string {
+	name := c.encoding
+	if c.bom {
+		name += "-with-signature"
+	}
+	return name + "-" + c.eol
+}
+
+// Parses a coding system name. Either part may be left out (utf-8, dos), in
+// which case it stays as it is in cur.
+func parseCodingSystem(name string, cur codingSystem) (codingSystem, error) {
+	ret := cur
+	name = strings.ToLower(strings.TrimSpace(name))
+	for _, eol := range codingEOLs {
+		if name == eol {
+			ret.eol = eol
+			return ret, nil
+		}
+		if strings.HasSuffix(name, "-"+eol) {
+			ret.eol = eol
+			name = strings.TrimSuffix(name, "-"+eol)
+			break
+		}
+	}
+	switch name {
+	case "latin-1", "iso-8859-1", "iso-latin-1":
+		ret.encoding, ret.bom = "latin-1", false
+	default:
+		ret.bom = strings.HasSuffix(name, "-with-signature")
+		ret.encoding = strings.TrimSuffix(name, "-with-signature")
+		if ret.encoding == "utf-8" || ret.encoding == "utf-16le" || ret.encoding == "utf-16be" {
+			break
+		}
+		return cur, errors.New("Unknown coding system: " + name)
+	}
+	return ret, nil
+}
+
+// The names set-buffer-file-coding-system completes.
+func codingSystemNames() []string {
+	ret := append([]string{}, codingEOLs...)
+	for _, enc := range codingEncodings {
+		ret = append(ret, enc)
+		for _, eol := range codingEOLs {
+			ret = append(ret, enc+"-"+eol)
+		}
+	}
+	return ret
+}
+
+// Works out how data is encoded, and turns it into lines of UTF-8.
+func decodeLines(data []byte) ([]string, codingSystem) {
+	c := defaultCoding
+	var text string
+	switch {
+	case bytes.HasPrefix(data, []byte{0xEF, 0xBB, 0xBF}):
+		c.bom = true
+		text = string(data[3:])
+	case bytes.HasPrefix(data, []byte{0xFF, 0xFE}):
+		c.encoding, c.bom = "utf-16le", true
+		text = decodeUTF16(data[2:], false)
+	case bytes.HasPrefix(data, []byte{0xFE, 0xFF}):
+		c.encoding, c.bom = "utf-16be", true
+		text = decodeUTF16(data[2:], true)
+	case utf8.Valid(data):
+		text = string(data)
+	default:
+		// Not UTF-8; every byte is a character in Latin-1.
+		c.encoding = "latin-1"
+		runes := make([]rune, len(data))
+		for i, b := range data {
+			runes[i] = rune(b)
+		}
+		text = string(runes)
+	}
+
+	// The first line ending decides, as long as the rest agree.
+	i := strings.IndexAny(text, "\r\n")
+	switch {
+	case i < 0 || text[i] == '\n':
+	case i+1 < len(text) && text[i+1] == '\n':
+		if strings.Count(text, "\n") == strings.Count(text, "\r\n") {
+			c.eol = "dos"
+		}
+	default:
+		if !strings.Contains(text, "\n") {
+			c.eol = "mac"
+		}
+	}
+	if text == "" {
+		return []string{}, c
+	}
+	lines := strings.Split(text, eolString(c.eol))
+	if lines[len(lines)-1] == "" {
+		// The last line ended with a newline like all the others.
+		lines = lines[:len(lines)-1]
+	}
+	return lines, c
+}
+
+func eolString(eol string) string {
+	switch eol {
+	case "dos":
+		return "\r\n"
+	case "mac":
+		return "\r"
+	}
+	return "\n"
+}
+
+func decodeUTF16(data []byte, bigEndian bool) string {
+	units := make([]uint16, len(data)/2)
+	for i := range units {
+		if bigEndian {
+			units[i] = uint16(data[2*i])<<8 | uint16(data[2*i+1])
+		} else {
+			units[i] = uint16(data[2*i+1])<<8 | uint16(data[2*i])
+		}
+	}
+	return string(utf16.Decode(units))
+}
+
+// Turns lines back into the bytes of a file in coding system c. Each line is
+// followed by a line ending.
+func encodeLines(lines []string, c codingSystem) ([]byte, error) {
+	var text bytes.Buffer
+	eol := eolString(c.eol)
+	for _, line := range lines {
+		text.WriteString(line)
+		text.WriteString(eol)
+	}
+	var out bytes.Buffer
+	switch c.encoding {
+	case "utf-8":
+		if c.bom {
+			out.Write([]byte{0xEF, 0xBB, 0xBF})
+		}
+		out.Write(text.Bytes())
+	case "latin-1":
+		for i, ru := range text.String() {
+			if ru > 0xFF {
+				return nil, fmt.Errorf("%q at byte %d can't be saved as latin-1; change the coding system with M-x set-buffer-file-coding-system", ru, i)
+			}
+			out.WriteByte(byte(ru))
+		}
+	case "utf-16le", "utf-16be":
+		if c.bom {
+			if c.encoding == "utf-16le" {
+				out.Write([]byte{0xFF, 0xFE})
+			} else {
+				out.Write([]byte{0xFE, 0xFF})
+			}
+		}
+		for _, u := range utf16.Encode([]rune(text.String())) {
+			if c.encoding == "utf-16le" {
+				out.Write([]byte{byte(u), byte(u >> 8)})
+			} else {
+				out.Write([]byte{byte(u >> 8), byte(u)})
+			}
+		}
+	default:
+		return nil, errors.New("Unknown encoding " + c.encoding)
+	}
+	return out.Bytes(), nil
+}
+
+// The buffer's coding system; buffers that weren't read from a file get the
+// default.
+func (buf *EditorBuffer) codingSystem() codingSystem {
+	if buf.coding.encoding == "" {
+		return defaultCoding
+	}
+	return buf.coding
+}
+
+func setBufferFileCodingSystem() {
+	buf := Global.CurrentB
+	cur := buf.codingSystem()
+	name := tabCompletedEditorPrompt("Coding system for saving (now "+cur.String()+")", func(prefix string) []string {
+		ret := []string{}
+		for _, name := range codingSystemNames() {
+			if strings.HasPrefix(name, prefix) {
+				ret = append(ret, name)
+			}
+		}
+		return ret
+	})
+	if name == "" {
+		Global.Input = "Cancelled."
+		return
+	}
+	c, err := parseCodingSystem(name, cur)
+	if err != nil {
+		Global.Input = err.Error()
+		return
+	}
+	buf.coding = c
+	buf.Dirty = true
+	Global.Input = buf.getRenderName() + " will be saved as " + c.String()
+	if _, _, err := bufferBytes(buf); err != nil {
+		Global.Input = err.Error()
+	}
+}
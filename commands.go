@@ -56,15 +56,20 @@ func (c *CommandList) PutCommand(key string, command *CommandFunc) {
 		c.Children = make(map[string]*CommandList)
 	}
 	keys := strings.Split(key, " ")
-	if c.Children[keys[0]] == nil {
-		c.Children[keys[0]] = &CommandList{false, nil, nil}
+	k := keys[0]
+	if k == "SPC" {
+		// The keys are separated by spaces, so the space key is spelt out.
+		k = " "
+	}
+	if c.Children[k] == nil {
+		c.Children[k] = &CommandList{false, nil, nil}
 	}
 	if len(keys) > 1 {
-		c.Children[keys[0]].Parent = true
-		c.Children[keys[0]].PutCommand(strings.Join(keys[1:], " "), command)
+		c.Children[k].Parent = true
+		c.Children[k].PutCommand(strings.Join(keys[1:], " "), command)
 	} else {
-		c.Children[keys[0]].Parent = false
-		c.Children[keys[0]].Command = command
+		c.Children[k].Parent = false
+		c.Children[k].Command = command
 	}
 }
 
@@ -98,6 +103,39 @@ func (c *CommandList) GetCommand(key string) (*CommandFunc, error) {
 	}
 }
 
+// Looks key up in the bindings of the current buffer's minor modes, then its
+// major mode's and then the global ones, reading more keys for as long as
+// any of them has a prefix that matches. A major mode binding a prefix like
+// C-x doesn't hide the global C-x commands it doesn't bind itself.
+func getCommandForKey(key string) (*CommandFunc, error) {
+	lists := Global.CurrentB.minorModeBindings()
+	if mode := Global.MajorBindings[Global.CurrentB.MajorMode]; mode != nil {
+		lists = append(lists, mode)
+	}
+	lists = append(lists, Emacs)
+	for {
+		Global.Input += key + " "
+		key = getMousek(key)
+		editorRefreshScreen()
+		next := []*CommandList{}
+		for _, l := range lists {
+			child := l.Children[key]
+			if child == nil {
+				continue
+			}
+			if !child.Parent {
+				return child.Command, nil
+			}
+			next = append(next, child)
+		}
+		if len(next) == 0 {
+			return nil, errors.New("Bad command: " + Global.Input)
+		}
+		lists = next
+		key = editorGetKey()
+	}
+}
+
 func (c *CommandList) UnbindAll() {
 	c.Children = make(map[string]*CommandList)
 }
@@ -118,18 +156,7 @@ func DescribeKeyBriefly() {
 	Global.Input = ""
 	editorRefreshScreen()
 	key := editorGetKey()
-	if Global.MajorBindings[Global.CurrentB.MajorMode] != nil {
-		com, comerr := Global.MajorBindings[Global.CurrentB.MajorMode].GetCommand(key)
-		if com != nil && comerr == nil {
-			if com.Name == "lisp code" {
-				Global.Input += "runs anonymous lisp code"
-			} else {
-				Global.Input += "runs the command " + com.Name
-			}
-			return
-		}
-	}
-	com, comerr := Emacs.GetCommand(key)
+	com, comerr := getCommandForKey(key)
 	if comerr != nil {
 		Global.Input += "is not bound to a command"
 	} else if com != nil {
@@ -220,7 +247,6 @@ func AproposCommand() {
 		Global.Input = "Nothing found for " + search
 	} else {
 		showMessages(results...)
-		Global.Input = ""
 	}
 }
 
@@ -228,6 +254,12 @@ func LoadDefaultCommands() {
 	DefineCommand(&CommandFunc{"describe-key-briefly", func(env *glisp.Glisp) { DescribeKeyBriefly() }, false})
 	DefineCommand(&CommandFunc{"run-command", RunCommand, true})
 	DefineCommand(&CommandFunc{"redo", editorRedoAction, false})
+	DefineCommand(&CommandFunc{"undo-tree-visualize", undoTreeVisualize, true})
+	DefineCommand(&CommandFunc{"undo-tree-visualize-undo", func(*glisp.Glisp) { undoTreeUndo() }, false})
+	DefineCommand(&CommandFunc{"undo-tree-visualize-redo", undoTreeRedo, false})
+	DefineCommand(&CommandFunc{"undo-tree-visualize-switch-branch-left", func(*glisp.Glisp) { undoTreeBranch(-1) }, false})
+	DefineCommand(&CommandFunc{"undo-tree-visualize-switch-branch-right", func(*glisp.Glisp) { undoTreeBranch(1) }, false})
+	DefineCommand(&CommandFunc{"undo-tree-visualize-select", undoTreeSelect, false})
 	DefineCommand(&CommandFunc{"suspend-emacs", func(env *glisp.Glisp) { suspend() }, false})
 	DefineCommand(&CommandFunc{"move-end-of-line", func(env *glisp.Glisp) { MoveCursorToEol() }, false})
 	DefineCommand(&CommandFunc{"move-beginning-of-line", func(env *glisp.Glisp) { MoveCursorToBol() }, false})
@@ -240,7 +272,54 @@ func LoadDefaultCommands() {
 	DefineCommand(&CommandFunc{"insert-newline-and-indent", func(env *glisp.Glisp) { editorInsertNewline(true) }, false})
 	DefineCommand(&CommandFunc{"insert-newline-maybe-indent", func(env *glisp.Glisp) { editorInsertNewline(Global.CurrentB.hasMode("indent-mode")) }, false})
 	DefineCommand(&CommandFunc{"insert-newline", func(env *glisp.Glisp) { editorInsertNewline(false) }, false})
-	DefineCommand(&CommandFunc{"isearch", func(env *glisp.Glisp) { editorFind() }, false})
+	DefineCommand(&CommandFunc{"isearch", func(env *glisp.Glisp) { editorFind(false, false) }, false})
+	DefineCommand(&CommandFunc{"isearch-backward", func(env *glisp.Glisp) { editorFind(false, true) }, false})
+	DefineCommand(&CommandFunc{"isearch-forward-regexp", func(env *glisp.Glisp) { editorFind(true, false) }, false})
+	DefineCommand(&CommandFunc{"isearch-backward-regexp", func(env *glisp.Glisp) { editorFind(true, true) }, false})
+	DefineCommand(&CommandFunc{"grep", func(env *glisp.Glisp) { doGrep() }, false})
+	DefineCommand(&CommandFunc{"rgrep", func(env *glisp.Glisp) { doRgrep() }, false})
+	DefineCommand(&CommandFunc{"next-error", func(env *glisp.Glisp) { nextError(env, 1) }, false})
+	DefineCommand(&CommandFunc{"previous-error", func(env *glisp.Glisp) { nextError(env, -1) }, false})
+	DefineCommand(&CommandFunc{"compile-goto-error", gotoResult, false})
+	DefineCommand(&CommandFunc{"compile", func(env *glisp.Glisp) { doCompile() }, false})
+	DefineCommand(&CommandFunc{"recompile", func(env *glisp.Glisp) { doRecompile() }, false})
+	DefineCommand(&CommandFunc{"kill-compilation", func(env *glisp.Glisp) { killCompilation() }, false})
+	DefineCommand(&CommandFunc{"list-processes", func(env *glisp.Glisp) { listProcesses() }, false})
+	DefineCommand(&CommandFunc{"kill-process", func(env *glisp.Glisp) { doKillProcess() }, false})
+	DefineCommand(&CommandFunc{"shell", func(env *glisp.Glisp) { doShell() }, false})
+	DefineCommand(&CommandFunc{"comint-send-input", func(env *glisp.Glisp) { comintSendInput() }, false})
+	DefineCommand(&CommandFunc{"comint-previous-input", func(env *glisp.Glisp) { comintPreviousInput() }, false})
+	DefineCommand(&CommandFunc{"comint-next-input", func(env *glisp.Glisp) { comintNextInput() }, false})
+	DefineCommand(&CommandFunc{"comint-interrupt-subjob", func(env *glisp.Glisp) { comintInterrupt() }, false})
+	DefineCommand(&CommandFunc{"comint-send-eof", func(env *glisp.Glisp) { comintSendEOF() }, false})
+	DefineCommand(&CommandFunc{"dired-find-file", func(env *glisp.Glisp) { diredFindFile(env) }, false})
+	DefineCommand(&CommandFunc{"dired-up-directory", func(env *glisp.Glisp) { diredUpDirectory() }, false})
+	DefineCommand(&CommandFunc{"dired-mark", func(env *glisp.Glisp) { diredSetMark('*') }, false})
+	DefineCommand(&CommandFunc{"dired-unmark", func(env *glisp.Glisp) { diredSetMark(' ') }, false})
+	DefineCommand(&CommandFunc{"dired-unmark-all-marks", func(env *glisp.Glisp) { diredUnmarkAll() }, false})
+	DefineCommand(&CommandFunc{"dired-flag-file-deletion", func(env *glisp.Glisp) { diredSetMark('D') }, false})
+	DefineCommand(&CommandFunc{"dired-do-flagged-delete", func(env *glisp.Glisp) { diredDoFlaggedDelete() }, false})
+	DefineCommand(&CommandFunc{"dired-do-rename", func(env *glisp.Glisp) { diredDoRename() }, false})
+	DefineCommand(&CommandFunc{"dired-do-copy", func(env *glisp.Glisp) { diredDoCopy() }, false})
+	DefineCommand(&CommandFunc{"dired-create-directory", func(env *glisp.Glisp) { diredCreateDirectory() }, false})
+	DefineCommand(&CommandFunc{"dired-do-chmod", func(env *glisp.Glisp) { diredDoChmod() }, false})
+	DefineCommand(&CommandFunc{"dired-revert", func(env *glisp.Glisp) { diredRevert() }, false})
+	DefineCommand(&CommandFunc{"wdired", func(env *glisp.Glisp) { wdired(env) }, false})
+	DefineCommand(&CommandFunc{"wdired-finish-edit", func(env *glisp.Glisp) { wdiredFinishEdit() }, false})
+	DefineCommand(&CommandFunc{"wdired-abort-changes", func(env *glisp.Glisp) { wdiredAbortChanges() }, false})
+	DefineCommand(&CommandFunc{"revert-buffer", func(env *glisp.Glisp) { doRevertBuffer() }, false})
+	DefineCommand(&CommandFunc{"read-only-mode", func(env *glisp.Glisp) { toggleReadOnly() }, false})
+	DefineCommand(&CommandFunc{"view-mode", func(env *glisp.Glisp) { viewMode() }, false})
+	DefineCommand(&CommandFunc{"view-mode-exit", func(env *glisp.Glisp) { viewModeExit() }, false})
+	DefineCommand(&CommandFunc{"large-file-beginning-of-buffer", func(env *glisp.Glisp) { largeFileBeginning() }, false})
+	DefineCommand(&CommandFunc{"large-file-end-of-buffer", func(env *glisp.Glisp) { largeFileEnd() }, false})
+	DefineCommand(&CommandFunc{"large-file-goto-line", func(env *glisp.Glisp) { largeFileGotoLine() }, false})
+	DefineCommand(&CommandFunc{"large-file-search-forward", func(env *glisp.Glisp) { largeFileSearch(true) }, false})
+	DefineCommand(&CommandFunc{"large-file-search-backward", func(env *glisp.Glisp) { largeFileSearch(false) }, false})
+	DefineCommand(&CommandFunc{"set-buffer-file-coding-system", func(env *glisp.Glisp) { setBufferFileCodingSystem() }, false})
+	DefineCommand(&CommandFunc{"recover-file", func(env *glisp.Glisp) { doRecoverFile(env) }, false})
+	DefineCommand(&CommandFunc{"recover-session", func(env *glisp.Glisp) { doRecoverSession(env) }, false})
+	DefineCommand(&CommandFunc{"do-auto-save", func(env *glisp.Glisp) { doAutoSave(); Global.Input = "Auto-saving...done" }, false})
 	DefineCommand(&CommandFunc{"buffers-list", func(env *glisp.Glisp) { editorSwitchBuffer() }, false})
 	DefineCommand(&CommandFunc{"end-of-buffer", func(env *glisp.Glisp) { Global.CurrentB.cy = Global.CurrentB.NumRows; Global.CurrentB.cx = 0 }, false})
 	DefineCommand(&CommandFunc{"beginning-of-buffer", func(env *glisp.Glisp) { Global.CurrentB.cy = 0; Global.CurrentB.cx = 0 }, false})
@@ -256,6 +335,8 @@ func LoadDefaultCommands() {
 	DefineCommand(&CommandFunc{"kill-region", func(env *glisp.Glisp) { doKillRegion() }, false})
 	DefineCommand(&CommandFunc{"yank-region", func(env *glisp.Glisp) { doYankRegion() }, false})
 	DefineCommand(&CommandFunc{"copy-region", func(env *glisp.Glisp) { doCopyRegion() }, false})
+	DefineCommand(&CommandFunc{"yank-pop", func(env *glisp.Glisp) { doYankPop() }, false})
+	DefineCommand(&CommandFunc{"browse-kill-ring", func(env *glisp.Glisp) { browseKillRing() }, false})
 	DefineCommand(&CommandFunc{"forward-word", func(env *glisp.Glisp) { moveForwardWord() }, false})
 	DefineCommand(&CommandFunc{"backward-word", func(env *glisp.Glisp) { moveBackWord() }, false})
 	DefineCommand(&CommandFunc{"backward-kill-word", func(env *glisp.Glisp) { delBackWord() }, false})
@@ -292,6 +373,7 @@ hold Meta (Alt on modern keyboards) and press n.
 - C-w - Kill (cut) the region (the space between the mark and cursor)
 - M-w - Copy the region
 - C-y - Yank (paste) the last thing you killed or copied.
+- M-y - Straight after C-y, replace the yanked text with an older kill.
 
 Current key bindings:
 `, WalkCommandTree(Emacs, ""))
@@ -303,7 +385,20 @@ Current key bindings:
 	DefineCommand(&CommandFunc{"end-macro", func(*glisp.Glisp) { stopRecMacro() }, true})
 	DefineCommand(&CommandFunc{"end-macro-and-run", func(e *glisp.Glisp) { doRunMacro(e) }, true})
 	DefineCommand(&CommandFunc{"kill-buffer-and-window", func(*glisp.Glisp) { KillBufferAndWindow() }, false})
-	DefineCommand(&CommandFunc{"view-messages", func(*glisp.Glisp) { showMessages(Global.messages...) }, false})
+	DefineCommand(&CommandFunc{"view-messages", func(*glisp.Glisp) { showMessagesBuffer() }, false})
+	DefineCommand(&CommandFunc{"quit-window", func(*glisp.Glisp) { quitWindow() }, false})
+	DefineCommand(&CommandFunc{"eval-expression", evalExpression, false})
+	DefineCommand(&CommandFunc{"eval-region", evalRegion, false})
+	DefineCommand(&CommandFunc{"eval-buffer", evalBuffer, false})
+	DefineCommand(&CommandFunc{"reload-init-file", reloadInitFile, false})
+	DefineCommand(&CommandFunc{"list-packages", func(*glisp.Glisp) { listPackages() }, false})
+	DefineCommand(&CommandFunc{"enable-package", enablePackage, false})
+	DefineCommand(&CommandFunc{"disable-package", func(*glisp.Glisp) { disablePackage() }, false})
+	DefineCommand(&CommandFunc{"install-package", installPackageCmd, false})
+	DefineCommand(&CommandFunc{"describe-variable", func(*glisp.Glisp) { describeVariable() }, false})
+	DefineCommand(&CommandFunc{"customize-variable", func(*glisp.Glisp) { customizeVariable() }, false})
+	DefineCommand(&CommandFunc{"scratch-buffer", func(*glisp.Glisp) { scratchBuffer() }, false})
+	DefineCommand(&CommandFunc{"scratch-send-input", scratchSendInput, false})
 	DefineCommand(&CommandFunc{"query-replace", func(*glisp.Glisp) { doQueryReplace() }, false})
 	DefineCommand(&CommandFunc{"replace-string", func(*glisp.Glisp) { doReplaceString() }, false})
 	DefineCommand(&CommandFunc{"what-cursor-position", func(*glisp.Glisp) { whatCursorPosition() }, false})
@@ -331,7 +426,10 @@ Current key bindings:
 	DefineCommand(&CommandFunc{"write-file", func(env *glisp.Glisp) { editorWriteFile(env) }, false})
 	DefineCommand(&CommandFunc{"visit-file", func(env *glisp.Glisp) { editorVisitFile(env) }, false})
 	if Global.debug {
-		DefineCommand(&CommandFunc{"debug-undo", func(*glisp.Glisp) { showMessages(fmt.Sprint(Global.CurrentB.Undo, "\n", Global.CurrentB.Undo.prev)) }, false})
+		DefineCommand(&CommandFunc{"debug-undo", func(*glisp.Glisp) {
+			lines, _ := undoTreeLines(Global.CurrentB)
+			showMessages(lines...)
+		}, false})
 		DefineCommand(&CommandFunc{"debug-universal", func(*glisp.Glisp) { showMessages(fmt.Sprint(Global.Universal), fmt.Sprint(Global.SetUniversal)) }, false})
 	}
 	DefineCommand(&CommandFunc{"repeat", func(env *glisp.Glisp) { RepeatCommand(env) }, true})
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/zhemao/glisp/interpreter"
+)
+
+// An errorRegexp recognises a line of compiler output that points at a place
+// in a file. The numbers are the submatches holding the file name, line and
+// column; a column of 0 means the format doesn't have one.
+type errorRegexp struct {
+	re   *regexp.Regexp
+	file int
+	line int
+	col  int
+}
+
+// Tried in order; the first that matches a line wins. More can be added from
+// lisp with adderrorregexp.
+var errorRegexps = []*errorRegexp{
+	// Python tracebacks: File "foo.py", line 12, in bar
+	{regexp.MustCompile(`^\s*File "([^"]+)", line ([0-9]+)`), 1, 2, 0},
+	// Go: ./foo.go:12:5: undefined: bar, and test failures, which are indented
+	{regexp.MustCompile(`^\s*([^\s:]+\.go):([0-9]+)(?::([0-9]+))?:`), 1, 2, 3},
+	// gcc and most other GNU tools: foo.c:12:5: error: ...
+	{regexp.MustCompile(`^([^\s:]+):([0-9]+):(?:([0-9]+):)? `), 1, 2, 3},
+}
+
+var compileCommand = "make -k"
+
+func compilationLocation(buf *EditorBuffer, line int) (string, int, int, bool) {
+	data := buf.row(line).Data
+	for _, er := range errorRegexps {
+		m := er.re.FindStringSubmatch(data)
+		if m == nil {
+			continue
+		}
+		fn := m[er.file]
+		if !filepath.IsAbs(fn) {
+			fn = filepath.Join(buf.Dir, fn)
+		}
+		ln, _ := strconv.Atoi(m[er.line])
+		col := 0
+		if er.col > 0 && er.col < len(m) && m[er.col] != "" {
+			// Compilers count columns from 1.
+			col, _ = strconv.Atoi(m[er.col])
+			col--
+		}
+		return fn, ln, col, true
+	}
+	return "", 0, 0, false
+}
+
+// The read-only buffer compilations are shown in.
+func compilationBuffer() *EditorBuffer {
+	buf := getOutputBuffer("*compilation*")
+	buf.MajorMode = "compilation"
+	return buf
+}
+
+// Runs command in dir, with its output going to the *compilation* buffer.
+func compile(command, dir string) {
+	buf := compilationBuffer()
+	if p := getBufferProcess(buf); p != nil {
+		kill, _ := editorYesNoPrompt("A compilation process is running; kill it?", false)
+		if !kill {
+			return
+		}
+		p.Sentinel = nil
+		p.Buffer = nil
+		p.Kill()
+	}
+	compileCommand = command
+	buf.Dir = dir
+	buf.setLines([]string{
+		"-*- mode: compilation; default-directory: \"" + dir + "\" -*-",
+		"Compilation started at " + time.Now().Format(time.ANSIC),
+		"",
+		command,
+		"",
+	})
+	setNextErrorBuffer(buf)
+	displayBuffer(buf)
+	p, err := startProcess("compilation", buf, dir, "sh", "-c", command)
+	if err != nil {
+		buf.appendText(err.Error())
+		Global.Input = err.Error()
+		AddErrorMessage(err.Error())
+		return
+	}
+	p.Sentinel = func(p *Process, event string) {
+		if p.Buffer == nil || !bufferExists(p.Buffer) {
+			return
+		}
+		msg := "Compilation " + strings.TrimSpace(event)
+		p.Buffer.appendText("\n" + msg + " at " + time.Now().Format(time.ANSIC))
+		Global.Input = msg
+	}
+	Global.Input = "Compiling: " + command
+}
+
+func doCompile() {
+	command := editorPrompt("Compile command (blank for "+compileCommand+")", nil)
+	if command == "" {
+		command = compileCommand
+	}
+	compile(command, currentDirectory())
+}
+
+func doRecompile() {
+	buf := compilationBuffer()
+	dir := buf.Dir
+	if dir == "" {
+		dir = currentDirectory()
+	}
+	compile(compileCommand, dir)
+}
+
+func killCompilation() {
+	p := getBufferProcess(compilationBuffer())
+	if p == nil {
+		Global.Input = "No compilation process running"
+		return
+	}
+	p.Kill()
+}
+
+func lispAddErrorRegexp(env *glisp.Glisp, name string, args []glisp.Sexp) (glisp.Sexp, error) {
+	if len(args) < 3 || len(args) > 4 {
+		return glisp.SexpNull, glisp.WrongNargs
+	}
+	var pattern string
+	switch t := args[0].(type) {
+	case glisp.SexpStr:
+		pattern = string(t)
+	default:
+		return glisp.SexpNull, errors.New("Arg 1 needs to be a string")
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return glisp.SexpNull, err
+	}
+	groups := []int{0, 0, 0}
+	for i, arg := range args[1:] {
+		switch t := arg.(type) {
+		case glisp.SexpInt:
+			groups[i] = int(t)
+		default:
+			return glisp.SexpNull, errors.New("Group numbers need to be ints")
+		}
+		if groups[i] < 0 || groups[i] > re.NumSubexp() {
+			return glisp.SexpNull, errors.New("No such group in regexp " + pattern)
+		}
+		// Group 0 is the whole match, which is never a file name or line
+		// number; for the column it means there isn't one.
+		if groups[i] == 0 && i < 2 {
+			return glisp.SexpNull, errors.New("The file and line need to be groups in the regexp, not 0")
+		}
+	}
+	// Regexps added later are more specific, so try them first.
+	errorRegexps = append([]*errorRegexp{{re, groups[0], groups[1], groups[2]}}, errorRegexps...)
+	return glisp.SexpNull, nil
+}
+
+func lispClearErrorRegexps(env *glisp.Glisp, name string, args []glisp.Sexp) (glisp.Sexp, error) {
+	errorRegexps = []*errorRegexp{}
+	return glisp.SexpNull, nil
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"strings"
+)
+
+// A diffHunk says that lines [oldStart, oldEnd) of the old text were replaced
+// by lines [newStart, newEnd) of the new text.
+type diffHunk struct {
+	oldStart, oldEnd int
+	newStart, newEnd int
+}
+
+// diffLines returns a minimal list of hunks that turn a into b, in order. It
+// uses Myers' O(ND) algorithm, which is quick when the two texts are mostly
+// the same - the usual case for a formatter.
+func diffLines(a, b []string) []diffHunk {
+	// Lines at the start and end that haven't changed needn't be searched.
+	pre := 0
+	for pre < len(a) && pre < len(b) && a[pre] == b[pre] {
+		pre++
+	}
+	suf := 0
+	for suf < len(a)-pre && suf < len(b)-pre && a[len(a)-1-suf] == b[len(b)-1-suf] {
+		suf++
+	}
+	a, b = a[pre:len(a)-suf], b[pre:len(b)-suf]
+	n, m := len(a), len(b)
+	if n == 0 && m == 0 {
+		return nil
+	}
+
+	// Find the shortest edit script, remembering the furthest reaching path
+	// on each diagonal for every number of edits d.
+	max := n + m
+	v := make([]int, 2*max+2)
+	trace := [][]int{}
+	found := false
+	for d := 0; d <= max && !found; d++ {
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[max+k-1] < v[max+k+1]) {
+				x = v[max+k+1]
+			} else {
+				x = v[max+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[max+k] = x
+			if x >= n && y >= m {
+				found = true
+				break
+			}
+		}
+		trace = append(trace, append([]int(nil), v...))
+	}
+
+	// Walk back through the trace to mark which lines are kept.
+	keptA := make([]bool, n)
+	keptB := make([]bool, m)
+	x, y := n, m
+	for d := len(trace) - 1; d >= 0; d-- {
+		k := x - y
+		var prevk int
+		if d == 0 {
+			prevk = 0
+		} else if k == -d || (k != d && trace[d-1][max+k-1] < trace[d-1][max+k+1]) {
+			prevk = k + 1
+		} else {
+			prevk = k - 1
+		}
+		prevx := 0
+		if d > 0 {
+			prevx = trace[d-1][max+prevk]
+		}
+		prevy := prevx - prevk
+		for x > prevx && y > prevy {
+			x--
+			y--
+			keptA[x] = true
+			keptB[y] = true
+		}
+		x, y = prevx, prevy
+	}
+
+	// Gather up the runs of lines that weren't kept.
+	ret := []diffHunk{}
+	i, j := 0, 0
+	for i < n || j < m {
+		if i < n && j < m && keptA[i] && keptB[j] {
+			i++
+			j++
+			continue
+		}
+		h := diffHunk{i, i, j, j}
+		for i < n && !keptA[i] {
+			i++
+		}
+		for j < m && !keptB[j] {
+			j++
+		}
+		h.oldEnd, h.newEnd = i, j
+		h.oldStart += pre
+		h.oldEnd += pre
+		h.newStart += pre
+		h.newEnd += pre
+		ret = append(ret, h)
+	}
+	return ret
+}
+
+// Works out where line y of the old text ends up, given the hunks between
+// the old and new text. Lines inside a hunk go to the same offset into the
+// replacement, or its last line if it's shorter.
+func diffMapLine(hunks []diffHunk, y int) int {
+	offset := 0
+	for _, h := range hunks {
+		if y < h.oldStart {
+			break
+		}
+		if y < h.oldEnd {
+			if h.newEnd == h.newStart {
+				return h.newStart
+			}
+			ny := h.newStart + y - h.oldStart
+			if ny >= h.newEnd {
+				ny = h.newEnd - 1
+			}
+			return ny
+		}
+		offset = h.newEnd - h.oldEnd
+	}
+	return y + offset
+}
+
+// Replaces the text of the current buffer with text, touching only the lines
+// that differ. All of the changes are undone and redone together as one edit,
+// and point and mark stay on the same lines of text as before.
+func bufReplaceText(text string) {
+	buf := Global.CurrentB
+	if !buf.checkWritable() {
+		return
+	}
+	old := buf.lines()
+	lines := strings.Split(text, "\n")
+	hunks := diffLines(old, lines)
+	if len(hunks) == 0 {
+		return
+	}
+	cx, cy := buf.cx, diffMapLine(hunks, buf.cy)
+	markx, marky := buf.MarkX, diffMapLine(hunks, buf.MarkY)
+
+	// Work from the bottom up so that the line numbers of the hunks still
+	// to do aren't disturbed.
+	first := true
+	for i := len(hunks) - 1; i >= 0; i-- {
+		h := hunks[i]
+		repl := strings.Join(lines[h.newStart:h.newEnd], "\n")
+		var startc, startl, endc, endl int
+		if h.oldEnd < len(old) {
+			// Replace whole lines, up to the start of the next kept line.
+			startc, startl, endc, endl = 0, h.oldStart, 0, h.oldEnd
+			if h.newEnd > h.newStart {
+				repl += "\n"
+			}
+		} else if h.oldStart > 0 {
+			// The hunk runs to the end of the buffer; hang it off the end
+			// of the last kept line instead.
+			startl, endl = h.oldStart-1, h.oldEnd-1
+			startc, endc = buf.row(startl).Size, buf.row(endl).Size
+			if h.newEnd > h.newStart {
+				repl = "\n" + repl
+			}
+		} else {
+			startc, startl = 0, 0
+			endl = h.oldEnd - 1
+			endc = buf.row(endl).Size
+		}
+		if startc != endc || startl != endl {
+			killed := bufKillRegion(buf, startc, endc, startl, endl)
+			editorAddRegionUndo(false, startc, endc, startl, endl, killed)
+			buf.Undo.paired = !first
+			first = false
+		}
+		if repl != "" {
+			sx, sy := spitRegion(startc, startl, repl)
+			editorAddRegionUndo(true, sx, buf.cx, sy, buf.cy, repl)
+			buf.Undo.paired = !first
+			first = false
+		}
+	}
+	if buf.Highlighter != nil {
+		buf.Highlight()
+	}
+
+	buf.cy = cy
+	if buf.cy >= buf.NumRows {
+		buf.cy = buf.NumRows - 1
+	}
+	buf.cx = cx
+	if buf.cx > buf.row(buf.cy).Size {
+		buf.cx = buf.row(buf.cy).Size
+	}
+	buf.prefcx = buf.cx
+	buf.MarkY = marky
+	if buf.MarkY >= buf.NumRows {
+		buf.MarkY = buf.NumRows - 1
+	}
+	buf.MarkX = markx
+	if buf.MarkX > buf.row(buf.MarkY).Size {
+		buf.MarkX = buf.row(buf.MarkY).Size
+	}
+}
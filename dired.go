@@ -1,53 +1,527 @@
 package main
 
 import (
+	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
+	"os"
 	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/zhemao/glisp/interpreter"
 )
 
+// A file's line in a dired buffer: a mark, the permissions, size, time and
+// name. The mark is ' ', '*' for marked or 'D' for flagged for deletion.
+var diredLineRegexp = regexp.MustCompile(`^(.) (\S+) +([0-9]+) (.{12}) (.+)$`)
+
+func diredLine(mark byte, dir, name string, fi os.FileInfo) string {
+	layout := "Jan _2 15:04"
+	if time.Since(fi.ModTime()) > 180*24*time.Hour || fi.ModTime().After(time.Now()) {
+		layout = "Jan _2  2006"
+	}
+	if fi.IsDir() {
+		name += "/"
+	} else if fi.Mode()&os.ModeSymlink != 0 {
+		if target, err := os.Readlink(filepath.Join(dir, name)); err == nil {
+			name += " -> " + target
+		}
+	}
+	return fmt.Sprintf("%c %s %10d %s %s", mark, fi.Mode().String(), fi.Size(), fi.ModTime().Format(layout), name)
+}
+
+// Returns the name of the file on line of a dired buffer, and where it
+// starts, or "" if the line isn't a file.
+func diredNameAt(buf *EditorBuffer, line int) (string, int) {
+	if line < 0 || line >= buf.NumRows {
+		return "", 0
+	}
+	m := diredLineRegexp.FindStringSubmatchIndex(buf.row(line).Data)
+	if m == nil {
+		return "", 0
+	}
+	data := buf.row(line).Data
+	name := data[m[10]:m[11]]
+	if strings.HasPrefix(data[m[4]:m[5]], "L") {
+		if i := strings.Index(name, " -> "); i >= 0 {
+			name = name[:i]
+		}
+	}
+	return strings.TrimSuffix(name, "/"), m[10]
+}
+
+func diredFileAt(buf *EditorBuffer, line int) string {
+	name, _ := diredNameAt(buf, line)
+	if name == "" {
+		return ""
+	}
+	return filepath.Join(buf.Dir, name)
+}
+
+// Lists dir in buf, keeping the marks of files that are still there.
+func diredRead(buf *EditorBuffer, dir string) error {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	marks := map[string]byte{}
+	if buf.Dir == dir {
+		for i := 0; i < buf.NumRows; i++ {
+			if name, _ := diredNameAt(buf, i); name != "" {
+				marks[name] = buf.row(i).Data[0]
+			}
+		}
+	}
+	buf.Dir = dir
+	buf.MajorMode = "dired"
+	// Letters are dired commands rather than inserting themselves, but the
+	// text can be edited like any other buffer's; g puts it back.
+	if buf.Modes == nil {
+		buf.AddDefaultModes()
+	}
+	buf.setMode("no-self-insert-mode", true)
+	lines := []string{"  " + dir + ":"}
+	if up, err := os.Lstat(filepath.Join(dir, "..")); err == nil && dir != filepath.Dir(dir) {
+		lines = append(lines, diredLine(' ', dir, "..", up))
+	}
+	for _, f := range files {
+		mark, ok := marks[f.Name()]
+		if !ok {
+			mark = ' '
+		}
+		lines = append(lines, diredLine(mark, dir, f.Name(), f))
+	}
+	buf.setLines(lines)
+	return nil
+}
+
+// Puts point on the file called name, or on line if it has gone.
+func diredGoto(buf *EditorBuffer, name string, line int) {
+	for i := 0; i < buf.NumRows; i++ {
+		if n, _ := diredNameAt(buf, i); n != "" && n == name {
+			line = i
+			break
+		}
+	}
+	if line >= buf.NumRows {
+		line = buf.NumRows - 1
+	}
+	if line < 1 {
+		// Not the header
+		line = 1
+	}
+	if line >= buf.NumRows {
+		line = 0
+	}
+	buf.cy = line
+	_, buf.cx = diredNameAt(buf, line)
+	buf.prefcx = buf.cx
+}
+
+// Shows dir in the *dired* buffer, with point on the file called name.
+func dired(dir, name string) {
+	buf := getSpecialBuffer("*dired*")
+	buf.Dir = ""
+	if err := diredRead(buf, dir); err != nil {
+		Global.Input = err.Error()
+		AddErrorMessage(err.Error())
+		return
+	}
+	switchToBuffer(buf)
+	diredGoto(buf, name, 1)
+}
+
 func DiredMode(env *glisp.Glisp) {
-	dir, perr := filepath.Abs("./")
-	if perr != nil {
-		Global.Input = perr.Error()
-		AddErrorMessage(perr.Error())
+	def := currentDirectory()
+	dir := tabCompletedEditorPrompt("Dired (blank for "+def+")", tabCompleteFilename)
+	if dir == "" {
+		dir = def
+	}
+	dir, err := AbsPath(dir)
+	if err != nil {
+		Global.Input = err.Error()
+		AddErrorMessage(err.Error())
 		return
 	}
-	done := false
-	for !done {
-		files, err := ioutil.ReadDir(dir)
+	name := ""
+	if Global.CurrentB.Filename != "" && filepath.Dir(Global.CurrentB.Filename) == dir {
+		name = filepath.Base(Global.CurrentB.Filename)
+	}
+	dired(filepath.Clean(dir), name)
+}
+
+// Runs f on the current buffer if it's a dired buffer.
+func withDired(f func(buf *EditorBuffer)) {
+	buf := Global.CurrentB
+	if buf.MajorMode != "dired" || buf.Dir == "" {
+		Global.Input = "Not in a dired buffer"
+		return
+	}
+	f(buf)
+}
+
+func diredRevert() {
+	withDired(func(buf *EditorBuffer) {
+		name, _ := diredNameAt(buf, buf.cy)
+		line := buf.cy
+		if err := diredRead(buf, buf.Dir); err != nil {
+			Global.Input = err.Error()
+			AddErrorMessage(err.Error())
+			return
+		}
+		diredGoto(buf, name, line)
+	})
+}
+
+func diredFindFile(env *glisp.Glisp) {
+	withDired(func(buf *EditorBuffer) {
+		fn := diredFileAt(buf, buf.cy)
+		if fn == "" {
+			Global.Input = "No file on this line"
+			return
+		}
+		fi, err := os.Stat(fn)
 		if err != nil {
 			Global.Input = err.Error()
 			AddErrorMessage(err.Error())
 			return
 		}
-		choices := []string{"<Cancel>", "../"}
-		for _, f := range files {
-			suffix := ""
-			if f.IsDir() {
-				suffix += "/"
+		if fi.IsDir() {
+			name := ""
+			if fn == filepath.Dir(buf.Dir) {
+				// Going up; keep our place.
+				name = filepath.Base(buf.Dir)
 			}
-			suffix += " " + f.Mode().String()
-			choices = append(choices, f.Name()+suffix)
+			dired(fn, name)
+		} else if b := findFileBuffer(fn); b != nil {
+			switchToBuffer(b)
+		} else {
+			openFile(fn, env)
 		}
-		choice := editorChoiceIndex("Dired: "+dir, choices, 0)
-		filechosen := choice - 2
-		if filechosen == -2 {
+	})
+}
+
+func diredUpDirectory() {
+	withDired(func(buf *EditorBuffer) {
+		dired(filepath.Dir(buf.Dir), filepath.Base(buf.Dir))
+	})
+}
+
+// Sets the mark on the current line and moves to the next.
+func diredSetMark(mark byte) {
+	withDired(func(buf *EditorBuffer) {
+		name, _ := diredNameAt(buf, buf.cy)
+		if name == "" || name == ".." {
+			Global.Input = "No file on this line"
 			return
-		} else if filechosen == -1 {
-			dir += "/.."
-		} else if files[filechosen].IsDir() {
-			dir += "/" + files[filechosen].Name()
-		} else {
-			openFile(dir+"/"+files[filechosen].Name(), env)
-			done = true
 		}
-		dir, err = filepath.Abs(dir)
+		row := buf.row(buf.cy)
+		row.Data = string(mark) + row.Data[1:]
+		rowUpdateRender(row, buf)
+		if buf.cy < buf.NumRows-1 {
+			diredGoto(buf, "", buf.cy+1)
+		}
+	})
+}
+
+func diredUnmarkAll() {
+	withDired(func(buf *EditorBuffer) {
+		n := 0
+		for i := 0; i < buf.NumRows; i++ {
+			if name, _ := diredNameAt(buf, i); name != "" && buf.row(i).Data[0] != ' ' {
+				row := buf.row(i)
+				row.Data = " " + row.Data[1:]
+				rowUpdateRender(row, buf)
+				n++
+			}
+		}
+		Global.Input = fmt.Sprintf("Removed %d marks", n)
+	})
+}
+
+// The files carrying mark, or if there aren't any, the file at point.
+func diredMarkedFiles(buf *EditorBuffer, mark byte) []string {
+	ret := []string{}
+	for i := 0; i < buf.NumRows; i++ {
+		if name, _ := diredNameAt(buf, i); name != "" && buf.row(i).Data[0] == mark {
+			ret = append(ret, filepath.Join(buf.Dir, name))
+		}
+	}
+	if len(ret) == 0 {
+		if name, _ := diredNameAt(buf, buf.cy); name != "" && name != ".." {
+			ret = append(ret, filepath.Join(buf.Dir, name))
+		}
+	}
+	return ret
+}
+
+// File names typed in a dired buffer are relative to its directory.
+func diredExpand(buf *EditorBuffer, fn string) (string, error) {
+	if strings.HasPrefix(fn, "~") || filepath.IsAbs(fn) {
+		return AbsPath(fn)
+	}
+	return filepath.Join(buf.Dir, fn), nil
+}
+
+func describeFiles(files []string) string {
+	if len(files) == 1 {
+		return filepath.Base(files[0])
+	}
+	return fmt.Sprintf("%d files", len(files))
+}
+
+// Reports errors from a dired operation on several files, and refreshes.
+func diredFinish(buf *EditorBuffer, verb string, files []string, errs []error) {
+	for _, err := range errs {
+		AddErrorMessage(err.Error())
+	}
+	if len(errs) == 1 && len(files) == 1 {
+		Global.Input = errs[0].Error()
+	} else if len(errs) > 0 {
+		Global.Input = fmt.Sprintf("Failed on %d of %s; see *Messages*", len(errs), describeFiles(files))
+	} else {
+		Global.Input = verb + " " + describeFiles(files)
+	}
+	name, _ := diredNameAt(buf, buf.cy)
+	line := buf.cy
+	if err := diredRead(buf, buf.Dir); err != nil {
+		AddErrorMessage(err.Error())
+	}
+	diredGoto(buf, name, line)
+}
+
+func diredDoFlaggedDelete() {
+	withDired(func(buf *EditorBuffer) {
+		files := []string{}
+		for i := 0; i < buf.NumRows; i++ {
+			if name, _ := diredNameAt(buf, i); name != "" && buf.row(i).Data[0] == 'D' {
+				files = append(files, filepath.Join(buf.Dir, name))
+			}
+		}
+		if len(files) == 0 {
+			Global.Input = "No files flagged for deletion"
+			return
+		}
+		ok, err := editorYesNoPrompt("Delete "+describeFiles(files)+" (directories and all they contain)?", false)
+		if err != nil || !ok {
+			return
+		}
+		errs := []error{}
+		for _, fn := range files {
+			if err := os.RemoveAll(fn); err != nil {
+				errs = append(errs, err)
+			}
+		}
+		diredFinish(buf, "Deleted", files, errs)
+	})
+}
+
+// Asks where to put files for a rename or copy. With one file, the answer is
+// the new name unless it's a directory; with several it has to be a
+// directory. Returns a function giving the destination of each file.
+func diredTarget(buf *EditorBuffer, verb string, files []string) func(string) string {
+	ans := tabCompletedEditorPrompt(verb+" "+describeFiles(files)+" to", tabCompleteFilename)
+	if ans == "" {
+		Global.Input = "Cancelled."
+		return nil
+	}
+	dest, err := diredExpand(buf, ans)
+	if err != nil {
+		Global.Input = err.Error()
+		return nil
+	}
+	fi, err := os.Stat(dest)
+	if err == nil && fi.IsDir() {
+		return func(fn string) string { return filepath.Join(dest, filepath.Base(fn)) }
+	}
+	if len(files) > 1 {
+		Global.Input = dest + " is not a directory"
+		return nil
+	}
+	return func(fn string) string { return dest }
+}
+
+func diredDoRename() {
+	withDired(func(buf *EditorBuffer) {
+		files := diredMarkedFiles(buf, '*')
+		if len(files) == 0 {
+			Global.Input = "No file on this line"
+			return
+		}
+		dest := diredTarget(buf, "Rename", files)
+		if dest == nil {
+			return
+		}
+		errs := []error{}
+		for _, fn := range files {
+			if err := renameFile(fn, dest(fn)); err != nil {
+				errs = append(errs, err)
+			}
+		}
+		diredFinish(buf, "Renamed", files, errs)
+	})
+}
+
+// Renames a file, without replacing one that's already there, and makes any
+// buffer visiting it follow.
+func renameFile(from, to string) error {
+	if _, err := os.Lstat(to); err == nil {
+		return &os.LinkError{Op: "rename", Old: from, New: to, Err: os.ErrExist}
+	}
+	if err := os.Rename(from, to); err != nil {
+		return err
+	}
+	if b := findFileBuffer(from); b != nil {
+		b.Filename = to
+		b.UpdateRenderName()
+	}
+	return nil
+}
+
+func diredDoCopy() {
+	withDired(func(buf *EditorBuffer) {
+		files := diredMarkedFiles(buf, '*')
+		if len(files) == 0 {
+			Global.Input = "No file on this line"
+			return
+		}
+		dest := diredTarget(buf, "Copy", files)
+		if dest == nil {
+			return
+		}
+		errs := []error{}
+		copied := []string{}
+		for _, fn := range files {
+			to := dest(fn)
+			if _, err := os.Lstat(to); err == nil {
+				ok, err := editorYesNoPrompt("Overwrite "+to+"?", false)
+				if err != nil {
+					break
+				} else if !ok {
+					continue
+				}
+			}
+			copied = append(copied, fn)
+			if err := copyTree(fn, to); err != nil {
+				errs = append(errs, err)
+			}
+		}
+		if len(copied) == 0 {
+			Global.Input = "Nothing copied"
+			return
+		}
+		diredFinish(buf, "Copied", copied, errs)
+	})
+}
+
+func copyFile(from, to string, mode os.FileMode) error {
+	in, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(to, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode.Perm())
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// Copies a file, or a directory and everything in it. Files already at the
+// destination are overwritten, so callers should ask first.
+func copyTree(from, to string) error {
+	if rel, err := filepath.Rel(from, to); err == nil && !strings.HasPrefix(rel, "..") {
+		return &os.LinkError{Op: "copy", Old: from, New: to, Err: errors.New("can't copy a directory into itself")}
+	}
+	return filepath.Walk(from, func(fn string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(from, fn)
+		if err != nil {
+			return err
+		}
+		dest := filepath.Join(to, rel)
+		switch {
+		case fi.IsDir():
+			return os.MkdirAll(dest, fi.Mode().Perm())
+		case fi.Mode()&os.ModeSymlink != 0:
+			target, err := os.Readlink(fn)
+			if err != nil {
+				return err
+			}
+			// The user has said it's all right to overwrite what's there.
+			if fi, err := os.Lstat(dest); err == nil && !fi.IsDir() {
+				os.Remove(dest)
+			}
+			return os.Symlink(target, dest)
+		case fi.Mode().IsRegular():
+			return copyFile(fn, dest, fi.Mode())
+		}
+		return nil
+	})
+}
+
+func diredCreateDirectory() {
+	withDired(func(buf *EditorBuffer) {
+		ans := tabCompletedEditorPrompt("Create directory", tabCompleteFilename)
+		if ans == "" {
+			Global.Input = "Cancelled."
+			return
+		}
+		dir, err := diredExpand(buf, ans)
+		if err == nil {
+			err = os.MkdirAll(dir, 0777)
+		}
 		if err != nil {
 			Global.Input = err.Error()
 			AddErrorMessage(err.Error())
 			return
 		}
-	}
+		if err := diredRead(buf, buf.Dir); err != nil {
+			AddErrorMessage(err.Error())
+		}
+		name := filepath.Base(dir)
+		if rel, err := filepath.Rel(buf.Dir, dir); err == nil {
+			// Made inside a new directory here; go to that.
+			name = strings.Split(filepath.ToSlash(rel), "/")[0]
+		}
+		diredGoto(buf, name, buf.cy)
+		Global.Input = "Created " + dir
+	})
+}
+
+func diredDoChmod() {
+	withDired(func(buf *EditorBuffer) {
+		files := diredMarkedFiles(buf, '*')
+		if len(files) == 0 {
+			Global.Input = "No file on this line"
+			return
+		}
+		ans := editorPrompt("Change mode of "+describeFiles(files)+" to (octal)", nil)
+		if ans == "" {
+			Global.Input = "Cancelled."
+			return
+		}
+		mode, err := strconv.ParseUint(ans, 8, 32)
+		if err != nil || mode > 0777 {
+			Global.Input = ans + " is not an octal file mode, such as 644"
+			return
+		}
+		errs := []error{}
+		for _, fn := range files {
+			if err := os.Chmod(fn, os.FileMode(mode)); err != nil {
+				errs = append(errs, err)
+			}
+		}
+		diredFinish(buf, "Changed mode of", files, errs)
+	})
 }
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/zhemao/glisp/interpreter"
+)
+
+// Runs src in env, the interpreter every command is given, and returns the
+// value of the last expression in it. Errors are logged.
+func evalLisp(env *glisp.Glisp, src string) (glisp.Sexp, error) {
+	ret, err := evalForms(env, src)
+	if err != nil {
+		AddErrorMessage("Lisp error: " + err.Error())
+		return glisp.SexpNull, err
+	}
+	return ret, nil
+}
+
+// Evaluates src and shows the result, or inserts it at point if there's a
+// universal argument.
+func evalAndShow(env *glisp.Glisp, src string) {
+	ret, err := evalLisp(env, src)
+	if err != nil {
+		Global.Input = "Lisp error: " + err.Error()
+		return
+	}
+	if Global.SetUniversal {
+		doYankText(ret.SexpString())
+		return
+	}
+	Global.Input = ret.SexpString()
+}
+
+func evalExpression(env *glisp.Glisp) {
+	src := editorPrompt("Eval", nil)
+	if src == "" {
+		Global.Input = "Cancelled."
+		return
+	}
+	evalAndShow(env, src)
+}
+
+func evalRegion(env *glisp.Glisp) {
+	src, err := regionCmd(bufCopyRegion)
+	if err != nil {
+		return
+	}
+	Global.CurrentB.regionActive = false
+	evalAndShow(env, src)
+}
+
+func evalBuffer(env *glisp.Glisp) {
+	buf := Global.CurrentB
+	if buf.NumRows == 0 {
+		Global.Input = "Buffer is empty"
+		return
+	}
+	src := getRegionText(buf, 0, buf.row(buf.NumRows-1).Size, 0, buf.NumRows-1)
+	if _, err := evalLisp(env, src); err != nil {
+		Global.Input = "Lisp error: " + err.Error()
+		return
+	}
+	Global.Input = "Evaluated " + buf.getRenderName()
+}
+
+// The *scratch* buffer is a Lisp REPL: type an expression after the prompt
+// and RET evaluates it, printing the result and a new prompt.
+const scratchPrompt = "> "
+
+func scratchBuffer() {
+	buf := findBufferByName("*scratch*")
+	if buf == nil {
+		buf = getSpecialBuffer("*scratch*")
+		buf.AddDefaultModes()
+		buf.MajorMode = "lisp-interaction"
+		buf.setLines([]string{
+			";; Lisp evaluation. Type an expression after the prompt and RET",
+			";; to evaluate it; RET on an earlier input copies it down here.",
+			scratchPrompt,
+		})
+		buf.cy, buf.cx = buf.NumRows-1, len(scratchPrompt)
+	}
+	switchToBuffer(buf)
+}
+
+// The row of the last prompt in buf, or -1 if there isn't one.
+func lastScratchPrompt(buf *EditorBuffer) int {
+	for i := buf.NumRows - 1; i >= 0; i-- {
+		if strings.HasPrefix(buf.row(i).Data, scratchPrompt) {
+			return i
+		}
+	}
+	return -1
+}
+
+// Reports whether src has as many closing brackets as opening ones, not
+// counting those in strings, comments and characters.
+func lispInputComplete(src string) bool {
+	return !scanLispForms(src, func(int, int) {})
+}
+
+// RET in *scratch*. At the last prompt, evaluates what's been typed after it
+// if it's a whole expression, and otherwise starts a new line of it. On an
+// earlier prompt, copies that input to the end to be edited and run again.
+func scratchSendInput(env *glisp.Glisp) {
+	buf := Global.CurrentB
+	prompt := lastScratchPrompt(buf)
+	if prompt < 0 {
+		buf.appendText("\n" + scratchPrompt)
+		buf.cy, buf.cx = buf.NumRows-1, buf.row(buf.NumRows-1).Size
+		return
+	}
+	if buf.cy < prompt {
+		if buf.cy < buf.NumRows && strings.HasPrefix(buf.row(buf.cy).Data, scratchPrompt) {
+			old := strings.TrimPrefix(buf.row(buf.cy).Data, scratchPrompt)
+			buf.cy, buf.cx = buf.NumRows-1, buf.row(buf.NumRows-1).Size
+			editorInsertStr(old)
+		}
+		return
+	}
+	last := buf.NumRows - 1
+	src := getRegionText(buf, len(scratchPrompt), buf.row(last).Size, prompt, last)
+	if !lispInputComplete(src) {
+		editorInsertNewline(false)
+		return
+	}
+	out := ""
+	if strings.TrimSpace(src) != "" {
+		ret, err := evalLisp(env, src)
+		if err != nil {
+			out = "Error: " + err.Error() + "\n"
+		} else {
+			out = ret.SexpString() + "\n"
+		}
+	}
+	buf.cy, buf.cx = last, buf.row(last).Size
+	buf.appendText("\n" + out + scratchPrompt)
+}
@@ -0,0 +1,372 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/zhemao/glisp/interpreter"
+)
+
+// A single line from a .gitignore file.
+type ignoreRule struct {
+	base     string // The directory holding the .gitignore
+	pattern  string
+	negate   bool
+	dirOnly  bool
+	anchored bool // Match against the path from base, not just the name
+}
+
+func readIgnoreFile(dir string) []ignoreRule {
+	data, err := ioutil.ReadFile(filepath.Join(dir, ".gitignore"))
+	if err != nil {
+		return nil
+	}
+	ret := []ignoreRule{}
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimRight(line, " \r")
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		rule := ignoreRule{base: dir}
+		if line[0] == '!' {
+			rule.negate = true
+			line = line[1:]
+		} else if line[0] == '\\' {
+			line = line[1:]
+		}
+		if strings.HasSuffix(line, "/") {
+			rule.dirOnly = true
+			line = strings.TrimRight(line, "/")
+		}
+		if strings.Contains(line, "/") {
+			rule.anchored = true
+			line = strings.TrimPrefix(line, "/")
+		}
+		rule.pattern = line
+		ret = append(ret, rule)
+	}
+	return ret
+}
+
+// Matches a slash separated path against a glob, where ** stands for any
+// number of directories.
+func ignoreGlobMatch(pattern, name []string) bool {
+	if len(pattern) == 0 {
+		return len(name) == 0
+	}
+	if pattern[0] == "**" {
+		for i := 0; i <= len(name); i++ {
+			if ignoreGlobMatch(pattern[1:], name[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(name) == 0 {
+		return false
+	}
+	ok, _ := path.Match(pattern[0], name[0])
+	return ok && ignoreGlobMatch(pattern[1:], name[1:])
+}
+
+func (r ignoreRule) match(fn string, isDir bool) bool {
+	if r.dirOnly && !isDir {
+		return false
+	}
+	if !r.anchored {
+		ok, _ := path.Match(r.pattern, filepath.Base(fn))
+		return ok
+	}
+	rel, err := filepath.Rel(r.base, fn)
+	if err != nil {
+		return false
+	}
+	return ignoreGlobMatch(strings.Split(r.pattern, "/"), strings.Split(filepath.ToSlash(rel), "/"))
+}
+
+// Reports whether fn is ignored. As in git, the last rule that matches wins.
+func isIgnored(rules []ignoreRule, fn string, isDir bool) bool {
+	ret := false
+	for _, r := range rules {
+		if r.match(fn, isDir) {
+			ret = !r.negate
+		}
+	}
+	return ret
+}
+
+// Collects the .gitignore rules that apply to dir from the directories above
+// it, up to the top of the git repository it's in.
+func parentIgnoreRules(dir string) []ignoreRule {
+	dirs := []string{}
+	for d := filepath.Dir(dir); ; d = filepath.Dir(d) {
+		dirs = append([]string{d}, dirs...)
+		if _, err := os.Stat(filepath.Join(d, ".git")); err == nil {
+			break
+		}
+		if d == filepath.Dir(d) {
+			// Not in a repository; no parent rules apply.
+			return nil
+		}
+	}
+	ret := []ignoreRule{}
+	for _, d := range dirs {
+		ret = append(ret, readIgnoreFile(d)...)
+	}
+	return ret
+}
+
+// The results of a search through a directory tree.
+type grepSearch struct {
+	pattern *regexp.Regexp
+	files   string // Glob that file names have to match; "" for all files
+	dir     string
+	results []string
+	matches int
+}
+
+func (g *grepSearch) walk(dir string, rules []ignoreRule) {
+	rules = append(rules, readIgnoreFile(dir)...)
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		AddErrorMessage(err.Error())
+		return
+	}
+	for _, f := range files {
+		fn := filepath.Join(dir, f.Name())
+		if f.Name() == ".git" || isIgnored(rules, fn, f.IsDir()) {
+			continue
+		}
+		if f.IsDir() {
+			g.walk(fn, rules)
+		} else if f.Mode().IsRegular() {
+			if g.files != "" {
+				if ok, _ := filepath.Match(g.files, f.Name()); !ok {
+					continue
+				}
+			}
+			g.searchFile(fn)
+		}
+	}
+}
+
+func (g *grepSearch) searchFile(fn string) {
+	data, err := ioutil.ReadFile(fn)
+	if err != nil {
+		AddErrorMessage(err.Error())
+		return
+	}
+	head := data
+	if len(head) > 8000 {
+		head = head[:8000]
+	}
+	if bytes.IndexByte(head, 0) >= 0 {
+		// Binary file
+		return
+	}
+	rel, err := filepath.Rel(g.dir, fn)
+	if err != nil {
+		rel = fn
+	}
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSuffix(line, "\r")
+		if g.pattern.MatchString(line) {
+			g.results = append(g.results, fmt.Sprintf("%s:%d:%s", rel, i+1, line))
+			g.matches++
+		}
+	}
+}
+
+// The pattern of the last grep, used to put the cursor on the match when
+// visiting a result.
+var grepPattern *regexp.Regexp
+
+var grepLocationRegexp = regexp.MustCompile(`^(.+?):([0-9]+):`)
+
+func grepLocation(buf *EditorBuffer, line int) (string, int, int, bool) {
+	data := buf.row(line).Data
+	m := grepLocationRegexp.FindStringSubmatch(data)
+	if m == nil {
+		return "", 0, 0, false
+	}
+	ln, _ := strconv.Atoi(m[2])
+	col := 0
+	if grepPattern != nil {
+		if loc := grepPattern.FindStringIndex(data[len(m[0]):]); loc != nil {
+			col = loc[0]
+		}
+	}
+	return filepath.Join(buf.Dir, m[1]), ln, col, true
+}
+
+// Searches every file under dir whose name matches files for pattern, and
+// shows the matching lines in the *grep* buffer.
+func grepDirectory(pattern, files, dir string) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		Global.Input = "Couldn't compile regexp " + pattern + ": " + err.Error()
+		return
+	}
+	dir, err = AbsPath(dir)
+	if err != nil {
+		Global.Input = err.Error()
+		AddErrorMessage(err.Error())
+		return
+	}
+	g := &grepSearch{re, files, dir, []string{}, 0}
+	g.walk(dir, parentIgnoreRules(dir))
+
+	buf := getOutputBuffer("*grep*")
+	buf.MajorMode = "grep"
+	buf.Dir = dir
+	lines := []string{"Grep for " + pattern + " in " + dir, ""}
+	lines = append(lines, g.results...)
+	lines = append(lines, "", fmt.Sprintf("Grep finished with %d matches found", g.matches))
+	buf.setLines(lines)
+	grepPattern = re
+	setNextErrorBuffer(buf)
+	displayBuffer(buf)
+	Global.Input = lines[len(lines)-1]
+}
+
+// The directory the current buffer's file is in, for a default.
+func currentDirectory() string {
+	if Global.CurrentB.Filename != "" {
+		return filepath.Dir(Global.CurrentB.Filename)
+	}
+	if Global.CurrentB.Dir != "" {
+		return Global.CurrentB.Dir
+	}
+	cwd, err := os.Getwd()
+	if err != nil {
+		return "."
+	}
+	return cwd
+}
+
+func doGrep() {
+	pattern := editorPrompt("Grep for regexp", nil)
+	if pattern == "" {
+		Global.Input = "Cancelled."
+		return
+	}
+	grepDirectory(pattern, "", currentDirectory())
+}
+
+func doRgrep() {
+	pattern := editorPrompt("Search for regexp", nil)
+	if pattern == "" {
+		Global.Input = "Cancelled."
+		return
+	}
+	files := editorPrompt("In files (blank for all)", nil)
+	dir := tabCompletedEditorPrompt("Base directory (blank for "+currentDirectory()+")", tabCompleteFilename)
+	if dir == "" {
+		dir = currentDirectory()
+	}
+	grepDirectory(pattern, files, dir)
+}
+
+// Buffers that next-error can step through, and how to find the file
+// location a line of each refers to, by major mode.
+var locationParsers = map[string]func(*EditorBuffer, int) (string, int, int, bool){
+	"grep":        grepLocation,
+	"compilation": compilationLocation,
+}
+
+// The buffer next-error and previous-error step through, and the line of the
+// result that was visited last.
+var nextErrorBuffer *EditorBuffer
+var nextErrorLine int
+
+func setNextErrorBuffer(buf *EditorBuffer) {
+	nextErrorBuffer = buf
+	nextErrorLine = -1
+}
+
+// Opens fn with point at line ln (counting from 1) and column col, reusing
+// its buffer if it's already open.
+func visitLocation(fn string, ln, col int, env *glisp.Glisp) {
+	buf := findFileBuffer(fn)
+	if buf != nil {
+		switchToBuffer(buf)
+	} else {
+		openFile(fn, env)
+		buf = Global.CurrentB
+	}
+	if ln > buf.NumRows {
+		ln = buf.NumRows
+	}
+	if ln < 1 {
+		ln = 1
+	}
+	buf.cy = ln - 1
+	buf.cx = 0
+	if buf.cy < buf.NumRows && col <= buf.row(buf.cy).Size {
+		buf.cx = col
+	}
+	buf.prefcx = buf.cx
+	buf.rowoff = buf.NumRows
+}
+
+// Visits the location on line of the results buffer buf. The file is shown
+// in the other window if buf is the current window, otherwise in this one.
+func visitResult(buf *EditorBuffer, line int, env *glisp.Glisp) bool {
+	parse := locationParsers[buf.MajorMode]
+	if parse == nil || line < 0 || line >= buf.NumRows {
+		return false
+	}
+	fn, ln, col, ok := parse(buf, line)
+	if !ok {
+		return false
+	}
+	setNextErrorBuffer(buf)
+	nextErrorLine = line
+	if _, err := os.Stat(fn); err != nil {
+		Global.Input = err.Error()
+		return true
+	}
+	buf.cy = line
+	buf.cx = 0
+	buf.prefcx = 0
+	if Global.CurrentB == buf {
+		callFunOtherWindow(func() { visitLocation(fn, ln, col, env) })
+	} else {
+		displayBuffer(buf)
+		visitLocation(fn, ln, col, env)
+	}
+	return true
+}
+
+// Runs on RET in a results buffer.
+func gotoResult(env *glisp.Glisp) {
+	buf := Global.CurrentB
+	if !visitResult(buf, buf.cy, env) {
+		Global.Input = "No location on this line"
+	}
+}
+
+func nextError(env *glisp.Glisp, dir int) {
+	buf := nextErrorBuffer
+	if buf == nil || locationParsers[buf.MajorMode] == nil || !bufferExists(buf) {
+		Global.Input = "No grep or compilation results to visit"
+		return
+	}
+	for line := nextErrorLine + dir; 0 <= line && line < buf.NumRows; line += dir {
+		if visitResult(buf, line, env) {
+			return
+		}
+	}
+	if dir > 0 {
+		Global.Input = "No more results"
+	} else {
+		Global.Input = "No earlier results"
+	}
+}
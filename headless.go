@@ -0,0 +1,44 @@
+package main
+
+import (
+	"github.com/zhemao/glisp/interpreter"
+)
+
+// StartHeadless sets up a fresh editor that draws on a width by height
+// VirtualScreen instead of the terminal, with the default configuration
+// loaded but not the user's rc file. It is meant for driving the editor from
+// tests.
+func StartHeadless(width, height int) (*VirtualScreen, *glisp.Glisp) {
+	InitEditor()
+	vs := NewVirtualScreen(width, height)
+	screen = vs
+	keysrc = NewScriptedKeys("")
+	if defs == nil {
+		LoadSyntaxDefs()
+	}
+	env := NewLispInterp(false)
+	Global.Input = ""
+	return vs, env
+}
+
+// RunKeys feeds a key sequence (in the format taken by NewScriptedKeys) into
+// the editor as if it had been typed, then redraws the screen. Prompts opened
+// along the way read their input from the same sequence.
+func RunKeys(env *glisp.Glisp, seq string) {
+	keys := NewScriptedKeys(seq)
+	oldsrc := keysrc
+	keysrc = keys
+	defer func() { keysrc = oldsrc }()
+	for !keys.Done() && !Global.quit {
+		runTopLevelKey(keys.PollKey(), env)
+	}
+	editorRefreshScreen()
+}
+
+// BufferString returns the contents of buf as a single string.
+func BufferString(buf *EditorBuffer) string {
+	if buf.NumRows == 0 {
+		return ""
+	}
+	return getRegionText(buf, 0, buf.row(buf.NumRows-1).Size, 0, buf.NumRows-1)
+}
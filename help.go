@@ -0,0 +1,76 @@
+package main
+
+import (
+	"strings"
+)
+
+// Gets the special buffer called name ready to show output: read-only and
+// in special mode (q to quit the window, SPC and DEL to page).
+func getOutputBuffer(name string) *EditorBuffer {
+	buf := getSpecialBuffer(name)
+	buf.MajorMode = "special"
+	if buf.Modes == nil {
+		buf.AddDefaultModes()
+	}
+	buf.setMode("no-self-insert-mode", true)
+	buf.ReadOnly = true
+	return buf
+}
+
+// Puts text into the buffer called name and shows it in the other window.
+// The current window stays selected.
+func showOutput(name string, mesgs ...string) *EditorBuffer {
+	buf := getOutputBuffer(name)
+	buf.setLines(strings.Split(strings.Join(mesgs, "\n"), "\n"))
+	displayBuffer(buf)
+	if buf != Global.CurrentB {
+		Global.Input = "C-M-v scrolls " + name + "; C-x o then q closes it"
+	}
+	return buf
+}
+
+// Shows some text in the *Help* buffer.
+func showMessages(mesgs ...string) {
+	showOutput("*Help*", mesgs...)
+}
+
+// Shows the messages logged so far in the *Messages* buffer, which then
+// keeps up with new ones.
+func showMessagesBuffer() {
+	buf := showOutput("*Messages*", Global.messages...)
+	buf.cy = buf.NumRows - 1
+	if buf.cy < 0 {
+		buf.cy = 0
+	}
+	buf.rowoff = buf.cy
+}
+
+// Adds msg to the end of the *Messages* buffer, if there is one.
+func appendMessagesBuffer(msg string) {
+	for _, buf := range Global.Buffers {
+		if buf.Filename == "" && buf.Rendername == "*Messages*" {
+			if buf.NumRows > 0 {
+				msg = "\n" + msg
+			}
+			buf.appendText(msg)
+			return
+		}
+	}
+}
+
+// Closes the window showing a special buffer, or shows another buffer in it
+// if it's the only one. The buffer is kept.
+func quitWindow() {
+	buf := Global.CurrentB
+	if len(Global.Windows) > 1 {
+		closeThisWindow()
+		return
+	}
+	for _, b := range Global.Buffers {
+		if b != buf && b.MajorMode != "special" {
+			switchToBuffer(b)
+			return
+		}
+	}
+	Global.Input = "No other buffer to show"
+}
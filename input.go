@@ -1,7 +1,9 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"strings"
 	"time"
 	"unicode/utf8"
 
@@ -10,11 +12,10 @@ import (
 )
 
 func InitTerm() {
-	err := termbox.Init()
+	err := screen.Init()
 	if err != nil {
 		panic(err)
 	}
-	termbox.SetInputMode(termbox.InputAlt | termbox.InputMouse)
 }
 
 func editorGetKey() string {
@@ -35,35 +36,112 @@ func editorGetKey() string {
 				// Don't refresh the screen.
 			}
 		}()
-		ev := termbox.PollEvent()
+		key := keysrc.PollKey()
 		done <- true
-		if ev.Type == termbox.EventResize {
+		runPendingEvents()
+		if key == "" {
 			editorRefreshScreen()
-		} else if ev.Type == termbox.EventKey {
-			return ParseTermboxEvent(ev)
-		} else if ev.Type == termbox.EventMouse {
-			return ParseMouseEvent(ev)
+		} else {
+			return key
 		}
 	}
 }
 
 func editorGetKeyNoRefresh() string {
 	for {
-		ev := termbox.PollEvent()
-		if ev.Type == termbox.EventKey {
-			return ParseTermboxEvent(ev)
+		key := keysrc.PollKey()
+		runPendingEvents()
+		if key != "" {
+			return key
+		}
+	}
+}
+
+// promptLine edits a single line of input in the prompt area. Every key that
+// isn't an editing key is passed to callback, which returns the new contents
+// of the line.
+func promptLine(prompt string, callback func(string, string) string) string {
+	cached := Global.Prompt
+	editorSetPrompt(prompt)
+	defer editorSetPrompt(cached)
+	query := []rune{}
+	pos := 0
+	for {
+		Global.Input = string(query)
+		editorRefreshScreen()
+		x := termutil.RunewidthStr(Global.Prompt+"-> ") + termutil.RunewidthStr(string(query[:pos]))
+		_, sy := screen.Size()
+		screen.SetCursor(x, sy-1)
+		screen.Flush()
+		key := editorGetKey()
+		switch key {
+		case "C-c", "C-g":
+			if callback != nil {
+				callback(string(query), key)
+			}
+			Global.Input = ""
+			return ""
+		case "RET":
+			if callback != nil {
+				callback(string(query), key)
+			}
+			return string(query)
+		case "DEL", "C-h":
+			if pos > 0 {
+				query = append(query[:pos-1], query[pos:]...)
+				pos--
+			}
+		case "deletechar", "C-d":
+			if pos < len(query) {
+				query = append(query[:pos], query[pos+1:]...)
+			}
+		case "LEFT", "C-b":
+			if pos > 0 {
+				pos--
+			}
+		case "RIGHT", "C-f":
+			if pos < len(query) {
+				pos++
+			}
+		case "Home", "C-a":
+			pos = 0
+		case "End", "C-e":
+			pos = len(query)
+		case "C-k":
+			query = query[:pos]
+		default:
+			if utf8.RuneCountInString(key) == 1 {
+				ru, _ := utf8.DecodeRuneInString(key)
+				query = append(query[:pos], append([]rune{ru}, query[pos:]...)...)
+				pos++
+			}
+		}
+		if callback != nil {
+			newquery := callback(string(query), key)
+			if newquery != string(query) {
+				query = []rune(newquery)
+				pos = len(query)
+			}
 		}
 	}
 }
 
 func editorPrompt(prompt string, callback func(string, string)) string {
-	ret := termutil.PromptWithCallback(prompt, func(int, int) { editorRefreshScreen() }, callback)
+	var ret string
+	if callback == nil {
+		ret = promptLine(prompt, nil)
+	} else {
+		ret = promptLine(prompt, func(query, key string) string {
+			callback(query, key)
+			return query
+		})
+	}
 	Global.Input = ret
 	return ret
 }
 
 func tabCompletedEditorPrompt(prompt string, getCandidates func(string) []string) string {
-	ret := termutil.DynamicPromptWithCallback(prompt, func(int, int) { editorRefreshScreen() }, func(query, key string) string {
+	ret := promptLine(prompt, func(query, key string) string {
 		if key == "TAB" || key == "C-i" {
 			if getCandidates == nil {
 				return query
@@ -111,13 +189,68 @@ func tabCompletedEditorPrompt(prompt string, getCandidates func(string) []string
 	return ret
 }
 
+// editorChoiceIndex takes over the screen with a menu of choices and returns
+// the index of the one picked, or def if the menu was cancelled.
 func editorChoiceIndex(title string, choices []string, def int) int {
-	return termutil.ChoiceIndex(title, choices, def)
-}
-
-func showMessages(mesgs ...string) {
-	termbox.HideCursor()
-	termutil.DisplayScreenMessage(mesgs...)
+	selection := def
+	if selection < 0 || selection >= len(choices) {
+		selection = 0
+	}
+	offset := 0
+	for {
+		sx, sy := screen.Size()
+		height := sy - 2
+		if height < 1 {
+			height = 1
+		}
+		if selection < offset {
+			offset = selection
+		} else if selection >= offset+height {
+			offset = selection - height + 1
+		}
+		screen.Clear()
+		screen.HideCursor()
+		printStringColored(termbox.AttrReverse, title, 0, 0)
+		for i := 0; i < height && offset+i < len(choices); i++ {
+			if offset+i == selection {
+				for x := 0; x < sx; x++ {
+					screen.SetCell(x, i+1, ' ', termbox.AttrReverse, termbox.ColorDefault)
+				}
+				printStringColored(termbox.AttrReverse, choices[offset+i], 0, i+1)
+			} else {
+				printString(choices[offset+i], 0, i+1)
+			}
+		}
+		screen.Flush()
+		switch editorGetKey() {
+		case "UP", "C-p":
+			if selection > 0 {
+				selection--
+			}
+		case "DOWN", "C-n":
+			if selection < len(choices)-1 {
+				selection++
+			}
+		case "prior", "M-v":
+			selection -= height
+			if selection < 0 {
+				selection = 0
+			}
+		case "next", "C-v":
+			selection += height
+			if selection >= len(choices) {
+				selection = len(choices) - 1
+			}
+		case "M-<", "Home":
+			selection = 0
+		case "M->", "End":
+			selection = len(choices) - 1
+		case "RET":
+			return selection
+		case "C-g", "C-c", "q":
+			return def
+		}
+	}
 }
 
 func ParseTermboxEvent(ev termbox.Event) string {
@@ -145,24 +278,54 @@ func ParseMouseEvent(ev termbox.Event) string {
 
 func editorYesNoPrompt(p string, noallowcancel bool) (bool, error) {
 	if noallowcancel {
-		return termutil.YesNo(p, func(int, int) { editorRefreshScreen() }), nil
+		r := editorPressKey(p+" (y/n)", "y", "n", "Y", "N")
+		return r == "y" || r == "Y", nil
 	} else {
-		r, err := termutil.YesNoCancel(p, func(int, int) { editorRefreshScreen() })
-		if err != nil {
+		r := editorPressKey(p+" (y/n/C-g)", "y", "n", "Y", "N", "C-g", "C-c")
+		if r == "C-g" || r == "C-c" {
 			Global.Input = "Cancelled."
+			return false, errors.New("Cancelled")
 		}
-		return r, err
+		return r == "y" || r == "Y", nil
 	}
 }
 
+// editorPressKey waits until one of keys is pressed, and returns it.
 func editorPressKey(p string, keys ...string) string {
-	return termutil.PressKey(p, func(int, int) { editorRefreshScreen() }, keys...)
+	cached := Global.Input
+	defer func() { Global.Input = cached }()
+	for {
+		Global.Input = p
+		editorRefreshScreen()
+		key := editorGetKey()
+		for _, k := range keys {
+			if k == key {
+				return key
+			}
+		}
+	}
 }
 
+// GetRawChar returns the next key press as the text it would insert, so that
+// control characters can be inserted literally.
 func GetRawChar() string {
-	return termutil.GetRawChar(func(int, int) {
-		editorRefreshScreen()
-	})
+	key := editorGetKey()
+	switch key {
+	case "TAB":
+		return "\t"
+	case "RET":
+		return "\r"
+	case "DEL":
+		return "\x7f"
+	case "ESC":
+		return "\x1b"
+	}
+	if len(key) == 3 && strings.HasPrefix(key, "C-") && '@' <= key[2] && key[2] <= '_' {
+		return string(rune(key[2] - '@'))
+	} else if len(key) == 3 && strings.HasPrefix(key, "C-") && 'a' <= key[2] && key[2] <= 'z' {
+		return string(rune(key[2] - 'a' + 1))
+	}
+	return key
 }
 
 func InsertRaw() {
@@ -174,6 +337,9 @@ func InsertRaw() {
 }
 
 func zapToChar() {
+	if !Global.CurrentB.checkWritable() {
+		return
+	}
 	if Global.CurrentB.cy == Global.CurrentB.NumRows {
 		Global.Input = "End of buffer"
 		return
@@ -183,11 +349,15 @@ func zapToChar() {
 	chars := GetRawChar()
 	Global.Input += chars
 	zapru, size := utf8.DecodeLastRuneInString(chars)
-	for _, row := range Global.CurrentB.Rows[Global.CurrentB.cy:] {
-		thisrow := row.idx == Global.CurrentB.cy
+	for cy := Global.CurrentB.cy; cy < Global.CurrentB.NumRows; cy++ {
+		row := Global.CurrentB.row(cy)
+		thisrow := cy == Global.CurrentB.cy
 		for in, ru := range row.Data {
 			if ru == zapru && !(thisrow && in < Global.CurrentB.cx) {
-				Global.Clipboard = bufKillRegion(Global.CurrentB, Global.CurrentB.cx, in+size, Global.CurrentB.cy, row.idx)
+				startc, startl := Global.CurrentB.cx, Global.CurrentB.cy
+				killed := bufKillRegion(Global.CurrentB, startc, in+size, startl, cy)
+				editorAddRegionUndo(false, startc, in+size, startl, cy, killed)
+				addKill(killed, false)
 				return
 			}
 		}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/zhemao/glisp/interpreter"
+)
+
+// KillRing holds recently killed text, newest first.
+type KillRing struct {
+	Entries   []string
+	Max       int
+	yank      int  // Entry most recently yanked; yank-pop moves on from it.
+	killed    bool // The running command has killed something.
+	appending bool // The last command killed something, so kills append.
+	yankcx    int  // Where the last yank started, so yank-pop can replace it.
+	yankcy    int
+}
+
+func NewKillRing() *KillRing {
+	return &KillRing{[]string{}, 60, 0, false, false, 0, 0}
+}
+
+// Push puts text on the front of the ring, dropping the oldest entry if the
+// ring is full.
+func (k *KillRing) Push(text string) {
+	k.Entries = append([]string{text}, k.Entries...)
+	if len(k.Entries) > k.Max {
+		k.Entries = k.Entries[:k.Max]
+	}
+	k.yank = 0
+}
+
+// Current returns the newest entry, or "" if nothing has been killed yet.
+func (k *KillRing) Current() string {
+	if len(k.Entries) == 0 {
+		return ""
+	}
+	return k.Entries[0]
+}
+
+// Rotate moves the yank pointer n entries further back, wrapping around, and
+// returns the entry it now points at.
+func (k *KillRing) Rotate(n int) string {
+	if len(k.Entries) == 0 {
+		return ""
+	}
+	k.yank = (k.yank + n) % len(k.Entries)
+	if k.yank < 0 {
+		k.yank += len(k.Entries)
+	}
+	return k.Entries[k.yank]
+}
+
+// Called by runTopLevelKey after whatever each key ran, so that we know
+// whether the next kill should be joined onto the last one. Commands run from
+// inside another command (like the one after C-u) don't call it, so they
+// count as part of the key that started them.
+func (k *KillRing) endCommand() {
+	k.appending = k.killed
+	k.killed = false
+}
+
+// addKill puts killed text on the ring. If the last command was a kill too,
+// the text is joined onto the newest entry instead; backward kills go on the
+// front of it.
+func addKill(text string, backward bool) {
+	k := Global.KillRing
+	if (k.appending || k.killed) && len(k.Entries) > 0 {
+		if backward {
+			k.Entries[0] = text + k.Entries[0]
+		} else {
+			k.Entries[0] += text
+		}
+		k.yank = 0
+	} else {
+		k.Push(text)
+	}
+	k.killed = true
+}
+
+func lastCommandWasYank() bool {
+	return Global.LastCommand != nil &&
+		(Global.LastCommand.Name == "yank-region" || Global.LastCommand.Name == "yank-pop")
+}
+
+func doYankPop() {
+	buf := Global.CurrentB
+	if !buf.checkWritable() {
+		return
+	}
+	k := Global.KillRing
+	if !lastCommandWasYank() {
+		Global.Input = "Previous command was not a yank"
+		return
+	}
+	if len(k.Entries) == 0 {
+		Global.Input = "Kill ring is empty"
+		return
+	}
+	startc, startl := k.yankcx, k.yankcy
+	endc, endl := buf.cx, buf.cy
+	if startl > endl || (startl == endl && startc > endc) || endl >= buf.NumRows {
+		Global.Input = "Point has moved since the last yank"
+		return
+	}
+	killed := bufKillRegion(buf, startc, endc, startl, endl)
+	editorAddRegionUndo(false, startc, endc, startl, endl, killed)
+	text := k.Rotate(1)
+	cx, cy := spitRegion(startc, startl, text)
+	editorAddRegionUndo(true, cx, buf.cx, cy, buf.cy, text)
+	buf.Undo.paired = true
+	buf.regionActive = false
+}
+
+func killRingSummary(text string) string {
+	lines := strings.Split(text, "\n")
+	if len(lines) > 1 {
+		return fmt.Sprintf("%s [+%d lines]", lines[0], len(lines)-1)
+	}
+	return text
+}
+
+func browseKillRing() {
+	k := Global.KillRing
+	if len(k.Entries) == 0 {
+		Global.Input = "Kill ring is empty"
+		return
+	}
+	choices := make([]string, len(k.Entries))
+	for i, text := range k.Entries {
+		choices[i] = killRingSummary(text)
+	}
+	i := editorChoiceIndex("Kill ring - RET to yank", choices, -1)
+	if i < 0 {
+		Global.Input = "Cancelled."
+		return
+	}
+	k.yank = i
+	k.yankcx, k.yankcy = Global.CurrentB.cx, Global.CurrentB.cy
+	doYankText(k.Entries[i])
+	Global.CurrentB.regionActive = false
+}
+
+func lispKillRingGet(env *glisp.Glisp, name string, args []glisp.Sexp) (glisp.Sexp, error) {
+	n := 0
+	if len(args) == 1 {
+		switch t := args[0].(type) {
+		case glisp.SexpInt:
+			n = int(t)
+		default:
+			return glisp.SexpNull, errors.New("Arg needs to be an int")
+		}
+	} else if len(args) > 1 {
+		return glisp.SexpNull, glisp.WrongNargs
+	}
+	k := Global.KillRing
+	if n < 0 || n >= len(k.Entries) {
+		return glisp.SexpNull, nil
+	}
+	return glisp.SexpStr(k.Entries[n]), nil
+}
+
+func lispKillRingPush(env *glisp.Glisp, name string, args []glisp.Sexp) (glisp.Sexp, error) {
+	if len(args) != 1 {
+		return glisp.SexpNull, glisp.WrongNargs
+	}
+	switch t := args[0].(type) {
+	case glisp.SexpStr:
+		Global.KillRing.Push(string(t))
+	default:
+		return glisp.SexpNull, errors.New("Arg needs to be a string")
+	}
+	return glisp.SexpNull, nil
+}
@@ -0,0 +1,403 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/zhemao/glisp/interpreter"
+)
+
+// Files bigger than this many bytes are opened in large-file mode: read
+// only, with just the lines around the window in memory. 0 turns it off.
+var largeFileThreshold int64 = 64 << 20
+
+const (
+	largeFileIndexStep = 1024    // The offset of every this many lines is kept
+	largeFilePageLines = 2000    // How many lines are in memory at once
+	largeFileMaxLine   = 1 << 20 // Longer lines are cut off at this many bytes
+)
+
+// A file in large-file mode. The buffer's rows are the lines from first to
+// first+NumRows; the rest of the file is read as it's needed.
+type largeFile struct {
+	fn    string
+	lines int
+	index []int64 // index[i] is the offset of line i*largeFileIndexStep
+	first int
+}
+
+// Reports whether opening fn needs large-file mode.
+func isLargeFile(fn string) (bool, int64) {
+	fi, err := os.Stat(fn)
+	if err != nil || !fi.Mode().IsRegular() {
+		return false, 0
+	}
+	return largeFileThreshold > 0 && fi.Size() > largeFileThreshold, fi.Size()
+}
+
+// Reads through fn once, counting its lines and noting where every
+// largeFileIndexStep'th one starts.
+func indexLargeFile(fn string) (*largeFile, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	ret := &largeFile{fn, 0, []int64{0}, 0}
+	chunk := make([]byte, 1<<20)
+	var off int64
+	var last byte = '\n'
+	for {
+		n, err := f.Read(chunk)
+		data := chunk[:n]
+		for {
+			i := bytes.IndexByte(data, '\n')
+			if i < 0 {
+				break
+			}
+			off += int64(i + 1)
+			ret.lines++
+			if ret.lines%largeFileIndexStep == 0 {
+				ret.index = append(ret.index, off)
+			}
+			data = data[i+1:]
+		}
+		off += int64(len(data))
+		if n > 0 {
+			last = chunk[n-1]
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if last != '\n' {
+		// The last line has no newline on the end.
+		ret.lines++
+	}
+	return ret, nil
+}
+
+// Reads a line, without its line ending. Only the first largeFileMaxLine
+// bytes of it are kept.
+func readLargeFileLine(r *bufio.Reader) (string, error) {
+	var line []byte
+	for {
+		chunk, err := r.ReadSlice('\n')
+		if room := largeFileMaxLine - len(line); room > 0 {
+			if len(chunk) > room {
+				chunk = chunk[:room]
+			}
+			line = append(line, chunk...)
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err == io.EOF && len(line) > 0 {
+			err = nil
+		}
+		return strings.TrimSuffix(strings.TrimSuffix(string(line), "\n"), "\r"), err
+	}
+}
+
+// Calls fn with each line from the first'th on until it returns false or
+// the file ends.
+func (lf *largeFile) eachLine(first int, fn func(line int, text string) bool) error {
+	f, err := os.Open(lf.fn)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	start := first / largeFileIndexStep
+	if start >= len(lf.index) {
+		start = len(lf.index) - 1
+	}
+	if _, err := f.Seek(lf.index[start], io.SeekStart); err != nil {
+		return err
+	}
+	r := bufio.NewReaderSize(f, 64<<10)
+	for line := start * largeFileIndexStep; ; line++ {
+		text, err := readLargeFileLine(r)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if line >= first && !fn(line, text) {
+			return nil
+		}
+	}
+}
+
+// Reads the lines from first to first+n.
+func (lf *largeFile) readLines(first, n int) ([]string, error) {
+	ret := []string{}
+	err := lf.eachLine(first, func(line int, text string) bool {
+		ret = append(ret, text)
+		return len(ret) < n
+	})
+	return ret, err
+}
+
+// Opens fn into buf in large-file mode.
+func openLargeFile(buf *EditorBuffer, fn string, size int64) error {
+	lf, err := indexLargeFile(fn)
+	if err != nil {
+		return err
+	}
+	fi, err := os.Stat(fn)
+	if err != nil {
+		return err
+	}
+	buf.large = lf
+	buf.MajorMode = "large-file"
+	buf.setMode("no-self-insert-mode", true)
+	buf.ReadOnly = true
+	buf.Highlighter = nil
+	buf.disk = fileStamp{true, fi.ModTime(), fi.Size(), [32]byte{}}
+	if err := largeFileGoto(buf, 0, 0); err != nil {
+		return err
+	}
+	Global.Input = fmt.Sprintf("%s is %s and %d lines; opened read-only in large-file mode",
+		buf.getRenderName(), formatSize(size), lf.lines)
+	return nil
+}
+
+func formatSize(size int64) string {
+	switch {
+	case size >= 1<<30:
+		return fmt.Sprintf("%.1fG", float64(size)/(1<<30))
+	case size >= 1<<20:
+		return fmt.Sprintf("%.1fM", float64(size)/(1<<20))
+	case size >= 1<<10:
+		return fmt.Sprintf("%.1fK", float64(size)/(1<<10))
+	}
+	return strconv.FormatInt(size, 10)
+}
+
+// The line of the file that the buffer's first row is.
+func (buf *EditorBuffer) lineOffset() int {
+	if buf.large == nil {
+		return 0
+	}
+	return buf.large.first
+}
+
+// The number of lines in the buffer's file, or the buffer if it's not in
+// large-file mode.
+func (buf *EditorBuffer) totalLines() int {
+	if buf.large == nil {
+		return buf.NumRows
+	}
+	return buf.large.lines
+}
+
+// Loads the lines around line of the file and puts point at column cx of
+// it, keeping the window where it was on the screen.
+func largeFileGoto(buf *EditorBuffer, line, cx int) error {
+	lf := buf.large
+	if line > lf.lines {
+		line = lf.lines
+	}
+	if line < 0 {
+		line = 0
+	}
+	first := line - largeFilePageLines/2
+	if first > lf.lines-largeFilePageLines {
+		first = lf.lines - largeFilePageLines
+	}
+	if first < 0 {
+		first = 0
+	}
+	lines, err := lf.readLines(first, largeFilePageLines)
+	if err != nil {
+		return err
+	}
+	delta := first - lf.first
+	rowoff, marky := buf.rowoff-delta, buf.MarkY-delta
+	buf.setLines(lines)
+	lf.first = first
+	buf.cy = line - first
+	if buf.cy > buf.NumRows {
+		buf.cy = buf.NumRows
+	}
+	if buf.cy < buf.NumRows && cx > buf.row(buf.cy).Size {
+		cx = buf.row(buf.cy).Size
+	} else if buf.cy == buf.NumRows {
+		cx = 0
+	}
+	buf.cx, buf.prefcx = cx, cx
+	if rowoff < 0 || rowoff > buf.cy {
+		rowoff = buf.cy
+	}
+	buf.rowoff = rowoff
+	if marky < 0 {
+		marky = 0
+	} else if marky > buf.NumRows {
+		marky = buf.NumRows
+	}
+	buf.MarkY = marky
+	return nil
+}
+
+// Called before the window is drawn. If point has got near either end of
+// the lines in memory, the lines around it are loaded instead.
+func largeFilePage(buf *EditorBuffer) {
+	lf := buf.large
+	if lf == nil {
+		return
+	}
+	margin := largeFilePageLines / 4
+	if (buf.cy < margin && lf.first > 0) ||
+		(buf.cy >= buf.NumRows-margin && lf.first+buf.NumRows < lf.lines) {
+		if err := largeFileGoto(buf, lf.first+buf.cy, buf.cx); err != nil {
+			Global.Input = err.Error()
+			AddErrorMessage(err.Error())
+		}
+	}
+}
+
+// Rereads the index of a file in large-file mode, for when it has grown.
+func revertLargeFile(buf *EditorBuffer) error {
+	line, cx := buf.lineOffset()+buf.cy, buf.cx
+	lf, err := indexLargeFile(buf.Filename)
+	if err != nil {
+		return err
+	}
+	fi, err := os.Stat(buf.Filename)
+	if err != nil {
+		return err
+	}
+	lf.first = buf.large.first
+	buf.large = lf
+	buf.disk = fileStamp{true, fi.ModTime(), fi.Size(), [32]byte{}}
+	return largeFileGoto(buf, line, cx)
+}
+
+func withLargeFile(f func(buf *EditorBuffer) error) {
+	buf := Global.CurrentB
+	if buf.large == nil {
+		Global.Input = "Not in large-file mode"
+		return
+	}
+	if err := f(buf); err != nil {
+		Global.Input = err.Error()
+		AddErrorMessage(err.Error())
+	}
+}
+
+func largeFileBeginning() {
+	withLargeFile(func(buf *EditorBuffer) error {
+		return largeFileGoto(buf, 0, 0)
+	})
+}
+
+func largeFileEnd() {
+	withLargeFile(func(buf *EditorBuffer) error {
+		return largeFileGoto(buf, buf.large.lines, 0)
+	})
+}
+
+func largeFileGotoLine() {
+	withLargeFile(func(buf *EditorBuffer) error {
+		line, err := strconv.Atoi(editorPrompt("Go to line", nil))
+		if err != nil {
+			Global.Input = "Cancelled."
+			return nil
+		}
+		Global.Input = "Jumping to line " + strconv.Itoa(line)
+		return largeFileGoto(buf, line-1, 0)
+	})
+}
+
+var largeFileLastSearch = ""
+
+// Prompts for a regexp and reads through the file from point for it,
+// without loading more than a line at a time.
+func largeFileSearch(forward bool) {
+	withLargeFile(func(buf *EditorBuffer) error {
+		p := "Search forward in file (regexp)"
+		if !forward {
+			p = "Search backward in file (regexp)"
+		}
+		if largeFileLastSearch != "" {
+			p += " (blank for " + largeFileLastSearch + ")"
+		}
+		query := editorPrompt(p, nil)
+		if query == "" {
+			query = largeFileLastSearch
+		}
+		if query == "" {
+			Global.Input = "Cancelled."
+			return nil
+		}
+		pat := query
+		if strings.ToLower(query) == query {
+			pat = "(?i)" + pat
+		}
+		re, err := regexp.Compile(pat)
+		if err != nil {
+			return err
+		}
+		largeFileLastSearch = query
+		here := buf.lineOffset() + buf.cy
+		found, foundx := -1, 0
+		if forward {
+			err = buf.large.eachLine(here, func(line int, text string) bool {
+				for _, m := range re.FindAllStringIndex(text, -1) {
+					if line > here || m[0] >= buf.cx {
+						found, foundx = line, m[1]
+						return false
+					}
+				}
+				return true
+			})
+		} else {
+			// There's no reading lines backwards, so this goes through the
+			// file up to point and remembers the last match.
+			err = buf.large.eachLine(0, func(line int, text string) bool {
+				if line > here {
+					return false
+				}
+				for _, m := range re.FindAllStringIndex(text, -1) {
+					if line < here || m[0] < buf.cx {
+						found, foundx = line, m[0]
+					}
+				}
+				return true
+			})
+		}
+		if err != nil {
+			return err
+		}
+		if found < 0 {
+			Global.Input = "Search failed: " + query
+			return nil
+		}
+		Global.Input = "Found " + query + " on line " + strconv.Itoa(found+1)
+		return largeFileGoto(buf, found, foundx)
+	})
+}
+
+func lispSetLargeFileThreshold(env *glisp.Glisp, name string, args []glisp.Sexp) (glisp.Sexp, error) {
+	if len(args) != 1 {
+		return glisp.SexpNull, glisp.WrongNargs
+	}
+	switch t := args[0].(type) {
+	case glisp.SexpInt:
+		largeFileThreshold = int64(t)
+	default:
+		return glisp.SexpNull, errors.New("Arg 1 needs to be an int")
+	}
+	return glisp.SexpNull, nil
+}
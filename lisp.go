@@ -3,7 +3,7 @@ package main
 import (
 	"errors"
 	"fmt"
-	"io/ioutil"
+	"os"
 
 	"github.com/mitchellh/go-homedir"
 	"github.com/zhemao/glisp/interpreter"
@@ -367,8 +367,7 @@ func lispSetTabStop(env *glisp.Glisp, name string, args []glisp.Sexp) (glisp.Sex
 	default:
 		return glisp.SexpNull, errors.New("Arg 1 needs to be an int")
 	}
-	Global.Tabsize = x
-	return glisp.SexpNull, nil
+	return glisp.SexpNull, setDefaultVariable(editorVariables["tab-width"], x)
 }
 
 func lispSetSoftTab(env *glisp.Glisp, name string, args []glisp.Sexp) (glisp.Sexp, error) {
@@ -382,8 +381,7 @@ func lispSetSoftTab(env *glisp.Glisp, name string, args []glisp.Sexp) (glisp.Sex
 	default:
 		return glisp.SexpNull, errors.New("Arg 1 needs to be a bool")
 	}
-	Global.SoftTab = x
-	return glisp.SexpNull, nil
+	return glisp.SexpNull, setDefaultVariable(editorVariables["soft-tab"], x)
 }
 
 func lispSetSyntaxOff(env *glisp.Glisp, name string, args []glisp.Sexp) (glisp.Sexp, error) {
@@ -397,8 +395,7 @@ func lispSetSyntaxOff(env *glisp.Glisp, name string, args []glisp.Sexp) (glisp.S
 	default:
 		return glisp.SexpNull, errors.New("Arg 1 needs to be a bool")
 	}
-	Global.NoSyntax = x
-	return glisp.SexpNull, nil
+	return glisp.SexpNull, setDefaultVariable(editorVariables["disable-syntax"], x)
 }
 
 func lispGetTabStr(env *glisp.Glisp, name string, args []glisp.Sexp) (glisp.Sexp, error) {
@@ -581,6 +578,12 @@ func loadLispFunctions(env *glisp.Glisp) {
 	env.AddFunction("settabstop", lispSetTabStop)
 	env.AddFunction("gettabstr", lispGetTabStr)
 	env.AddFunction("setsofttab", lispSetSoftTab)
+	env.AddFunction("setmakebackupfiles", lispSetMakeBackupFiles)
+	env.AddFunction("setbackupdirectory", lispSetBackupDirectory)
+	env.AddFunction("setversioncontrol", lispSetVersionControl)
+	env.AddFunction("setautosaveinterval", lispSetAutoSaveInterval)
+	env.AddFunction("setautosavetimeout", lispSetAutoSaveTimeout)
+	env.AddFunction("setlargefilethreshold", lispSetLargeFileThreshold)
 	env.AddFunction("disablesyntax", lispSetSyntaxOff)
 	env.AddFunction("unbindall", lispSingleton(func() { Emacs.UnbindAll() }))
 	env.AddFunction("emacsdefinecmd", lispDefineCmd)
@@ -605,6 +608,39 @@ func loadLispFunctions(env *glisp.Glisp) {
 	env.AddFunction("filterbuffer", lispFilterBuffer)
 	env.AddFunction("filterregion", lispFilterRegion)
 	env.AddFunction("shellcmd", lispRunExtCmd)
+	env.AddFunction("killringget", lispKillRingGet)
+	env.AddFunction("killringpush", lispKillRingPush)
+	env.AddFunction("adderrorregexp", lispAddErrorRegexp)
+	env.AddFunction("clearerrorregexps", lispClearErrorRegexps)
+	env.AddFunction("startprocess", lispStartProcess)
+	env.AddFunction("processsendstring", lispProcessSendString)
+	env.AddFunction("processsendeof", lispProcessSendEOF)
+	env.AddFunction("setprocesssentinel", lispSetProcessSentinel)
+	env.AddFunction("setprocessfilter", lispSetProcessFilter)
+	env.AddFunction("killprocess", lispKillProcess)
+	env.AddFunction("processstatus", lispProcessStatus)
+	env.AddFunction("point", lispPoint)
+	env.AddFunction("goto-char", lispGotoChar)
+	env.AddFunction("line-number", lispLineNumber)
+	env.AddFunction("current-line-string", lispCurrentLineString)
+	env.AddFunction("buffer-substring", lispBufferSubstring)
+	env.AddFunction("buffer-string", lispBufferString)
+	env.AddFunction("insert", lispInsert)
+	env.AddFunction("delete-region", lispDeleteRegion)
+	env.AddFunction("region-beginning", lispRegionBound(false))
+	env.AddFunction("region-end", lispRegionBound(true))
+	env.AddFunction("buffer-name", lispBufferName)
+	env.AddFunction("buffer-file-name", lispBufferFileName)
+	env.AddFunction("switch-to-buffer", lispSwitchToBuffer)
+	env.AddFunction("load", lispLoad)
+	env.AddFunction("require", lispRequire)
+	env.AddFunction("provide", lispProvide)
+	env.AddFunction("addloadpath", lispAddLoadPath)
+	env.AddFunction("setq-local", lispSetqLocal)
+	env.AddFunction("set-default", lispSetDefault)
+	env.AddFunction("symbol-value", lispSymbolValue)
+	env.AddFunction("default-value", lispDefaultValue)
+	env.AddFunction("kill-local-variable", lispKillLocalVariable)
 	LoadDefaultCommands()
 }
 
@@ -613,40 +649,41 @@ func NewLispInterp(loaduser bool) *glisp.Glisp {
 	loadLispFunctions(ret)
 	LoadDefaultConfig(ret)
 	if loaduser {
+		if loadPackagesAtStartup {
+			loadPackages(ret)
+		}
 		LoadUserConfig(ret)
 	}
 	return ret
 }
 
+// Runs the init file, ~/.gomacs.lisp unless -l or -q said otherwise.
 func LoadUserConfig(env *glisp.Glisp) {
-	usr, ue := homedir.Dir()
-	if ue != nil {
-		Global.Input = "Error getting current user's home directory: " + ue.Error()
-		AddErrorMessage(Global.Input)
+	if initFile == "" {
 		return
 	}
-	rc, err := ioutil.ReadFile(usr + "/.gomacs.lisp")
+	fn, err := homedir.Expand(initFile)
 	if err != nil {
-		AddErrorMessage(err.Error())
+		Global.Input = "Error getting current user's home directory: " + err.Error()
+		AddErrorMessage(Global.Input)
 		return
 	}
-	err = env.LoadString(string(rc))
-	if err != nil {
-		Global.Input = "Error parsing rc file: " + err.Error()
-		AddErrorMessage(Global.Input)
+	if _, err := os.Stat(fn); err != nil {
+		AddErrorMessage(err.Error())
 		return
 	}
-	_, err = env.Run()
-	if err != nil {
-		Global.Input = "Error executing rc file: " + err.Error()
+	if err := loadLispFile(env, fn); err != nil {
+		Global.Input = "Error loading init file: " + err.Error()
 		AddErrorMessage(Global.Input)
-		return
 	}
 }
 
 func LoadDefaultConfig(env *glisp.Glisp) {
 	_, err := env.EvalString(`
 (emacsbindkey "C-s" "isearch")
+(emacsbindkey "C-r" "isearch-backward")
+(emacsbindkey "C-M-s" "isearch-forward-regexp")
+(emacsbindkey "C-M-r" "isearch-backward-regexp")
 (emacsbindkey "C-x C-c" "save-buffers-kill-emacs")
 (emacsbindkey "C-x C-s" "save-buffer")
 (emacsbindkey "LEFT" "backward-char")
@@ -671,6 +708,7 @@ func LoadDefaultConfig(env *glisp.Glisp) {
 (emacsbindkey "C-j" "insert-newline-and-indent")
 (emacsbindkey "RET" "insert-newline-maybe-indent")
 (emacsbindkey "C-x C-f" "find-file")
+(emacsbindkey "C-x C-q" "read-only-mode")
 (emacsbindkey "C-x b" "buffers-list")
 (emacsbindkey "M-<" "beginning-of-buffer")
 (emacsbindkey "M->" "end-of-buffer")
@@ -687,6 +725,7 @@ func LoadDefaultConfig(env *glisp.Glisp) {
 (emacsbindkey "C-w" "kill-region")
 (emacsbindkey "M-w" "copy-region")
 (emacsbindkey "C-y" "yank-region")
+(emacsbindkey "M-y" "yank-pop")
 (emacsbindkey "M-f" "forward-word")
 (emacsbindkey "M-d" "kill-word")
 (emacsbindkey "M-b" "backward-word")
@@ -696,20 +735,68 @@ func LoadDefaultConfig(env *glisp.Glisp) {
 (emacsbindkey "C-x k" "kill-buffer")
 (emacsbindkey "C-k" "kill-line")
 (emacsbindkey "C-x C-_" "redo")
+(emacsbindkey "C-x u" "undo-tree-visualize")
 (emacsbindkey "C-z" "suspend-emacs")
 (emacsbindkey "C-h c" "describe-key-briefly")
 (emacsbindkey "M-x" "run-command")
+(emacsbindkey "M-:" "eval-expression")
 (emacsbindkey "C-x C-u" "upcase-region")
 (emacsbindkey "C-x C-l" "downcase-region")
 (emacsbindkey "M-u" "upcase-word")
 (emacsbindkey "M-l" "downcase-word")
 (emacsbindkey "C-h m" "show-modes")
 (emacsbindkey "C-h b" "describe-bindings")
+(emacsbindkey "C-h v" "describe-variable")
 (emacsbindkey "f1" "quick-help")
 (emacsbindkey "C-x d" "dired-mode")
 (emacsbindkey "M-g M-g" "goto-line")
 (emacsbindkey "M-g g" "goto-line")
 (emacsbindkey "M-g c" "goto-char")
+(emacsbindkey "M-g n" "next-error")
+(emacsbindkey "M-g M-n" "next-error")
+(emacsbindkey "M-g p" "previous-error")
+(emacsbindkey "M-g M-p" "previous-error")
+(bindkeymode "grep" "RET" "compile-goto-error")
+(bindkeymode "compilation" "RET" "compile-goto-error")
+(bindkeymode "shell" "RET" "comint-send-input")
+(bindkeymode "shell" "M-p" "comint-previous-input")
+(bindkeymode "shell" "M-n" "comint-next-input")
+(bindkeymode "shell" "C-c C-c" "comint-interrupt-subjob")
+(bindkeymode "shell" "C-c C-d" "comint-send-eof")
+(bindkeymode "dired" "RET" "dired-find-file")
+(bindkeymode "dired" "^" "dired-up-directory")
+(bindkeymode "dired" "m" "dired-mark")
+(bindkeymode "dired" "u" "dired-unmark")
+(bindkeymode "dired" "U" "dired-unmark-all-marks")
+(bindkeymode "dired" "d" "dired-flag-file-deletion")
+(bindkeymode "dired" "x" "dired-do-flagged-delete")
+(bindkeymode "dired" "R" "dired-do-rename")
+(bindkeymode "dired" "C" "dired-do-copy")
+(bindkeymode "dired" "+" "dired-create-directory")
+(bindkeymode "dired" "M" "dired-do-chmod")
+(bindkeymode "dired" "g" "dired-revert")
+(bindkeymode "dired" "C-x C-q" "wdired")
+(bindkeymode "wdired" "C-c C-c" "wdired-finish-edit")
+(bindkeymode "wdired" "C-c C-k" "wdired-abort-changes")
+(bindkeymode "special" "q" "quit-window")
+(bindkeymode "special" "SPC" "scroll-down-command")
+(bindkeymode "special" "DEL" "scroll-up-command")
+(bindkeymode "undo-tree" "p" "undo-tree-visualize-undo")
+(bindkeymode "undo-tree" "n" "undo-tree-visualize-redo")
+(bindkeymode "undo-tree" "b" "undo-tree-visualize-switch-branch-left")
+(bindkeymode "undo-tree" "f" "undo-tree-visualize-switch-branch-right")
+(bindkeymode "undo-tree" "RET" "undo-tree-visualize-select")
+(bindkeymode "undo-tree" "q" "quit-window")
+(bindkeymode "lisp-interaction" "RET" "scratch-send-input")
+(bindkeymode "view-mode" "SPC" "scroll-down-command")
+(bindkeymode "view-mode" "DEL" "scroll-up-command")
+(bindkeymode "view-mode" "q" "view-mode-exit")
+(bindkeymode "large-file" "M-<" "large-file-beginning-of-buffer")
+(bindkeymode "large-file" "M->" "large-file-end-of-buffer")
+(bindkeymode "large-file" "M-g g" "large-file-goto-line")
+(bindkeymode "large-file" "M-g M-g" "large-file-goto-line")
+(bindkeymode "large-file" "C-s" "large-file-search-forward")
+(bindkeymode "large-file" "C-r" "large-file-search-backward")
 (emacsbindkey "C-x (" "start-macro")
 (emacsbindkey "C-x )" "end-macro")
 (emacsbindkey "C-x e" "end-macro-and-run")
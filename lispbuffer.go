@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/zhemao/glisp/interpreter"
+)
+
+// Positions in the buffer, as Lisp sees them, are byte offsets from the
+// start of the buffer, counting one for each newline (the same offsets C-x =
+// reports). They're worked out from the rows each time rather than stored.
+
+// The offset of column cx of row cy in buf.
+func (buf *EditorBuffer) posToOffset(cx, cy int) int {
+	offset := 0
+	for i := 0; i < cy && i < buf.NumRows; i++ {
+		offset += buf.row(i).Size + 1
+	}
+	return offset + cx
+}
+
+// The column and row of offset in buf. Offsets outside the buffer are moved
+// to its start or end, and ones in the middle of a character to its start.
+func (buf *EditorBuffer) offsetToPos(offset int) (int, int) {
+	if offset < 0 || buf.NumRows == 0 {
+		return 0, 0
+	}
+	for cy := 0; cy < buf.NumRows; cy++ {
+		row := buf.row(cy)
+		if offset <= row.Size {
+			cx := offset
+			for cx > 0 && cx < row.Size && !utf8.RuneStart(row.Data[cx]) {
+				cx--
+			}
+			return cx, cy
+		}
+		offset -= row.Size + 1
+	}
+	last := buf.NumRows - 1
+	return buf.row(last).Size, last
+}
+
+// The text of buf between two offsets, in either order, as columns and rows
+// ready for getRegionText or bufKillRegion.
+func (buf *EditorBuffer) offsetRange(a, b int) (int, int, int, int) {
+	if a > b {
+		a, b = b, a
+	}
+	startc, startl := buf.offsetToPos(a)
+	endc, endl := buf.offsetToPos(b)
+	return startc, endc, startl, endl
+}
+
+func lispIntArg(args []glisp.Sexp, i int) (int, error) {
+	switch t := args[i].(type) {
+	case glisp.SexpInt:
+		return int(t), nil
+	default:
+		return 0, errors.New("Arg " + strconv.Itoa(i+1) + " needs to be an int")
+	}
+}
+
+func lispPoint(env *glisp.Glisp, name string, args []glisp.Sexp) (glisp.Sexp, error) {
+	if len(args) != 0 {
+		return glisp.SexpNull, glisp.WrongNargs
+	}
+	buf := Global.CurrentB
+	return glisp.SexpInt(buf.posToOffset(buf.cx, buf.cy)), nil
+}
+
+func lispGotoChar(env *glisp.Glisp, name string, args []glisp.Sexp) (glisp.Sexp, error) {
+	if len(args) != 1 {
+		return glisp.SexpNull, glisp.WrongNargs
+	}
+	offset, err := lispIntArg(args, 0)
+	if err != nil {
+		return glisp.SexpNull, err
+	}
+	buf := Global.CurrentB
+	buf.cx, buf.cy = buf.offsetToPos(offset)
+	buf.prefcx = buf.cx
+	return glisp.SexpInt(buf.posToOffset(buf.cx, buf.cy)), nil
+}
+
+func lispLineNumber(env *glisp.Glisp, name string, args []glisp.Sexp) (glisp.Sexp, error) {
+	if len(args) != 0 {
+		return glisp.SexpNull, glisp.WrongNargs
+	}
+	buf := Global.CurrentB
+	return glisp.SexpInt(buf.lineOffset() + buf.cy + 1), nil
+}
+
+func lispCurrentLineString(env *glisp.Glisp, name string, args []glisp.Sexp) (glisp.Sexp, error) {
+	if len(args) != 0 {
+		return glisp.SexpNull, glisp.WrongNargs
+	}
+	buf := Global.CurrentB
+	if buf.cy >= buf.NumRows {
+		return glisp.SexpStr(""), nil
+	}
+	return glisp.SexpStr(buf.row(buf.cy).Data), nil
+}
+
+func lispBufferSubstring(env *glisp.Glisp, name string, args []glisp.Sexp) (glisp.Sexp, error) {
+	if len(args) != 2 {
+		return glisp.SexpNull, glisp.WrongNargs
+	}
+	a, err := lispIntArg(args, 0)
+	if err != nil {
+		return glisp.SexpNull, err
+	}
+	b, err := lispIntArg(args, 1)
+	if err != nil {
+		return glisp.SexpNull, err
+	}
+	buf := Global.CurrentB
+	if buf.NumRows == 0 {
+		return glisp.SexpStr(""), nil
+	}
+	startc, endc, startl, endl := buf.offsetRange(a, b)
+	return glisp.SexpStr(getRegionText(buf, startc, endc, startl, endl)), nil
+}
+
+func lispBufferString(env *glisp.Glisp, name string, args []glisp.Sexp) (glisp.Sexp, error) {
+	if len(args) != 0 {
+		return glisp.SexpNull, glisp.WrongNargs
+	}
+	return glisp.SexpStr(strings.Join(Global.CurrentB.lines(), "\n")), nil
+}
+
+// Inserts the strings at point, leaving point after them. The universal
+// argument doesn't repeat them, as it would for a command.
+func lispInsert(env *glisp.Glisp, name string, args []glisp.Sexp) (glisp.Sexp, error) {
+	var bb bytes.Buffer
+	for i, arg := range args {
+		switch t := arg.(type) {
+		case glisp.SexpStr:
+			bb.WriteString(string(t))
+		default:
+			return glisp.SexpNull, errors.New("Arg " + strconv.Itoa(i+1) + " needs to be a string")
+		}
+	}
+	s := bb.String()
+	buf := Global.CurrentB
+	if s == "" || !buf.checkWritable() {
+		return glisp.SexpNull, nil
+	}
+	if strings.Contains(s, "\n") {
+		cx, cy := spitRegion(buf.cx, buf.cy, s)
+		editorAddRegionUndo(true, cx, buf.cx, cy, buf.cy, s)
+	} else {
+		setUniversal := Global.SetUniversal
+		Global.SetUniversal = false
+		editorInsertStr(s)
+		Global.SetUniversal = setUniversal
+	}
+	return glisp.SexpNull, nil
+}
+
+// Deletes the text between two offsets and returns it. It isn't put on the
+// kill ring.
+func lispDeleteRegion(env *glisp.Glisp, name string, args []glisp.Sexp) (glisp.Sexp, error) {
+	if len(args) != 2 {
+		return glisp.SexpNull, glisp.WrongNargs
+	}
+	a, err := lispIntArg(args, 0)
+	if err != nil {
+		return glisp.SexpNull, err
+	}
+	b, err := lispIntArg(args, 1)
+	if err != nil {
+		return glisp.SexpNull, err
+	}
+	buf := Global.CurrentB
+	startc, endc, startl, endl := buf.offsetRange(a, b)
+	if buf.NumRows == 0 || (startc == endc && startl == endl) || !buf.checkWritable() {
+		return glisp.SexpStr(""), nil
+	}
+	ret := bufKillRegion(buf, startc, endc, startl, endl)
+	editorAddRegionUndo(false, startc, endc, startl, endl, ret)
+	return glisp.SexpStr(ret), nil
+}
+
+// Returns the offset of the start of the region, or of its end if end is
+// set.
+func lispRegionBound(end bool) glisp.GlispUserFunction {
+	return func(env *glisp.Glisp, name string, args []glisp.Sexp) (glisp.Sexp, error) {
+		if len(args) != 0 {
+			return glisp.SexpNull, glisp.WrongNargs
+		}
+		buf := Global.CurrentB
+		if buf.MarkY > buf.NumRows || (buf.MarkY < buf.NumRows && buf.MarkX > buf.row(buf.MarkY).Size) {
+			return glisp.SexpNull, errors.New("The mark is not set now, so there is no region")
+		}
+		point, mark := buf.posToOffset(buf.cx, buf.cy), buf.posToOffset(buf.MarkX, buf.MarkY)
+		if (point > mark) == end {
+			return glisp.SexpInt(point), nil
+		}
+		return glisp.SexpInt(mark), nil
+	}
+}
+
+func lispBufferName(env *glisp.Glisp, name string, args []glisp.Sexp) (glisp.Sexp, error) {
+	if len(args) != 0 {
+		return glisp.SexpNull, glisp.WrongNargs
+	}
+	return glisp.SexpStr(Global.CurrentB.getRenderName()), nil
+}
+
+func lispBufferFileName(env *glisp.Glisp, name string, args []glisp.Sexp) (glisp.Sexp, error) {
+	if len(args) != 0 {
+		return glisp.SexpNull, glisp.WrongNargs
+	}
+	if Global.CurrentB.Filename == "" {
+		return glisp.SexpNull, nil
+	}
+	return glisp.SexpStr(Global.CurrentB.Filename), nil
+}
+
+// Shows the buffer called name in the current window, making a new empty
+// one if there's no such buffer.
+func lispSwitchToBuffer(env *glisp.Glisp, name string, args []glisp.Sexp) (glisp.Sexp, error) {
+	if len(args) != 1 {
+		return glisp.SexpNull, glisp.WrongNargs
+	}
+	var bufname string
+	switch t := args[0].(type) {
+	case glisp.SexpStr:
+		bufname = string(t)
+	default:
+		return glisp.SexpNull, errors.New("Arg needs to be a string")
+	}
+	buf := findBufferByName(bufname)
+	if buf == nil {
+		buf = getSpecialBuffer(bufname)
+		buf.AddDefaultModes()
+	}
+	switchToBuffer(buf)
+	return glisp.SexpNull, nil
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/mitchellh/go-homedir"
+	"github.com/zhemao/glisp/interpreter"
+)
+
+// The file run at startup and by reload-init-file. -l changes it, and -q
+// empties it so that nothing is run.
+var initFile = "~/.gomacs.lisp"
+
+// The directories load and require look in for files given without a
+// directory.
+var loadPath = []string{"~/.gomacs.d"}
+
+// The features that have been loaded by require or announced by provide.
+var features = map[string]bool{}
+
+// A file waiting to be loaded, and the feature it was required for, if any.
+type pendingLoad struct {
+	fn      string
+	feature string
+}
+
+// The interpreter can't run code while it's already running some, so load
+// and require queue the file, and it's loaded once the top-level expression
+// that asked for it has finished, before the next one starts.
+var pendingLoads []pendingLoad
+
+const maxLoadDepth = 20
+
+var loadDepth = 0
+
+// Finds the file name refers to. Names that start with /, ~ or . are used
+// as they are; others are looked for in each directory on the load path.
+// Either way, name.lisp is tried after name.
+func findLispFile(name string) (string, error) {
+	dirs := loadPath
+	if filepath.IsAbs(name) || strings.HasPrefix(name, "~") || strings.HasPrefix(name, ".") {
+		dirs = []string{""}
+	}
+	for _, dir := range dirs {
+		for _, fn := range []string{name, name + ".lisp"} {
+			fn, err := homedir.Expand(filepath.Join(dir, fn))
+			if err != nil {
+				return "", err
+			}
+			if fi, err := os.Stat(fn); err == nil && fi.Mode().IsRegular() {
+				return fn, nil
+			}
+		}
+	}
+	return "", errors.New("Cannot open load file: " + name)
+}
+
+// Goes through Lisp source, skipping strings, comments and characters such
+// as #\(, and calls form with where each top-level expression starts and
+// ends, including one left unfinished at the end. Returns whether src ends
+// in the middle of an expression or a string.
+func scanLispForms(src string, form func(start, end int)) bool {
+	start, depth := -1, 0
+	instr, escaped, comment := false, false, false
+	for i := 0; i < len(src); {
+		ru, size := utf8.DecodeRuneInString(src[i:])
+		switch {
+		case comment:
+			comment = ru != '\n'
+		case instr:
+			if escaped {
+				escaped = false
+			} else if ru == '\\' {
+				escaped = true
+			} else if ru == '"' {
+				instr = false
+			}
+		case ru == ';':
+			if depth == 0 && start >= 0 {
+				form(start, i)
+				start = -1
+			}
+			comment = true
+		case unicode.IsSpace(ru):
+			if depth == 0 && start >= 0 {
+				form(start, i)
+				start = -1
+			}
+		default:
+			if start < 0 {
+				start = i
+			}
+			switch ru {
+			case '"':
+				instr = true
+			case '#':
+				// A character such as #\( mustn't count as a bracket.
+				if strings.HasPrefix(src[i+1:], "\\") {
+					_, csize := utf8.DecodeRuneInString(src[i+2:])
+					size += 1 + csize
+				}
+			case '(', '[', '{':
+				depth++
+			case ')', ']', '}':
+				depth--
+				if depth <= 0 {
+					form(start, i+size)
+					start, depth = -1, 0
+				}
+			}
+		}
+		i += size
+	}
+	if start >= 0 {
+		form(start, len(src))
+	}
+	return depth > 0 || instr
+}
+
+// Splits Lisp source into its top-level expressions.
+func splitLispForms(src string) []string {
+	forms := []string{}
+	scanLispForms(src, func(start, end int) {
+		forms = append(forms, src[start:end])
+	})
+	return forms
+}
+
+// Runs the top-level expressions in src one at a time, loading the files
+// each one asks for before going on to the next, and returns the value of
+// the last. It stops at the first error, leaving env ready to use again.
+func evalForms(env *glisp.Glisp, src string) (glisp.Sexp, error) {
+	ret := glisp.Sexp(glisp.SexpNull)
+	for _, form := range splitLispForms(src) {
+		var err error
+		ret, err = env.EvalString(form)
+		if err != nil {
+			env.Clear()
+			pendingLoads = nil
+			return glisp.SexpNull, err
+		}
+		if err := runPendingLoads(env); err != nil {
+			return glisp.SexpNull, err
+		}
+	}
+	return ret, nil
+}
+
+// Loads the files queued since this was last called.
+func runPendingLoads(env *glisp.Glisp) error {
+	loads := pendingLoads
+	pendingLoads = nil
+	for _, l := range loads {
+		if err := loadLispFile(env, l.fn); err != nil {
+			if l.feature != "" {
+				delete(features, l.feature)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// Loads any files queued by Lisp run outside evalForms, such as a function
+// bound to a key, and reports what goes wrong.
+func loadPendingFiles(env *glisp.Glisp) {
+	if len(pendingLoads) == 0 {
+		return
+	}
+	if err := runPendingLoads(env); err != nil {
+		Global.Input = "Error loading: " + err.Error()
+		AddErrorMessage(Global.Input)
+	}
+}
+
+func loadLispFile(env *glisp.Glisp, fn string) error {
+	if loadDepth >= maxLoadDepth {
+		return errors.New("Too many nested loads; does " + fn + " load itself?")
+	}
+	src, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return err
+	}
+	loadDepth++
+	defer func() { loadDepth-- }()
+	if _, err := evalForms(env, string(src)); err != nil {
+		return errors.New(fn + ": " + err.Error())
+	}
+	return nil
+}
+
+func lispNameArg(arg glisp.Sexp) (string, error) {
+	switch t := arg.(type) {
+	case glisp.SexpStr:
+		return string(t), nil
+	case glisp.SexpSymbol:
+		return t.Name(), nil
+	default:
+		return "", errors.New("Arg needs to be a string or a symbol")
+	}
+}
+
+func lispLoad(env *glisp.Glisp, name string, args []glisp.Sexp) (glisp.Sexp, error) {
+	if len(args) != 1 {
+		return glisp.SexpNull, glisp.WrongNargs
+	}
+	file, err := lispNameArg(args[0])
+	if err != nil {
+		return glisp.SexpNull, err
+	}
+	fn, err := findLispFile(file)
+	if err != nil {
+		return glisp.SexpNull, err
+	}
+	pendingLoads = append(pendingLoads, pendingLoad{fn, ""})
+	return glisp.SexpBool(true), nil
+}
+
+// Loads the file for a feature from the load path, unless it's already been
+// loaded.
+func lispRequire(env *glisp.Glisp, name string, args []glisp.Sexp) (glisp.Sexp, error) {
+	if len(args) != 1 {
+		return glisp.SexpNull, glisp.WrongNargs
+	}
+	feature, err := lispNameArg(args[0])
+	if err != nil {
+		return glisp.SexpNull, err
+	}
+	if features[feature] {
+		return glisp.SexpBool(false), nil
+	}
+	fn, err := findLispFile(feature)
+	if err != nil {
+		return glisp.SexpNull, err
+	}
+	features[feature] = true
+	pendingLoads = append(pendingLoads, pendingLoad{fn, feature})
+	return glisp.SexpBool(true), nil
+}
+
+func lispProvide(env *glisp.Glisp, name string, args []glisp.Sexp) (glisp.Sexp, error) {
+	if len(args) != 1 {
+		return glisp.SexpNull, glisp.WrongNargs
+	}
+	feature, err := lispNameArg(args[0])
+	if err != nil {
+		return glisp.SexpNull, err
+	}
+	features[feature] = true
+	return glisp.SexpNull, nil
+}
+
+func lispAddLoadPath(env *glisp.Glisp, name string, args []glisp.Sexp) (glisp.Sexp, error) {
+	if len(args) != 1 {
+		return glisp.SexpNull, glisp.WrongNargs
+	}
+	switch t := args[0].(type) {
+	case glisp.SexpStr:
+		loadPath = append([]string{string(t)}, loadPath...)
+	default:
+		return glisp.SexpNull, errors.New("Arg needs to be a string")
+	}
+	return glisp.SexpNull, nil
+}
+
+func reloadInitFile(env *glisp.Glisp) {
+	if initFile == "" {
+		Global.Input = "No init file to reload (started with -q)"
+		return
+	}
+	fn, err := homedir.Expand(initFile)
+	if err != nil {
+		Global.Input = err.Error()
+		return
+	}
+	pendingLoads = append(pendingLoads, pendingLoad{fn, ""})
+	if err := runPendingLoads(env); err != nil {
+		Global.Input = "Error loading: " + err.Error()
+		AddErrorMessage(Global.Input)
+		return
+	}
+	Global.Input = "Reloaded " + initFile
+}
@@ -25,6 +25,8 @@ func runMacroOnce(env *glisp.Glisp, m []*EditorAction) {
 			Global.Universal = act.Universal
 			Global.SetUniversal = act.HasUniversal
 			act.Command.Com(env)
+			// Each action was a key of its own when it was recorded.
+			Global.KillRing.endCommand()
 			Global.SetUniversal = false
 		}
 	}
@@ -36,11 +38,13 @@ func micromode(repeatkey string, msg string, env *glisp.Glisp, f func(*glisp.Gli
 	editorRefreshScreen()
 	key := editorGetKey()
 	for key == repeatkey {
+		Global.KillRing.endCommand()
 		f(env)
 		editorRefreshScreen()
 		key = editorGetKey()
 	}
 	Global.SetUniversal = false
+	Global.KillRing.endCommand()
 	RunCommandForKey(key, env)
 }
 
@@ -1,10 +1,11 @@
 package main
 
 import (
-	"bufio"
 	"bytes"
+	"crypto/sha256"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"path"
@@ -16,7 +17,6 @@ import (
 	"unicode/utf8"
 
 	"github.com/mitchellh/go-homedir"
-	"github.com/nsf/termbox-go"
 	"github.com/zhemao/glisp/interpreter"
 	"github.com/zyedidia/highlight"
 )
@@ -24,13 +24,14 @@ import (
 const TIMEOUT int64 = 10000000
 
 type EditorRow struct {
-	idx        int
 	Size       int
 	Data       string
 	RenderSize int
 	Render     string
 	HlState    highlight.State
 	HlMatches  highlight.LineMatch
+	tabsize    int       // The tab width Render was made with
+	leaf       *ropeNode // Where the row is in its buffer; see rows.go
 }
 
 type EditorBuffer struct {
@@ -43,9 +44,9 @@ type EditorBuffer struct {
 	rowoff       int
 	coloff       int
 	NumRows      int
-	Rows         []*EditorRow
+	rows         rowRope // Only used through the methods in rows.go
 	Undo         *EditorUndo
-	Redo         *EditorUndo
+	UndoRoot     *EditorUndo // Holds the branches made on the unmodified buffer
 	SaveUndo     *EditorUndo // The undo at which we can undirty the buffer
 	MarkX        int
 	MarkY        int
@@ -57,6 +58,15 @@ type EditorBuffer struct {
 	needshl      bool
 	regionActive bool
 	region       *Region
+	Dir          string // Where file names in a special buffer are relative to
+	disk         fileStamp
+	autoSaveDone bool // The auto-save file is up to date with autoSaveUndo
+	autoSaveUndo *EditorUndo
+	backedUp     bool // A backup has been made since the file was opened
+	coding       codingSystem
+	ReadOnly     bool
+	large        *largeFile             // Set in large-file mode
+	locals       map[string]interface{} // The buffer's own values of variables
 }
 
 type EditorState struct {
@@ -69,7 +79,7 @@ type EditorState struct {
 	NoSyntax                bool
 	Windows                 []*EditorBuffer
 	CurrentBHeight          int
-	Clipboard               string
+	KillRing                *KillRing
 	SoftTab                 bool
 	DefaultModes            map[string]bool
 	messages                []string
@@ -133,18 +143,20 @@ func saveBuffersKillEmacs(env *glisp.Glisp) {
 	}
 }
 
-func rowUpdateRender(row *EditorRow) {
-	tabs := 0
-	for _, rv := range row.Data {
-		if rv == '\t' {
-			tabs++
-		}
+func rowUpdateRender(row *EditorRow, buf *EditorBuffer) {
+	row.tabsize = buf.tabWidth()
+	tabs := strings.Count(row.Data, "\t")
+	row.RenderSize = row.Size + tabs*(row.tabsize-1) + 1
+	if tabs == 0 {
+		// Nothing to expand, so share the string rather than copying it.
+		row.Render = row.Data
+		return
 	}
 	var buffer bytes.Buffer
-	row.RenderSize = row.Size + tabs*(Global.Tabsize-1) + 1
+	buffer.Grow(row.RenderSize)
 	for _, rv := range row.Data {
 		if rv == '\t' {
-			for i := 0; i < Global.Tabsize; i++ {
+			for i := 0; i < row.tabsize; i++ {
 				buffer.WriteByte(' ')
 			}
 		} else {
@@ -156,29 +168,30 @@ func rowUpdateRender(row *EditorRow) {
 
 func editorReHighlightRow(row *EditorRow, buf *EditorBuffer) {
 	if buf.Highlighter != nil {
-		if buf.rehlfrom >= 0 && buf.rehlfrom != row.idx {
-			if row.idx < buf.rehlfrom {
-				buf.rehlfrom = row.idx
+		at := row.index()
+		if buf.rehlfrom >= 0 && buf.rehlfrom != at {
+			if at < buf.rehlfrom {
+				buf.rehlfrom = at
 			}
 			buf.needshl = true
 		} else {
-			buf.rehlfrom = row.idx
+			buf.rehlfrom = at
 		}
 	}
 }
 
 func (buf *EditorBuffer) updateHighlighting() {
 	if buf.Highlighter != nil && buf.rehlfrom >= 0 {
-		row := buf.Rows[buf.rehlfrom]
-		curstate := buf.State(row.idx)
-		buf.Highlighter.ReHighlightStates(buf, row.idx)
-		if curstate != buf.State(row.idx) || buf.needshl {
+		at := buf.rehlfrom
+		curstate := buf.State(at)
+		buf.Highlighter.ReHighlightStates(buf, at)
+		if curstate != buf.State(at) || buf.needshl {
 			// If the EOL state changed, the buffer needs rehighlighting
 			// as this was probably multiline comment or string.
-			buf.Highlighter.HighlightMatches(buf, row.idx, buf.NumRows)
+			buf.Highlighter.HighlightMatches(buf, at, buf.NumRows)
 		} else {
 			// Probably only this line changed.
-			buf.Highlighter.ReHighlightLine(buf, row.idx)
+			buf.Highlighter.ReHighlightLine(buf, at)
 		}
 		buf.rehlfrom = -1
 		buf.needshl = false
@@ -186,47 +199,32 @@ func (buf *EditorBuffer) updateHighlighting() {
 }
 
 func editorUpdateRow(row *EditorRow, buf *EditorBuffer) {
-	rowUpdateRender(row)
+	rowUpdateRender(row, buf)
 	editorReHighlightRow(row, buf)
 }
 
-func updateLineIndexes() {
-	for i, row := range Global.CurrentB.Rows {
-		row.idx = i
-	}
-}
-
 func editorAppendRow(line string) {
-	Global.CurrentB.Rows = append(Global.CurrentB.Rows, &EditorRow{Global.CurrentB.NumRows,
-		len(line), line, 0, "", nil, nil})
-	editorUpdateRow(Global.CurrentB.Rows[Global.CurrentB.NumRows], Global.CurrentB)
-	Global.CurrentB.NumRows++
-	Global.CurrentB.Dirty = true
+	buf := Global.CurrentB
+	buf.insertRows(buf.NumRows, &EditorRow{len(line), line, 0, "", nil, nil, 0, nil})
+	editorUpdateRow(buf.row(buf.NumRows-1), buf)
+	buf.Dirty = true
 }
 
 func editorDelRow(at int) {
-	if at < 0 || at > Global.CurrentB.NumRows {
+	if at < 0 || at >= Global.CurrentB.NumRows {
 		return
 	}
-	copy(Global.CurrentB.Rows[at:], Global.CurrentB.Rows[at+1:])
-	Global.CurrentB.Rows[len(Global.CurrentB.Rows)-1] = nil
-	Global.CurrentB.Rows = Global.CurrentB.Rows[:len(Global.CurrentB.Rows)-1]
-	Global.CurrentB.NumRows--
+	Global.CurrentB.deleteRows(at, at+1)
 	Global.CurrentB.Dirty = true
-	updateLineIndexes()
 }
 
 func editorInsertRow(at int, line string) {
 	if at < 0 || at > Global.CurrentB.NumRows {
 		return
 	}
-	Global.CurrentB.Rows = append(Global.CurrentB.Rows, nil)
-	copy(Global.CurrentB.Rows[at+1:], Global.CurrentB.Rows[at:])
-	Global.CurrentB.Rows[at] = &EditorRow{at, len(line), line, 0, "", nil, nil}
-	editorUpdateRow(Global.CurrentB.Rows[at], Global.CurrentB)
-	Global.CurrentB.NumRows++
+	Global.CurrentB.insertRows(at, &EditorRow{len(line), line, 0, "", nil, nil, 0, nil})
+	editorUpdateRow(Global.CurrentB.row(at), Global.CurrentB)
 	Global.CurrentB.Dirty = true
-	updateLineIndexes()
 }
 
 func editorRowAppendStr(row *EditorRow, buf *EditorBuffer, s string) {
@@ -268,6 +266,9 @@ func editorRowDelChar(row *EditorRow, buf *EditorBuffer, at int, rw int) {
 }
 
 func editorInsertStr(s string) {
+	if !Global.CurrentB.checkWritable() {
+		return
+	}
 	if Global.SetUniversal && Global.Universal >= 0 {
 		os := s
 		s = ""
@@ -283,11 +284,14 @@ func editorInsertStr(s string) {
 		return
 	}
 	editorAddInsertUndo(Global.CurrentB.cx, Global.CurrentB.cy, s)
-	editorRowInsertStr(Global.CurrentB.Rows[Global.CurrentB.cy], Global.CurrentB, Global.CurrentB.cx, s)
+	editorRowInsertStr(Global.CurrentB.row(Global.CurrentB.cy), Global.CurrentB, Global.CurrentB.cx, s)
 	Global.CurrentB.cx += len(s)
 }
 
 func editorDelChar() {
+	if !Global.CurrentB.checkWritable() {
+		return
+	}
 	times := 1
 	if Global.SetUniversal {
 		if Global.Universal >= 0 {
@@ -305,18 +309,18 @@ func editorDelChar() {
 		if Global.CurrentB.cy == Global.CurrentB.NumRows {
 			return
 		}
-		row := Global.CurrentB.Rows[Global.CurrentB.cy]
+		row := Global.CurrentB.row(Global.CurrentB.cy)
 		if Global.CurrentB.cx > 0 {
-			_, rs := utf8.DecodeLastRuneInString(Global.CurrentB.Rows[Global.CurrentB.cy].Data[:Global.CurrentB.cx])
+			_, rs := utf8.DecodeLastRuneInString(Global.CurrentB.row(Global.CurrentB.cy).Data[:Global.CurrentB.cx])
 			editorAddDeleteUndo(Global.CurrentB.cx-rs, Global.CurrentB.cx, Global.CurrentB.cy,
 				Global.CurrentB.cy, row.Data[Global.CurrentB.cx-rs:Global.CurrentB.cx])
 			editorRowDelChar(row, Global.CurrentB, Global.CurrentB.cx-rs, rs)
 			Global.CurrentB.cx -= rs
 		} else {
-			editorAddDeleteUndo(Global.CurrentB.cx, Global.CurrentB.Rows[Global.CurrentB.cy-1].Size,
+			editorAddDeleteUndo(Global.CurrentB.cx, Global.CurrentB.row(Global.CurrentB.cy-1).Size,
 				Global.CurrentB.cy-1, Global.CurrentB.cy, row.Data)
-			Global.CurrentB.cx = Global.CurrentB.Rows[Global.CurrentB.cy-1].Size
-			editorRowAppendStr(Global.CurrentB.Rows[Global.CurrentB.cy-1], Global.CurrentB, row.Data)
+			Global.CurrentB.cx = Global.CurrentB.row(Global.CurrentB.cy - 1).Size
+			editorRowAppendStr(Global.CurrentB.row(Global.CurrentB.cy-1), Global.CurrentB, row.Data)
 			editorDelRow(Global.CurrentB.cy)
 			Global.CurrentB.cy--
 		}
@@ -324,6 +328,9 @@ func editorDelChar() {
 }
 
 func editorDelForwardChar() {
+	if !Global.CurrentB.checkWritable() {
+		return
+	}
 	times := 1
 	if Global.SetUniversal {
 		if Global.Universal < 0 {
@@ -355,6 +362,9 @@ func getIndentation(s string) string {
 }
 
 func editorInsertNewline(indent bool) {
+	if !Global.CurrentB.checkWritable() {
+		return
+	}
 	if Global.CurrentB.cy == Global.CurrentB.NumRows {
 		defer func() { Global.CurrentB.cy++; Global.CurrentB.cx = 0 }()
 		if Global.CurrentB.NumRows == 0 {
@@ -362,10 +372,10 @@ func editorInsertNewline(indent bool) {
 			return
 		} else {
 			Global.CurrentB.cy--
-			Global.CurrentB.cx = Global.CurrentB.Rows[Global.CurrentB.cy].Size
+			Global.CurrentB.cx = Global.CurrentB.row(Global.CurrentB.cy).Size
 		}
 	}
-	row := Global.CurrentB.Rows[Global.CurrentB.cy]
+	row := Global.CurrentB.row(Global.CurrentB.cy)
 	if Global.CurrentB.cx == 0 {
 		editorAddInsertUndo(Global.CurrentB.cx, Global.CurrentB.cy, "\n")
 		editorInsertRow(Global.CurrentB.cy, "")
@@ -378,7 +388,7 @@ func editorInsertNewline(indent bool) {
 		data := pre + row.Data[Global.CurrentB.cx:]
 		editorAddInsertUndo(Global.CurrentB.cx, Global.CurrentB.cy, "\n"+pre)
 		editorInsertRow(Global.CurrentB.cy+1, data)
-		row = Global.CurrentB.Rows[Global.CurrentB.cy]
+		row = Global.CurrentB.row(Global.CurrentB.cy)
 		row.Size = Global.CurrentB.cx
 		row.Data = row.Data[0:Global.CurrentB.cx]
 		editorUpdateRow(row, Global.CurrentB)
@@ -403,24 +413,80 @@ func AbsPath(filename string) (string, error) {
 }
 
 func EditorOpen(filename string, env *glisp.Glisp) error {
+	return editorOpenFile(filename, env, true)
+}
+
+// Opens filename into the current buffer. If allowLarge is set, files over
+// largeFileThreshold are opened in large-file mode.
+func editorOpenFile(filename string, env *glisp.Glisp, allowLarge bool) error {
 	fpath, perr := AbsPath(filename)
 	if perr != nil {
 		return perr
 	}
 	Global.CurrentB.Filename = fpath
 	Global.CurrentB.UpdateRenderName()
-	f, err := os.Open(fpath)
-	if err != nil {
+	if large, size := isLargeFile(fpath); large && allowLarge {
+		return openLargeFile(Global.CurrentB, fpath, size)
+	}
+	lines, coding, stamp, err := readFileLines(fpath)
+	if _, partial := err.(*partialReadError); err != nil && !partial {
 		return err
 	}
-	defer f.Close()
-	scanner := bufio.NewScanner(f)
-	for scanner.Scan() {
-		editorAppendRow(scanner.Text())
+	buf := Global.CurrentB
+	rows := make([]*EditorRow, len(lines))
+	for i, line := range lines {
+		rows[i] = newRow(buf, line)
 	}
+	buf.insertRows(buf.NumRows, rows...)
+	Global.CurrentB.coding = coding
+	Global.CurrentB.disk = stamp
 	Global.CurrentB.Dirty = false
+	Global.CurrentB.ReadOnly = !fileWritable(fpath)
 	editorSelectSyntaxHighlight(Global.CurrentB, env)
-	return nil
+	if hasNewerAutoSave(fpath) {
+		Global.Input = Global.CurrentB.getRenderName() + " has auto-save data; M-x recover-file to recover it"
+	}
+	// On a partial read, what we got is loaded but the caller reports the
+	// error.
+	return err
+}
+
+// A read that failed partway through the file. readFileLines still returns
+// the lines before the failure.
+type partialReadError struct {
+	fn   string
+	read int
+	err  error
+}
+
+func (e *partialReadError) Error() string {
+	return fmt.Sprintf("%s: only the first %d bytes could be read: %s", e.fn, e.read, e.err)
+}
+
+// Reads the lines of a file, working out its coding system, and notes what
+// it looked like for changedOnDisk. Lines can be of any length.
+func readFileLines(fn string) ([]string, codingSystem, fileStamp, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return nil, defaultCoding, fileStamp{}, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, defaultCoding, fileStamp{}, err
+	}
+	h := sha256.New()
+	data, err := ioutil.ReadAll(io.TeeReader(f, h))
+	if err != nil {
+		if len(data) == 0 {
+			return nil, defaultCoding, fileStamp{}, err
+		}
+		// The stamp is left empty, so saving over the file will ask first.
+		lines, coding := decodeLines(data)
+		return lines, coding, fileStamp{}, &partialReadError{fn, len(data), err}
+	}
+	lines, coding := decodeLines(data)
+	return lines, coding, newFileStamp(fi, h.Sum(nil)), nil
 }
 
 func (buf *EditorBuffer) UpdateRenderName() {
@@ -459,7 +525,18 @@ func EditorSave(env *glisp.Glisp) {
 }
 
 func editorBufSave(buf *EditorBuffer, env *glisp.Glisp) {
+	if buf.large != nil {
+		Global.Input = buf.getRenderName() + " is in large-file mode and can't be saved"
+		return
+	}
 	fn := buf.Filename
+	if fn != "" && buf.changedOnDisk() {
+		ok, err := editorYesNoPrompt(buf.getRenderName()+" has changed on disk since it was read; save anyway?", false)
+		if err != nil || !ok {
+			Global.Input = "Save aborted; M-x revert-buffer rereads the file"
+			return
+		}
+	}
 	if fn == "" {
 		fn = editorPrompt("Save as", nil)
 		if fn == "" {
@@ -478,29 +555,34 @@ func editorBufSave(buf *EditorBuffer, env *glisp.Glisp) {
 		}
 	}
 	editorSelectSyntaxHighlight(buf, env)
-	f, err := os.Create(fn)
+	data, l, err := bufferBytes(buf)
+	if err == nil {
+		err = saveFile(buf, fn, data)
+	}
 	if err != nil {
 		Global.Input = err.Error()
 		AddErrorMessage(err.Error())
 		return
 	}
-	defer f.Close()
-	l, b := 0, 0
-	for _, row := range buf.Rows {
-		f.WriteString(row.Data)
-		f.WriteString("\n")
-		b += row.Size + 1
-		l++
-	}
-	Global.Input = fmt.Sprintf("Wrote %d lines (%d bytes) to %s", l, b, fn)
+	buf.disk, _ = statFileStamp(fn)
+	removeAutoSave(buf)
+	Global.Input = fmt.Sprintf("Wrote %d lines (%d bytes) to %s", l, len(data), fn)
 	AddErrorMessage(Global.Input)
 	buf.Dirty = false
 	buf.SaveUndo = buf.Undo
 }
 
+// Returns the text of buf as it's written to its file, in its coding
+// system, and how many lines that is.
+func bufferBytes(buf *EditorBuffer) ([]byte, int, error) {
+	lines := buf.lines()
+	data, err := encodeLines(lines, buf.codingSystem())
+	return data, len(lines), err
+}
+
 func getTabString() string {
-	if Global.SoftTab {
-		return strings.Repeat(" ", Global.Tabsize)
+	if Global.CurrentB.softTab() {
+		return strings.Repeat(" ", Global.CurrentB.tabWidth())
 	} else {
 		return "\t"
 	}
@@ -510,13 +592,14 @@ func InitEditor() {
 	buffer := &EditorBuffer{}
 	buffer.MajorMode = "Unknown"
 	Global = EditorState{false, "", buffer, []*EditorBuffer{buffer}, 4, "",
-		false, []*EditorBuffer{buffer}, 0, "", false, make(map[string]bool),
+		false, []*EditorBuffer{buffer}, 0, NewKillRing(), false, make(map[string]bool),
 		[]string{}, false, 0, false, loadDefaultHooks(), nil, false, 0,
 		NewRegisterList(), 80, make(map[string]*CommandList), 0, 0}
 	Global.DefaultModes["terminal-title-mode"] = true
 	Emacs = new(CommandList)
 	Emacs.Parent = true
 	funcnames = make(map[string]*CommandFunc)
+	loadDefaultVariables()
 }
 
 func dumpCrashLog(e string) {
@@ -539,7 +622,8 @@ func RunCommandForKey(key string, env *glisp.Glisp) {
 		return
 	}
 	// Hack fixed (though we won't support any encoding save utf8)
-	if !Global.CurrentB.hasMode("no-self-insert-mode") && utf8.RuneCountInString(key) == 1 {
+	if !Global.CurrentB.hasMode("no-self-insert-mode") && utf8.RuneCountInString(key) == 1 &&
+		!minorModeBinds(Global.CurrentB, key) {
 		com := &CommandFunc{
 			key,
 			func(*glisp.Glisp) {
@@ -550,16 +634,8 @@ func RunCommandForKey(key string, env *glisp.Glisp) {
 		com.Run(env)
 		return
 	}
-	if Global.MajorBindings[Global.CurrentB.MajorMode] != nil {
-		Global.Input = ""
-		com, comerr := Global.MajorBindings[Global.CurrentB.MajorMode].GetCommand(key)
-		if com != nil && comerr == nil {
-			com.Run(env)
-			return
-		}
-	}
 	Global.Input = ""
-	com, comerr := Emacs.GetCommand(key)
+	com, comerr := getCommandForKey(key)
 	if comerr != nil {
 		Global.Input = comerr.Error()
 		return
@@ -568,8 +644,22 @@ func RunCommandForKey(key string, env *glisp.Glisp) {
 	}
 }
 
+// Runs the command for a key typed at the top level, rather than read by a
+// command that's already running, then does what has to be done between
+// commands.
+func runTopLevelKey(key string, env *glisp.Glisp) {
+	commandRunning = true
+	RunCommandForKey(key, env)
+	commandRunning = false
+	Global.KillRing.endCommand()
+	loadPendingFiles(env)
+	updateAutoRevert()
+	runPendingEvents()
+}
+
 func AddErrorMessage(msg string) {
 	Global.messages = append(Global.messages, msg)
+	appendMessagesBuffer(msg)
 }
 
 func SetUniversalArgument(env *glisp.Glisp) {
@@ -630,28 +720,29 @@ func getRepeatTimes() int {
 	}
 }
 
+// Sets fill-column for the current buffer only; other buffers keep theirs.
 func setFillColumn() {
-	if Global.SetUniversal {
-		if Global.Universal > 0 {
-			Global.Fillcolumn = Global.Universal
-			Global.Input = fmt.Sprintf("Fill column set to %d", Global.Fillcolumn)
-		} else {
-			Global.Input = fmt.Sprintf("Invalid value for fill column: %d", Global.Universal)
-			AddErrorMessage(Global.Input)
-		}
-	} else {
-		fc, err := strconv.Atoi(editorPrompt("Set the fill column to", nil))
+	fc := Global.Universal
+	if !Global.SetUniversal {
+		var err error
+		fc, err = strconv.Atoi(editorPrompt("Set the fill column to", nil))
 		if err != nil {
 			Global.Input = "Invalid value for fill column: " + err.Error()
 			AddErrorMessage(Global.Input)
-		} else if fc <= 0 {
-			Global.Input = fmt.Sprintf("Invalid value for fill column: %d", Global.Universal)
-			AddErrorMessage(Global.Input)
-		} else {
-			Global.Fillcolumn = fc
-			Global.Input = fmt.Sprintf("Fill column set to %d", fc)
+			return
 		}
 	}
+	if fc <= 0 {
+		Global.Input = fmt.Sprintf("Invalid value for fill column: %d", fc)
+		AddErrorMessage(Global.Input)
+		return
+	}
+	if err := setLocalVariable(Global.CurrentB, editorVariables["fill-column"], fc); err != nil {
+		Global.Input = err.Error()
+		AddErrorMessage(Global.Input)
+		return
+	}
+	Global.Input = fmt.Sprintf("Fill column set to %d", fc)
 }
 
 func keyboardQuit() {
@@ -660,15 +751,25 @@ func keyboardQuit() {
 }
 
 func main() {
-	var dumptreequit bool
+	var dumptreequit, noinit bool
+	loadfile := ""
 	cpuprofile := ""
 	InitEditor()
 	fs := flag.NewFlagSet("", flag.ExitOnError)
 	fs.BoolVar(&Global.NoSyntax, "s", false, "disable syntax highlighting")
 	fs.BoolVar(&Global.debug, "d", false, "enable dumps of crash logs")
 	fs.BoolVar(&dumptreequit, "D", false, "dump the keybindings to stdout and quit")
+	fs.BoolVar(&noinit, "q", false, "don't load the init file")
+	fs.StringVar(&loadfile, "l", "", "load this file instead of ~/.gomacs.lisp")
 	fs.StringVar(&cpuprofile, "cpuprofile", "", "write cpu profile to file")
 	fs.Parse(os.Args[1:])
+	if noinit {
+		initFile = ""
+		loadPackagesAtStartup = false
+	}
+	if loadfile != "" {
+		initFile = loadfile
+	}
 	if cpuprofile != "" {
 		f, err := os.Create(cpuprofile)
 		if err != nil {
@@ -711,17 +812,22 @@ func main() {
 	}
 
 	InitTerm()
-	defer termbox.Close()
+	defer screen.Close()
+	defer autoSaveOnCrash()
+	catchFatalSignals()
+	updateAutoRevert()
 	editorRefreshScreen()
 	lastkey := "<none>"
 	lt := time.Now()
 	for {
 		if Global.quit {
+			removeAutoSaveSession()
 			return
 		} else {
 			key := editorGetKey()
 			t := time.Now()
-			RunCommandForKey(key, env)
+			runTopLevelKey(key, env)
+			autoSaveAfterKey()
 			// A bit hacky, but this fixes some of our speed issues when pasting.
 			// Don't do the optimisation if this key and the last were the same!
 			if t.UnixNano()-lt.UnixNano() > TIMEOUT || lastkey == key {
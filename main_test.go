@@ -0,0 +1,805 @@
+package main
+
+import (
+	"archive/tar"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zhemao/glisp/interpreter"
+)
+
+// go test -update rewrites the golden files with what the editor draws now.
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// Worked out before any test changes directory.
+var testdata, _ = filepath.Abs("testdata")
+
+// Compares got with testdata/name.golden.
+func checkGolden(t *testing.T, name, got string) {
+	t.Helper()
+	fn := filepath.Join(testdata, name+".golden")
+	if *update {
+		if err := ioutil.WriteFile(fn, []byte(got), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := ioutil.ReadFile(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != string(want) {
+		t.Errorf("%s doesn't match %s:\n--- got\n%s\n--- want\n%s", name, fn, got, want)
+	}
+}
+
+// Runs the test in a new empty directory, so that files it visits have the
+// same names every time.
+func inTempDir(t *testing.T) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "gomacs-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		os.Chdir(wd)
+		os.RemoveAll(dir)
+	})
+	return dir
+}
+
+func TestScriptedKeys(t *testing.T) {
+	tests := []struct {
+		seq  string
+		want []string
+	}{
+		{"C-x C-f foo RET C-k", []string{"C-x", "C-f", "f", "o", "o", "RET", "C-k"}},
+		{"a SPC M-% f1 LEFT", []string{"a", " ", "M-%", "f1", "LEFT"}},
+		{`C-x "RET" SPC "C-x"`, []string{"C-x", "R", "E", "T", " ", "C", "-", "x"}},
+		{`"a b" "say \"hi\"\\"`, []string{"a", " ", "b", "s", "a", "y", " ", "\"", "h", "i", "\"", "\\"}},
+	}
+	for _, tt := range tests {
+		got := NewScriptedKeys(tt.seq).Keys
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("NewScriptedKeys(%q) = %q, want %q", tt.seq, got, tt.want)
+		}
+	}
+}
+
+func TestFindFileKillLine(t *testing.T) {
+	inTempDir(t)
+	if err := ioutil.WriteFile("foo", []byte("first line\nsecond line\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	vs, env := StartHeadless(40, 8)
+	RunKeys(env, "C-x C-f foo RET C-k")
+	buf := Global.CurrentB
+	if buf.getRenderName() != "foo" {
+		t.Fatalf("visited %q, want foo", buf.getRenderName())
+	}
+	if got := BufferString(buf); got != "\nsecond line" {
+		t.Errorf("buffer is %q", got)
+	}
+	if got := Global.KillRing.Current(); got != "first line" {
+		t.Errorf("killed %q", got)
+	}
+	if !buf.Dirty {
+		t.Error("buffer isn't modified")
+	}
+	checkGolden(t, "find-file-kill-line", vs.String())
+}
+
+func TestTypeKeyNames(t *testing.T) {
+	_, env := StartHeadless(40, 8)
+	RunKeys(env, `"RET" RET "C-x" SPC "f1"`)
+	if got := BufferString(Global.CurrentB); got != "RET\nC-x f1" {
+		t.Errorf("buffer is %q", got)
+	}
+}
+
+func TestDrawRows(t *testing.T) {
+	vs, env := StartHeadless(30, 8)
+	RunKeys(env, `"package main" RET RET "func main() {" RET C-q TAB "println(1)" RET "}" M-<`)
+	buf := Global.CurrentB
+	vs.Clear()
+	editorDrawRows(0, 6, buf, 0)
+	checkGolden(t, "draw-rows", vs.String())
+
+	buf.setMode("line-number-mode", true)
+	vs.Clear()
+	editorDrawRows(0, 6, buf, GetGutterWidth(buf.NumRows))
+	checkGolden(t, "draw-rows-line-numbers", vs.String())
+}
+
+func TestDrawRowsScrolled(t *testing.T) {
+	vs, env := StartHeadless(20, 6)
+	RunKeys(env, `"a line that is longer than the screen" RET "short"`)
+	buf := Global.CurrentB
+	buf.coloff = 10
+	vs.Clear()
+	editorDrawRows(0, 4, buf, 0)
+	checkGolden(t, "draw-rows-scrolled", vs.String())
+}
+
+func TestDrawStatusLine(t *testing.T) {
+	inTempDir(t)
+	if err := ioutil.WriteFile("notes.txt", []byte("one\ntwo\nthree\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	vs, env := StartHeadless(50, 6)
+	RunKeys(env, "C-x C-f notes.txt RET C-n C-e")
+	buf := Global.CurrentB
+	vs.Clear()
+	editorDrawStatusLine(50, 0, buf)
+	buf.Dirty = true
+	editorDrawStatusLine(50, 1, buf)
+	buf.ReadOnly = true
+	editorDrawStatusLine(50, 2, buf)
+	// Windows other than the current one have no dashes.
+	Global.CurrentB = &EditorBuffer{}
+	editorDrawStatusLine(50, 3, buf)
+	checkGolden(t, "draw-status-line", vs.String())
+}
+
+func TestSplitWindowScreen(t *testing.T) {
+	vs, env := StartHeadless(40, 12)
+	RunKeys(env, `"top and bottom" RET "both show this" C-x 2`)
+	checkGolden(t, "split-window", vs.String())
+}
+
+func TestKillsAppend(t *testing.T) {
+	tests := []struct {
+		seq, want string
+	}{
+		// The C-k run by C-u is part of the same key, so the next one joins on.
+		{"C-u 2 C-k C-k", "a\nb\nc"},
+		{"C-k C-k C-x z z", "a\nb\n"},
+		// Each key in a macro is a command of its own.
+		{"C-x ( C-k C-n C-k C-x ) C-x e", "d"},
+		{"C-k C-n C-k", "b"},
+	}
+	for _, tt := range tests {
+		_, env := StartHeadless(40, 8)
+		RunKeys(env, `"a" RET "b" RET "c" RET "d" M-<`)
+		RunKeys(env, tt.seq)
+		if got := Global.KillRing.Current(); got != tt.want {
+			t.Errorf("%s killed %q, want %q", tt.seq, got, tt.want)
+		}
+	}
+}
+
+func TestUndoTreeBuffer(t *testing.T) {
+	vs, env := StartHeadless(50, 12)
+	RunKeys(env, "abc C-_ xyz C-x u")
+	src := Global.Buffers[0]
+	if Global.CurrentB.getRenderName() != "*undo-tree*" {
+		t.Fatalf("in %s, not *undo-tree*", Global.CurrentB.getRenderName())
+	}
+	checkGolden(t, "undo-tree", vs.String())
+	RunKeys(env, "C-p RET")
+	if got := BufferString(src); got != "abc" {
+		t.Errorf("after jumping the buffer is %q", got)
+	}
+	RunKeys(env, "p b n")
+	if got := BufferString(src); got != "xyz" {
+		t.Errorf("after switching branch the buffer is %q", got)
+	}
+	RunKeys(env, "q")
+	if Global.CurrentB != src || len(Global.Windows) != 1 {
+		t.Error("q didn't go back to the buffer")
+	}
+}
+
+func TestComintOutputKeepsUndo(t *testing.T) {
+	_, env := StartHeadless(40, 8)
+	buf := Global.CurrentB
+	c := &comint{nil, buf, 0, 0, nil, 0}
+	c.output("$ ")
+	RunKeys(env, "ls SPC foo")
+	c.output("hello\n$ ")
+	if got := BufferString(buf); got != "$ hello\n$ ls foo" {
+		t.Fatalf("buffer is %q", got)
+	}
+	RunKeys(env, "C-_")
+	if got := BufferString(buf); got != "$ hello\n$ " {
+		t.Errorf("after undo the buffer is %q", got)
+	}
+}
+
+func TestDiredCopyAsksBeforeOverwriting(t *testing.T) {
+	dir := inTempDir(t)
+	ioutil.WriteFile("a", []byte("new\n"), 0644)
+	ioutil.WriteFile("b", []byte("old\n"), 0644)
+	_, env := StartHeadless(60, 10)
+	RunKeys(env, "C-x d "+dir+" RET")
+	buf := Global.CurrentB
+	for _, tt := range []struct{ answer, want string }{{"n", "old\n"}, {"y", "new\n"}} {
+		diredGoto(buf, "a", 0)
+		RunKeys(env, "C b RET "+tt.answer)
+		if got, _ := ioutil.ReadFile("b"); string(got) != tt.want {
+			t.Errorf("after answering %s, b has %q", tt.answer, got)
+		}
+	}
+}
+
+func TestSaveKeepsHardLinks(t *testing.T) {
+	inTempDir(t)
+	ioutil.WriteFile("file", []byte("old\n"), 0644)
+	if err := os.Link("file", "link"); err != nil {
+		t.Skip(err)
+	}
+	_, env := StartHeadless(40, 8)
+	RunKeys(env, "C-x C-f file RET new C-x C-s")
+	if got, _ := ioutil.ReadFile("link"); string(got) != "newold\n" {
+		t.Errorf("the other link has %q", got)
+	}
+}
+
+func TestLispInputComplete(t *testing.T) {
+	tests := []struct {
+		src  string
+		want bool
+	}{
+		{"(+ 1 2)", true},
+		{"(foo \"a)\"", false},
+		{"(list #\\( 1)", true},
+		{"(list #\\)", false},
+		{"(a ; b)\n", false},
+	}
+	for _, tt := range tests {
+		if got := lispInputComplete(tt.src); got != tt.want {
+			t.Errorf("lispInputComplete(%q) = %v", tt.src, got)
+		}
+	}
+}
+
+func TestReloadInitFileReportsErrors(t *testing.T) {
+	dir := inTempDir(t)
+	_, env := StartHeadless(60, 8)
+	defer func(fn string) { initFile = fn }(initFile)
+	initFile = filepath.Join(dir, "init.lisp")
+	RunKeys(env, "M-x reload-init-file RET")
+	if Global.Input == "Reloaded "+initFile {
+		t.Errorf("reloading a missing init file said %q", Global.Input)
+	}
+	ioutil.WriteFile(initFile, []byte("(+ 1 2)\n"), 0644)
+	RunKeys(env, "M-x reload-init-file RET")
+	if Global.Input != "Reloaded "+initFile {
+		t.Errorf("reloading said %q", Global.Input)
+	}
+}
+
+func TestSetFillColumnIsLocal(t *testing.T) {
+	_, env := StartHeadless(60, 8)
+	def := Global.Fillcolumn
+	RunKeys(env, "C-u 3 0 C-x f")
+	first := Global.CurrentB
+	if got := first.fillColumn(); got != 30 {
+		t.Errorf("fill column is %d after C-u 30 C-x f", got)
+	}
+	switchToBuffer(getSpecialBuffer("other"))
+	RunKeys(env, "C-x f 4 0 RET")
+	if got := Global.CurrentB.fillColumn(); got != 40 {
+		t.Errorf("fill column is %d after C-x f 40", got)
+	}
+	if Global.Fillcolumn != def || first.fillColumn() != 30 {
+		t.Error("C-x f changed other buffers' fill column")
+	}
+}
+
+// A save hook like gofmt on a file that's already formatted changes nothing;
+// point at the end of the buffer has to survive that.
+func TestFilterUnchangedAtEOF(t *testing.T) {
+	inTempDir(t)
+	ioutil.WriteFile("f.txt", []byte("one\ntwo\n"), 0644)
+	_, env := StartHeadless(40, 8)
+	RunKeys(env, "C-x C-f f.txt RET M->")
+	buf := Global.CurrentB
+	if buf.cy != buf.NumRows {
+		t.Fatalf("point is on line %d of %d", buf.cy, buf.NumRows)
+	}
+	replaceBufferWithShellCommand(buf, "cat", nil, env)
+	if got := BufferString(buf); got != "one\ntwo" {
+		t.Errorf("buffer is %q", got)
+	}
+}
+
+func TestDiffLines(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want []diffHunk
+	}{
+		{"a b c", "a b c", nil},
+		{"a b c", "a x c", []diffHunk{{1, 2, 1, 2}}},
+		{"a b c", "a c", []diffHunk{{1, 2, 1, 1}}},
+		{"a c", "a b c", []diffHunk{{1, 1, 1, 2}}},
+		{"a b c d", "x b c y", []diffHunk{{0, 1, 0, 1}, {3, 4, 3, 4}}},
+		{"", "a", []diffHunk{{0, 0, 0, 1}}},
+	}
+	for _, tt := range tests {
+		a, b := strings.Fields(tt.a), strings.Fields(tt.b)
+		got := diffLines(a, b)
+		if len(got) == 0 && len(tt.want) == 0 {
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("diffLines(%q, %q) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestBufReplaceText(t *testing.T) {
+	tests := []struct{ old, new string }{
+		{"one\ntwo\nthree", "one\n2\nthree"},
+		{"one\ntwo\nthree", "zero\none\nthree\nfour"},
+		{"same", "same"},
+		{"a\nb", ""},
+	}
+	for _, tt := range tests {
+		_, env := StartHeadless(40, 8)
+		buf := Global.CurrentB
+		buf.setLines(strings.Split(tt.old, "\n"))
+		bufReplaceText(tt.new)
+		if got := BufferString(buf); got != tt.new {
+			t.Errorf("replacing %q with %q gave %q", tt.old, tt.new, got)
+		}
+		if tt.old != tt.new {
+			RunKeys(env, "C-_")
+			if got := BufferString(buf); got != tt.old {
+				t.Errorf("undoing %q -> %q gave %q", tt.old, tt.new, got)
+			}
+		}
+	}
+
+	StartHeadless(40, 8)
+	buf := Global.CurrentB
+	buf.setLines([]string{"ro"})
+	buf.ReadOnly = true
+	bufReplaceText("changed")
+	if got := BufferString(buf); got != "ro" {
+		t.Errorf("read-only buffer became %q", got)
+	}
+}
+
+func TestGrepBufferIsReadOnly(t *testing.T) {
+	dir := inTempDir(t)
+	ioutil.WriteFile("a.txt", []byte("needle\n"), 0644)
+	_, env := StartHeadless(60, 10)
+	grepDirectory("needle", "", dir)
+	buf := findBufferByName("*grep*")
+	before := BufferString(buf)
+	switchToBuffer(buf)
+	RunKeys(env, "M-< xyz C-k")
+	if got := BufferString(buf); got != before {
+		t.Errorf("*grep* was edited to %q", got)
+	}
+}
+
+// Process output and timers mustn't run while a command is waiting for a
+// key, only once it's done.
+func TestEventsWaitForCommand(t *testing.T) {
+	_, env := StartHeadless(40, 8)
+	ran := false
+	DefineCommand(&CommandFunc{"test-wait-for-key", func(*glisp.Glisp) {
+		runOnMainLoop(func() { ran = true })
+		editorGetKey()
+		if ran {
+			t.Error("event ran in the middle of a command")
+		}
+	}, false})
+	RunKeys(env, "M-x test-wait-for-key RET x")
+	if !ran {
+		t.Error("event never ran")
+	}
+}
+
+func TestAddErrorRegexpGroups(t *testing.T) {
+	defer func(old []*errorRegexp) { errorRegexps = old }(errorRegexps)
+	re := glisp.SexpStr(`^(\S+) line (\d+)(?: col (\d+))?`)
+	tests := []struct {
+		groups []glisp.SexpInt
+		ok     bool
+	}{
+		{[]glisp.SexpInt{1, 2, 3}, true},
+		{[]glisp.SexpInt{1, 2, 0}, true},
+		{[]glisp.SexpInt{1, 2}, true},
+		{[]glisp.SexpInt{0, 2}, false},
+		{[]glisp.SexpInt{1, 0}, false},
+		{[]glisp.SexpInt{1, 4}, false},
+	}
+	for _, tt := range tests {
+		args := []glisp.Sexp{re}
+		for _, g := range tt.groups {
+			args = append(args, g)
+		}
+		_, err := lispAddErrorRegexp(nil, "adderrorregexp", args)
+		if (err == nil) != tt.ok {
+			t.Errorf("groups %v: error %v", tt.groups, err)
+		}
+	}
+}
+
+func TestCompilationBufferIsReadOnly(t *testing.T) {
+	dir := inTempDir(t)
+	_, env := StartHeadless(60, 10)
+	compile("true", dir)
+	buf := compilationBuffer()
+	if !buf.ReadOnly || buf.MajorMode != "compilation" {
+		t.Errorf("*compilation* is in %s, read-only %v", buf.MajorMode, buf.ReadOnly)
+	}
+	before := BufferString(buf)
+	switchToBuffer(buf)
+	RunKeys(env, "M-< xyz")
+	if got := BufferString(buf); got != before {
+		t.Errorf("*compilation* was edited to %q", got)
+	}
+}
+
+func TestDiredIsEditable(t *testing.T) {
+	dir := inTempDir(t)
+	ioutil.WriteFile("a", nil, 0644)
+	_, env := StartHeadless(60, 10)
+	RunKeys(env, "C-x d "+dir+" RET")
+	buf := Global.CurrentB
+	rows := buf.NumRows
+	RunKeys(env, "M-< C-k C-k")
+	if buf.NumRows != rows-1 {
+		t.Errorf("killing a line of *dired* left %d of %d lines", buf.NumRows, rows)
+	}
+	RunKeys(env, "g")
+	if buf.NumRows != rows {
+		t.Errorf("g gave %d lines, want %d", buf.NumRows, rows)
+	}
+}
+
+func TestAutoRevertPollsOnlyWhenOn(t *testing.T) {
+	inTempDir(t)
+	ioutil.WriteFile("log", []byte("one\n"), 0644)
+	_, env := StartHeadless(60, 10)
+	RunKeys(env, "C-x C-f log RET")
+	if autoRevertStop != nil {
+		t.Fatal("polling with no buffer in auto-revert-mode")
+	}
+	RunKeys(env, "M-x auto-revert-mode RET")
+	if autoRevertStop == nil {
+		t.Fatal("not polling after turning on auto-revert-mode")
+	}
+	buf := Global.CurrentB
+	os.Chtimes("log", time.Now(), time.Now().Add(time.Hour))
+	ioutil.WriteFile("log", []byte("one\ntwo\n"), 0644)
+	commandRunning = true
+	autoRevertBuffers()
+	commandRunning = false
+	if got := BufferString(buf); got != "one" {
+		t.Errorf("reverted to %q while a command was running", got)
+	}
+	autoRevertBuffers()
+	if got := BufferString(buf); got != "one\ntwo" {
+		t.Errorf("auto-revert gave %q", got)
+	}
+	RunKeys(env, "M-x auto-revert-mode RET")
+	if autoRevertStop != nil {
+		t.Error("still polling after turning auto-revert-mode off")
+	}
+}
+
+func TestCodingRoundTrip(t *testing.T) {
+	tests := []struct {
+		data  string
+		lines []string
+		want  string
+	}{
+		{"a\nb\n", []string{"a", "b"}, "utf-8-unix"},
+		{"a\r\nb\r\n", []string{"a", "b"}, "utf-8-dos"},
+		{"a\rb\r", []string{"a", "b"}, "utf-8-mac"},
+		{"\xEF\xBB\xBFa\nb\n", []string{"a", "b"}, "utf-8-with-signature-unix"},
+		{"caf\xE9\n", []string{"café"}, "latin-1-unix"},
+		{"\xFF\xFEa\x00\r\x00\n\x00\xE9\x00\r\x00\n\x00", []string{"a", "é"}, "utf-16le-with-signature-dos"},
+		{"\xFE\xFF\x00a\x00\n\xD8\x3D\xDE\x00\x00\n", []string{"a", "😀"}, "utf-16be-with-signature-unix"},
+	}
+	for _, tt := range tests {
+		lines, c := decodeLines([]byte(tt.data))
+		if !reflect.DeepEqual(lines, tt.lines) || c.String() != tt.want {
+			t.Errorf("decodeLines(%q) = %q, %s; want %q, %s", tt.data, lines, c, tt.lines, tt.want)
+			continue
+		}
+		out, err := encodeLines(lines, c)
+		if err != nil || string(out) != tt.data {
+			t.Errorf("encodeLines(%q, %s) = %q, %v; want %q", lines, c, out, err, tt.data)
+		}
+	}
+
+	// Mixed line endings are left in the lines rather than lost.
+	lines, c := decodeLines([]byte("a\r\nb\nc\r\n"))
+	if c.eol != "unix" || !reflect.DeepEqual(lines, []string{"a\r", "b", "c\r"}) {
+		t.Errorf("mixed endings decoded as %q, %s", lines, c)
+	}
+	if _, err := encodeLines([]string{"€"}, codingSystem{"latin-1", false, "unix"}); err == nil {
+		t.Error("encoded € as latin-1")
+	}
+}
+
+func TestSaveKeepsCoding(t *testing.T) {
+	inTempDir(t)
+	ioutil.WriteFile("dos", []byte("\xEF\xBB\xBFone\r\ntwo\r\n"), 0644)
+	_, env := StartHeadless(60, 10)
+	RunKeys(env, `C-x C-f dos RET C-e "!" C-x C-s`)
+	got, _ := ioutil.ReadFile("dos")
+	if want := "\xEF\xBB\xBFone!\r\ntwo\r\n"; string(got) != want {
+		t.Errorf("saved %q, want %q", got, want)
+	}
+}
+
+func TestLargeFileGoto(t *testing.T) {
+	inTempDir(t)
+	var text strings.Builder
+	for i := 0; i < 5000; i++ {
+		fmt.Fprintf(&text, "line %d\n", i)
+	}
+	text.WriteString("last")
+	ioutil.WriteFile("big", []byte(text.String()), 0644)
+	defer func(old int64) { largeFileThreshold = old }(largeFileThreshold)
+	largeFileThreshold = 1000
+
+	lf, err := indexLargeFile("big")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lf.lines != 5001 || len(lf.index) != 5 {
+		t.Fatalf("indexed %d lines with %d offsets, want 5001 and 5", lf.lines, len(lf.index))
+	}
+	if lines, _ := lf.readLines(3071, 3); !reflect.DeepEqual(lines, []string{"line 3071", "line 3072", "line 3073"}) {
+		t.Errorf("lines from 3071 are %q", lines)
+	}
+
+	_, env := StartHeadless(60, 10)
+	RunKeys(env, "C-x C-f big RET y")
+	buf := Global.CurrentB
+	if buf.large == nil || !buf.ReadOnly || buf.NumRows != largeFilePageLines {
+		t.Fatalf("big opened with large=%v read-only=%v and %d rows", buf.large != nil, buf.ReadOnly, buf.NumRows)
+	}
+	tests := []struct {
+		line, cx int
+		want     string
+		wantcx   int
+	}{
+		{4000, 3, "line 4000", 3},
+		{5000, 10, "last", 4},
+		{10, 100, "line 10", 7},
+		{-5, 0, "line 0", 0},
+	}
+	for _, tt := range tests {
+		if err := largeFileGoto(buf, tt.line, tt.cx); err != nil {
+			t.Fatal(err)
+		}
+		line := buf.lineOffset() + buf.cy
+		if got := buf.row(buf.cy).Data; got != tt.want || buf.cx != tt.wantcx {
+			t.Errorf("going to %d,%d got %q at line %d column %d, want %q column %d",
+				tt.line, tt.cx, got, line, buf.cx, tt.want, tt.wantcx)
+		}
+	}
+	RunKeys(env, "M->")
+	if got := buf.lineOffset() + buf.cy; got != 5001 {
+		t.Errorf("M-> went to line %d, want 5001", got)
+	}
+}
+
+func TestBufferOffsets(t *testing.T) {
+	StartHeadless(40, 8)
+	buf := Global.CurrentB
+	buf.setLines([]string{"héllo", "", "xy"})
+	tests := []struct{ cx, cy, offset int }{
+		{0, 0, 0},
+		{3, 0, 3},
+		{6, 0, 6},
+		{0, 1, 7},
+		{0, 2, 8},
+		{2, 2, 10},
+	}
+	for _, tt := range tests {
+		if got := buf.posToOffset(tt.cx, tt.cy); got != tt.offset {
+			t.Errorf("posToOffset(%d, %d) = %d, want %d", tt.cx, tt.cy, got, tt.offset)
+		}
+		if cx, cy := buf.offsetToPos(tt.offset); cx != tt.cx || cy != tt.cy {
+			t.Errorf("offsetToPos(%d) = %d, %d, want %d, %d", tt.offset, cx, cy, tt.cx, tt.cy)
+		}
+	}
+	// Off the ends, and in the middle of é.
+	for offset, want := range map[int][2]int{-3: {0, 0}, 2: {1, 0}, 99: {2, 2}} {
+		if cx, cy := buf.offsetToPos(offset); cx != want[0] || cy != want[1] {
+			t.Errorf("offsetToPos(%d) = %d, %d, want %d, %d", offset, cx, cy, want[0], want[1])
+		}
+	}
+}
+
+func TestLispEditsUndo(t *testing.T) {
+	_, env := StartHeadless(40, 8)
+	buf := Global.CurrentB
+	buf.setLines([]string{"one two", "three"})
+	str := func(s string) glisp.Sexp { return glisp.SexpStr(s) }
+	num := func(i int) glisp.Sexp { return glisp.SexpInt(i) }
+	tests := []struct {
+		goTo int
+		fn   glisp.GlispUserFunction
+		args []glisp.Sexp
+		want string
+		ret  glisp.Sexp
+	}{
+		{3, lispInsert, []glisp.Sexp{str("!"), str("\nnew")}, "one!\nnew two\nthree", glisp.SexpNull},
+		{0, lispDeleteRegion, []glisp.Sexp{num(12), num(4)}, "one!\nthree", str("\nnew two")},
+		{0, lispInsert, []glisp.Sexp{str("x")}, "xone!\nthree", glisp.SexpNull},
+	}
+	for _, tt := range tests {
+		before := BufferString(buf)
+		lispGotoChar(env, "goto-char", []glisp.Sexp{num(tt.goTo)})
+		ret, err := tt.fn(env, "", tt.args)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := BufferString(buf); got != tt.want || ret != tt.ret {
+			t.Errorf("%v gave %q and returned %v, want %q and %v", tt.args, got, ret, tt.want, tt.ret)
+		}
+		RunKeys(env, "C-_")
+		if got := BufferString(buf); got != before {
+			t.Errorf("undoing %v gave %q, want %q", tt.args, got, before)
+		}
+		lispGotoChar(env, "goto-char", []glisp.Sexp{num(tt.goTo)})
+		tt.fn(env, "", tt.args)
+	}
+
+	buf.ReadOnly = true
+	lispDeleteRegion(env, "delete-region", []glisp.Sexp{num(0), num(5)})
+	if got := BufferString(buf); got != "xone!\nthree" {
+		t.Errorf("delete-region in a read-only buffer gave %q", got)
+	}
+}
+
+func TestSplitLispForms(t *testing.T) {
+	tests := []struct {
+		src  string
+		want []string
+	}{
+		{"(a) (b)", []string{"(a)", "(b)"}},
+		{"(a\n  (b))\n\n(c)", []string{"(a\n  (b))", "(c)"}},
+		{"; (not this)\n(a) ; nor this\n", []string{"(a)"}},
+		{`(a ")(") (b #\) #\()`, []string{`(a ")(")`, `(b #\) #\()`}},
+		{`(a "\"(") b`, []string{`(a "\"(")`, "b"}},
+		{"1 'sym \"str\"", []string{"1", "'sym", `"str"`}},
+		{"(a) (b", []string{"(a)", "(b"}},
+		{"[1 2] {3}", []string{"[1 2]", "{3}"}},
+		{"", []string{}},
+	}
+	for _, tt := range tests {
+		if got := splitLispForms(tt.src); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("splitLispForms(%q) = %q, want %q", tt.src, got, tt.want)
+		}
+	}
+}
+
+func TestScratchContinuesUnfinishedInput(t *testing.T) {
+	_, env := StartHeadless(60, 10)
+	RunKeys(env, `M-x scratch-buffer RET "(list \"a)\"" RET`)
+	buf := Global.CurrentB
+	lines := buf.lines()
+	if len(lines) != 4 || lines[2] != `> (list "a)"` || lines[3] != "" {
+		t.Fatalf("RET on unfinished input gave %q", lines)
+	}
+	RunKeys(env, `"#\\( 1)" RET`)
+	lines = buf.lines()
+	if lines[3] != `#\( 1)` || lines[len(lines)-1] != scratchPrompt {
+		t.Errorf("RET on finished input gave %q", lines)
+	}
+}
+
+// Makes a package called name in dir/packages, disabled so that it can be
+// enabled.
+func writeTestPackage(t *testing.T, dir, name, manifest string, files map[string]string) {
+	t.Helper()
+	pkg := filepath.Join(dir, "packages", name)
+	if err := os.MkdirAll(pkg, 0755); err != nil {
+		t.Fatal(err)
+	}
+	files[packageManifest] = manifest
+	files[packageDisabled] = ""
+	for fn, text := range files {
+		if err := ioutil.WriteFile(filepath.Join(pkg, fn), []byte(text), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestEnablePackageLoadsIt(t *testing.T) {
+	dir := inTempDir(t)
+	defer func(old string, path []string) {
+		packageDirectory, loadPath, features = old, path, map[string]bool{}
+	}(packageDirectory, loadPath)
+	packageDirectory = filepath.Join(dir, "packages")
+	writeTestPackage(t, dir, "good", "name: good\n", map[string]string{"good.lisp": "(def good-loaded 1)\n"})
+	writeTestPackage(t, dir, "broken", "name: broken\nmain: missing.lisp\n", map[string]string{})
+
+	_, env := StartHeadless(60, 10)
+	RunKeys(env, "M-x enable-package RET good RET")
+	if Global.Input != "Enabled and loaded good" || len(pendingLoads) != 0 {
+		t.Errorf("enabling good said %q with %d loads left", Global.Input, len(pendingLoads))
+	}
+	RunKeys(env, "M-x enable-package RET broken RET")
+	if !strings.HasPrefix(Global.Input, "Enabled broken, but it failed to load: ") {
+		t.Errorf("enabling broken said %q", Global.Input)
+	}
+}
+
+func TestPackageMainStaysInside(t *testing.T) {
+	dir := inTempDir(t)
+	tests := []struct {
+		main string
+		ok   bool
+	}{
+		{"good.lisp", true},
+		{"lisp/good.lisp", true},
+		{"lisp/../good.lisp", true},
+		{"../evil.lisp", false},
+		{"lisp/../../evil.lisp", false},
+		{"..", false},
+		{"/etc/evil.lisp", false},
+	}
+	for i, tt := range tests {
+		name := fmt.Sprint("pkg", i)
+		writeTestPackage(t, dir, name, "main: "+tt.main+"\n", map[string]string{})
+		_, err := readPackage(filepath.Join(dir, "packages", name))
+		if (err == nil) != tt.ok {
+			t.Errorf("readPackage with main %s gave %v", tt.main, err)
+		}
+	}
+}
+
+func TestUntarStaysInside(t *testing.T) {
+	dir := inTempDir(t)
+	tests := []struct {
+		name string
+		ok   bool
+	}{
+		{"pkg/manifest", true},
+		{"./pkg/../manifest", true},
+		{"../evil", false},
+		{"pkg/../../evil", false},
+		{"..", false},
+		{"/evil", false},
+	}
+	for i, tt := range tests {
+		fn := filepath.Join(dir, fmt.Sprint(i, ".tar"))
+		f, err := os.Create(fn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tw := tar.NewWriter(f)
+		tw.WriteHeader(&tar.Header{Name: tt.name, Mode: 0644, Size: 2, Typeflag: tar.TypeReg})
+		tw.Write([]byte("hi"))
+		tw.Close()
+		f.Close()
+		out := filepath.Join(dir, fmt.Sprint(i), "out")
+		err = untar(fn, out)
+		if (err == nil) != tt.ok {
+			t.Errorf("untar of %s gave %v", tt.name, err)
+		}
+		if _, err := os.Stat(filepath.Join(out, "..", "evil")); err == nil {
+			t.Errorf("untar of %s wrote outside the directory", tt.name)
+		}
+	}
+	if _, err := os.Stat("/evil"); err == nil {
+		t.Error("untar wrote /evil")
+	}
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"sort"
+
 	"github.com/zhemao/glisp/interpreter"
 )
 
@@ -37,6 +39,31 @@ func (e *EditorBuffer) setMode(mode string, enabled bool) {
 	e.Modes[mode] = enabled
 }
 
+// The bindings of the buffer's minor modes that have any (bindkeymode works
+// for minor modes too), in order of name.
+func (e *EditorBuffer) minorModeBindings() []*CommandList {
+	modes := e.getEnabledModes()
+	sort.Strings(modes)
+	ret := []*CommandList{}
+	for _, mode := range modes {
+		if l := Global.MajorBindings[mode]; l != nil {
+			ret = append(ret, l)
+		}
+	}
+	return ret
+}
+
+// Reports whether one of the buffer's minor modes binds key by itself, in
+// which case typing it runs that rather than inserting it.
+func minorModeBinds(buf *EditorBuffer, key string) bool {
+	for _, l := range buf.minorModeBindings() {
+		if l.Children[key] != nil {
+			return true
+		}
+	}
+	return false
+}
+
 func doToggleMode(mode string) {
 	enabled := Global.CurrentB.toggleMode(mode)
 	if enabled {
@@ -48,7 +75,7 @@ func doToggleMode(mode string) {
 
 func (e *EditorBuffer) getEnabledModes() []string {
 	enmodes := []string{}
-	for mode, enabled := range Global.CurrentB.Modes {
+	for mode, enabled := range e.Modes {
 		if enabled {
 			enmodes = append(enmodes, mode)
 		}
@@ -2,8 +2,6 @@ package main
 
 import (
 	"os/exec"
-
-	"github.com/nsf/termbox-go"
 )
 
 const (
@@ -21,7 +19,7 @@ func (row *EditorRow) screenXtoCx(sx int) int {
 }
 
 func screenYtoBufAndCy(sy int) (*EditorBuffer, int) {
-	_, ssy := termbox.Size()
+	_, ssy := screen.Size()
 	bufheight := ssy / len(Global.Windows)
 	buf := Global.Windows[sy/bufheight]
 	return buf, buf.rowoff + sy%bufheight
@@ -35,7 +33,7 @@ func JumpToMousePoint() {
 		Global.CurrentB.cx = 0
 	} else {
 		Global.CurrentB.cy = cy
-		Global.CurrentB.cx = Global.CurrentB.Rows[cy].screenXtoCx(Global.MouseX)
+		Global.CurrentB.cx = Global.CurrentB.row(cy).screenXtoCx(Global.MouseX)
 		Global.CurrentB.prefcx = Global.CurrentB.cx
 	}
 }
@@ -100,7 +98,7 @@ func MouseYankXsel() {
 		AddErrorMessage(Global.Input)
 		return
 	}
-	Global.Clipboard = out
+	Global.KillRing.Push(out)
 	if Global.CurrentB.hasMode("xsel-jump-to-cursor-mode") {
 		JumpToMousePoint()
 	}
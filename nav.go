@@ -11,7 +11,7 @@ import (
 func editorScroll(sx, sy int) {
 	Global.CurrentB.rx = 0
 	if Global.CurrentB.cy < Global.CurrentB.NumRows {
-		Global.CurrentB.rx = editorRowCxToRx(Global.CurrentB.Rows[Global.CurrentB.cy])
+		Global.CurrentB.rx = editorRowCxToRx(Global.CurrentB.row(Global.CurrentB.cy))
 	}
 
 	if Global.CurrentB.cy < Global.CurrentB.rowoff {
@@ -36,7 +36,7 @@ func editorCentreView() {
 }
 
 func (buf *EditorBuffer) UpdateRowToPrefCX() {
-	row := buf.Rows[buf.cy]
+	row := buf.row(buf.cy)
 	if buf.prefcx == -1 || buf.prefcx > row.Size {
 		buf.cx = row.Size
 	} else {
@@ -79,10 +79,10 @@ func (buf *EditorBuffer) MoveCursorLeft() {
 		} else if buf.cx == 0 {
 			buf.cy--
 			buf.prefcx = -1
-			buf.cx = buf.Rows[buf.cy].Size
+			buf.cx = buf.row(buf.cy).Size
 		} else {
 			_, rs :=
-				utf8.DecodeLastRuneInString(buf.Rows[buf.cy].Data[:buf.cx])
+				utf8.DecodeLastRuneInString(buf.row(buf.cy).Data[:buf.cx])
 			buf.cx -= rs
 			buf.prefcx = buf.cx
 		}
@@ -94,12 +94,12 @@ func (buf *EditorBuffer) MoveCursorRight() {
 	for i := 0; i < times; i++ {
 		if buf.cy >= buf.NumRows {
 			Global.Input = "End of buffer"
-		} else if buf.cx == buf.Rows[buf.cy].Size {
+		} else if buf.cx == buf.row(buf.cy).Size {
 			buf.cy++
 			buf.prefcx = 0
 			buf.cx = 0
 		} else {
-			_, rs := utf8.DecodeRuneInString(buf.Rows[buf.cy].Data[buf.cx:])
+			_, rs := utf8.DecodeRuneInString(buf.row(buf.cy).Data[buf.cx:])
 			buf.cx += rs
 			buf.prefcx = buf.cx
 		}
@@ -109,7 +109,7 @@ func (buf *EditorBuffer) MoveCursorRight() {
 func MoveCursorToEol() {
 	Global.CurrentB.prefcx = -1
 	if Global.CurrentB.cy < Global.CurrentB.NumRows {
-		Global.CurrentB.cx = Global.CurrentB.Rows[Global.CurrentB.cy].Size
+		Global.CurrentB.cx = Global.CurrentB.row(Global.CurrentB.cy).Size
 	}
 }
 
@@ -176,67 +176,244 @@ func MoveCursorForthPage() {
 	}
 }
 
-// HACK: Go does not have static variables, so these have to go in global state.
-var last_match int = -1
-var direction int = 1
-
-func editorFindCallback(query string, key string) {
-	Global.Input = query
-	if key == "C-s" {
-		direction = 1
-	} else if key == "C-r" {
-		direction = -1
-		//If we cancelled or finished...
-	} else if key == "C-c" || key == "C-g" || key == "RET" {
-		if key == "C-c" || key == "C-g" {
-			Global.Input = "Cancelled search."
-		}
-		//...outta here!
-		last_match = -1
-		direction = 1
-		Global.CurrentB.regionActive = false
+// The state of the incremental search in progress. While it is non-nil the
+// renderer highlights every visible match of its pattern.
+type isearchState struct {
+	regex      bool
+	backward   bool
+	wrapped    bool
+	failing    bool
+	pattern    *regexp.Regexp
+	query      string
+	mx, my     int // Start of the current match
+	mend       int // End of the current match (on line my)
+	origx      int // Where the search started
+	origy      int
+	histpos    int
+	incomplete bool
+	matched    bool // mx, my and mend hold a match
+}
+
+var isearch *isearchState
+var isearchHistory []string
+
+func (s *isearchState) promptName() string {
+	ret := "I-search"
+	if s.regex {
+		ret = "Regexp " + ret
+	}
+	if s.wrapped {
+		ret = "Wrapped " + ret
+	}
+	if s.failing {
+		ret = "Failing " + ret
+	}
+	if s.backward {
+		ret += " backward"
+	}
+	if s.incomplete {
+		ret += " [incomplete input]"
+	}
+	return ret
+}
+
+// Compiles the query. The search ignores case unless the query has an upper
+// case letter in it.
+func (s *isearchState) compile(query string) {
+	s.query = query
+	s.pattern = nil
+	s.incomplete = false
+	if query == "" {
+		return
+	}
+	pat := query
+	if !s.regex {
+		pat = regexp.QuoteMeta(query)
+	}
+	if strings.ToLower(query) == query {
+		pat = "(?i)" + pat
+	}
+	re, err := regexp.Compile(pat)
+	if err != nil {
+		s.incomplete = true
 		return
-	} else {
-		last_match = -1
-		direction = 1
 	}
+	s.pattern = re
+}
 
-	if last_match == -1 {
-		direction = 1
+// Finds the first match starting at or after cx on line cy, going round the
+// end of the buffer if need be.
+func (s *isearchState) searchForward(cx, cy int) bool {
+	buf := Global.CurrentB
+	for i := 0; i <= buf.NumRows; i++ {
+		y := (cy + i) % buf.NumRows
+		for _, m := range s.pattern.FindAllStringIndex(buf.row(y).Data, -1) {
+			if (i == 0 && m[0] < cx) || (i == buf.NumRows && m[0] >= cx) {
+				continue
+			}
+			s.wrapped = s.wrapped || cy+i >= buf.NumRows
+			s.mx, s.my, s.mend = m[0], y, m[1]
+			return true
+		}
 	}
-	current := last_match
-	ql := len(query)
-	for range Global.CurrentB.Rows {
-		current += direction
-		if current == -1 {
-			current = Global.CurrentB.NumRows - 1
-		} else if current == Global.CurrentB.NumRows {
-			current = 0
+	return false
+}
+
+// Finds the last match starting before cx on line cy, going round the start
+// of the buffer if need be.
+func (s *isearchState) searchBackward(cx, cy int) bool {
+	buf := Global.CurrentB
+	for i := 0; i <= buf.NumRows; i++ {
+		y := (cy - i + buf.NumRows) % buf.NumRows
+		var found []int
+		for _, m := range s.pattern.FindAllStringIndex(buf.row(y).Data, -1) {
+			if (i == 0 && m[0] >= cx) || (i == buf.NumRows && m[0] < cx) {
+				continue
+			}
+			found = m
 		}
-		row := Global.CurrentB.Rows[current]
-		match := strings.Index(row.Render, query)
-		if match > -1 {
-			last_match = current
-			Global.CurrentB.cy = current
-			Global.CurrentB.cx = editorRowRxToCx(row, match)
-			Global.CurrentB.prefcx = Global.CurrentB.cx
-			Global.CurrentB.rowoff = Global.CurrentB.NumRows
-			Global.CurrentB.MarkX = Global.CurrentB.cx + ql
-			Global.CurrentB.MarkY = Global.CurrentB.cy
-			Global.CurrentB.regionActive = true
-			Global.CurrentB.recalcRegion()
-			break
+		if found != nil {
+			s.wrapped = s.wrapped || cy-i < 0
+			s.mx, s.my, s.mend = found[0], y, found[1]
+			return true
 		}
 	}
+	return false
 }
 
-func editorFind() {
+// Puts point at the start of the current match and selects it.
+func (s *isearchState) showMatch() {
+	buf := Global.CurrentB
+	buf.cy = s.my
+	buf.cx = s.mx
+	buf.prefcx = buf.cx
+	buf.rowoff = buf.NumRows
+	buf.MarkX = s.mend
+	buf.MarkY = s.my
+	buf.regionActive = true
+	buf.recalcRegion()
+	s.matched = true
+}
+
+// Returns the matches on row as start and end rune offsets into row.Render.
+func (s *isearchState) renderMatches(row *EditorRow) [][]int {
+	if s.pattern == nil {
+		return nil
+	}
+	ret := s.pattern.FindAllStringIndex(row.Data, -1)
+	// The matches are in order, so convert the offsets in one pass rather
+	// than counting from the start of the line for each; lines can be long.
+	b, ri := 0, 0
+	for _, m := range ret {
+		for j := range m {
+			ri += row.dataToRenderIndexFrom(b, m[j])
+			b = m[j]
+			m[j] = ri
+		}
+	}
+	return ret
+}
+
+func isearchCallback(query string, key string) string {
+	s := isearch
+	buf := Global.CurrentB
+	switch key {
+	case "C-c", "C-g":
+		buf.regionActive = false
+		return query
+	case "RET":
+		if query != "" && (len(isearchHistory) == 0 || isearchHistory[len(isearchHistory)-1] != query) {
+			isearchHistory = append(isearchHistory, query)
+		}
+		buf.regionActive = false
+		return query
+	case "M-p", "M-n":
+		if key == "M-p" && s.histpos < len(isearchHistory) {
+			s.histpos++
+		} else if key == "M-n" && s.histpos > 0 {
+			s.histpos--
+		}
+		if s.histpos > 0 {
+			query = isearchHistory[len(isearchHistory)-s.histpos]
+		} else {
+			query = ""
+		}
+	case "M-r":
+		s.regex = !s.regex
+	case "C-s", "C-r", "C-M-s", "C-M-r":
+		backward := key == "C-r" || key == "C-M-r"
+		if query == "" && len(isearchHistory) > 0 {
+			// Searching again with nothing typed repeats the last search.
+			query = isearchHistory[len(isearchHistory)-1]
+		} else if s.pattern != nil && !s.failing && backward == s.backward {
+			// Move on to the next match.
+			if backward {
+				s.failing = !s.searchBackward(s.mx, s.my)
+			} else if s.mend > s.mx {
+				s.failing = !s.searchForward(s.mend, s.my)
+			} else {
+				s.failing = !s.searchForward(s.mend+1, s.my)
+			}
+			if !s.failing {
+				s.showMatch()
+			}
+			editorSetPrompt(s.promptName())
+			return query
+		}
+		s.backward = backward
+	}
+
+	if query != s.query || key == "M-r" || s.pattern == nil {
+		// The query has changed, so look again from where we are.
+		s.compile(query)
+	}
+	if s.pattern == nil {
+		s.failing = false
+		if query == "" {
+			buf.cx, buf.cy = s.origx, s.origy
+			buf.prefcx = buf.cx
+			buf.regionActive = false
+			s.matched = false
+		}
+		editorSetPrompt(s.promptName())
+		return query
+	}
+	cx, cy := s.origx, s.origy
+	if s.matched {
+		cx, cy = s.mx, s.my
+	}
+	if s.backward {
+		if s.matched {
+			cx++
+		}
+		s.failing = !s.searchBackward(cx, cy)
+	} else {
+		s.failing = !s.searchForward(cx, cy)
+	}
+	if !s.failing {
+		s.showMatch()
+	}
+	editorSetPrompt(s.promptName())
+	return query
+}
+
+func editorFind(regex, backward bool) {
 	saved_cx := Global.CurrentB.cx
 	saved_cy := Global.CurrentB.cy
 	saved_co := Global.CurrentB.coloff
 	saved_ro := Global.CurrentB.rowoff
 
-	query := editorPrompt("Search", editorFindCallback)
+	if Global.CurrentB.NumRows == 0 {
+		Global.Input = "Buffer is empty"
+		return
+	}
+	isearch = &isearchState{}
+	isearch.regex = regex
+	isearch.backward = backward
+	isearch.origx, isearch.origy = saved_cx, saved_cy
+	defer func() { isearch = nil }()
+
+	query := promptLine(isearch.promptName(), isearchCallback)
 
 	if query == "" {
 		//Search cancelled, go back to where we were
@@ -246,10 +423,21 @@ func editorFind() {
 		Global.CurrentB.cy = saved_cy
 		Global.CurrentB.coloff = saved_co
 		Global.CurrentB.rowoff = saved_ro
+		Global.Input = "Cancelled search."
+	} else if isearch.failing {
+		Global.Input = "Search failed: " + query
+	} else {
+		Global.Input = query
+		if isearch.wrapped {
+			Global.Input += " (Wrapped)"
+		}
 	}
 }
 
 func doQueryReplace() {
+	if !Global.CurrentB.checkWritable() {
+		return
+	}
 	orig := editorPrompt("Find", nil)
 	if orig == "" {
 		Global.Input = "Can't query-replace with an empty query"
@@ -260,7 +448,8 @@ func doQueryReplace() {
 	all := false
 	ql := len(orig)
 	rlen := len(replace)
-	for cy, row := range Global.CurrentB.Rows {
+	for cy := 0; cy < Global.CurrentB.NumRows; cy++ {
+		row := Global.CurrentB.row(cy)
 		match := strings.Index(row.Data, orig)
 		prestring := ""
 		matchstring := row.Data
@@ -307,6 +496,9 @@ func doQueryReplace() {
 }
 
 func doReplaceString() {
+	if !Global.CurrentB.checkWritable() {
+		return
+	}
 	orig := editorPrompt("Find", nil)
 	if orig == "" {
 		Global.Input = "Can't string-replace with an empty query"
@@ -317,7 +509,8 @@ func doReplaceString() {
 	lines := 0
 	ql := len(orig)
 	nl := len(replace)
-	for cy, row := range Global.CurrentB.Rows {
+	for cy := 0; cy < Global.CurrentB.NumRows; cy++ {
+		row := Global.CurrentB.row(cy)
 		match := strings.LastIndex(row.Render, orig)
 		if match != -1 {
 			count := strings.Count(row.Render, orig)
@@ -344,6 +537,9 @@ func doReplaceString() {
 }
 
 func doQueryReplaceRegexp() {
+	if !Global.CurrentB.checkWritable() {
+		return
+	}
 	orig := editorPrompt("Find regexp", nil)
 	if orig == "" {
 		Global.Input = "Can't query-replace-regexp with an empty query"
@@ -357,7 +553,8 @@ func doQueryReplaceRegexp() {
 	}
 	replace := editorPrompt("Replace "+orig+" with", nil)
 	all := false
-	for cy, row := range Global.CurrentB.Rows {
+	for cy := 0; cy < Global.CurrentB.NumRows; cy++ {
+		row := Global.CurrentB.row(cy)
 		match := pattern.FindStringIndex(row.Data)
 		prestring := ""
 		matchstring := row.Data
@@ -405,6 +602,9 @@ func doQueryReplaceRegexp() {
 }
 
 func doReplaceRegexp() {
+	if !Global.CurrentB.checkWritable() {
+		return
+	}
 	orig := editorPrompt("Find regexp", nil)
 	if orig == "" {
 		Global.Input = "Can't replace-regexp with an empty query"
@@ -418,7 +618,8 @@ func doReplaceRegexp() {
 	replace := editorPrompt("Replace "+orig+" with", nil)
 	matches := 0
 	lines := 0
-	for cy, row := range Global.CurrentB.Rows {
+	for cy := 0; cy < Global.CurrentB.NumRows; cy++ {
+		row := Global.CurrentB.row(cy)
 		match := pattern.MatchString(row.Data)
 		if match {
 			count := len(pattern.FindAllString(row.Data, -1))
@@ -469,7 +670,7 @@ func gotoChar() {
 	if Global.CurrentB.cy == Global.CurrentB.NumRows {
 		return
 	}
-	datalen := len(Global.CurrentB.Rows[Global.CurrentB.cy].Data)
+	datalen := len(Global.CurrentB.row(Global.CurrentB.cy).Data)
 	if line < 0 {
 		line = 0
 	} else if line >= datalen {
@@ -482,7 +683,8 @@ func gotoChar() {
 
 func getOffsetInBuffer(buf *EditorBuffer) (int, int) {
 	offset, total := 0, 0
-	for i, row := range buf.Rows {
+	for i := 0; i < buf.NumRows; i++ {
+		row := buf.row(i)
 		total += row.Size + 1
 		if i == buf.cy {
 			offset += buf.cx
@@ -504,7 +706,7 @@ func whatCursorPosition() {
 		Global.Input = "End of buffer"
 		return
 	}
-	row := Global.CurrentB.Rows[cy]
+	row := Global.CurrentB.row(cy)
 	var ru rune
 	if cx >= row.Size {
 		ru = '\n'
@@ -0,0 +1,413 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/mitchellh/go-homedir"
+	"github.com/zhemao/glisp/interpreter"
+)
+
+// Packages are Lisp extensions, each in its own directory under
+// packageDirectory with a manifest file describing it:
+//
+//	name: gofmt
+//	version: 1.0
+//	description: Run gofmt on Go buffers when they're saved
+//	main: gofmt.lisp
+//
+// main defaults to name.lisp. Packages are enabled unless their directory
+// has a file called disabled in it, and enabled ones are loaded at startup.
+var packageDirectory = "~/.gomacs.d/packages"
+
+// Set by -q, which skips the packages as well as the init file.
+var loadPackagesAtStartup = true
+
+const (
+	packageManifest = "manifest"
+	packageDisabled = "disabled"
+)
+
+type lispPackage struct {
+	name        string
+	version     string
+	description string
+	main        string
+	dir         string
+	enabled     bool
+}
+
+// Reads the manifest in dir.
+func readPackage(dir string) (*lispPackage, error) {
+	f, err := os.Open(filepath.Join(dir, packageManifest))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	pkg := &lispPackage{}
+	pkg.dir = dir
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+		i := strings.Index(line, ":")
+		if i < 0 {
+			return nil, fmt.Errorf("%s: bad line in manifest: %s", dir, line)
+		}
+		val := strings.TrimSpace(line[i+1:])
+		switch strings.TrimSpace(line[:i]) {
+		case "name":
+			pkg.name = val
+		case "version":
+			pkg.version = val
+		case "description":
+			pkg.description = val
+		case "main":
+			pkg.main = val
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	if pkg.name == "" {
+		pkg.name = filepath.Base(dir)
+	}
+	if strings.ContainsAny(pkg.name, "/\\") || pkg.name == "." || pkg.name == ".." {
+		return nil, errors.New("Bad package name: " + pkg.name)
+	}
+	if pkg.main == "" {
+		pkg.main = pkg.name + ".lisp"
+	}
+	// main has to be inside the package.
+	main := filepath.Clean(pkg.main)
+	if filepath.IsAbs(main) || main == ".." || strings.HasPrefix(main, ".."+string(filepath.Separator)) {
+		return nil, errors.New("Bad main file for package " + pkg.name + ": " + pkg.main)
+	}
+	_, err = os.Stat(filepath.Join(dir, packageDisabled))
+	pkg.enabled = os.IsNotExist(err)
+	return pkg, nil
+}
+
+func packageDir() (string, error) {
+	return homedir.Expand(packageDirectory)
+}
+
+// The installed packages, by name.
+func installedPackages() ([]*lispPackage, error) {
+	dir, err := packageDir()
+	if err != nil {
+		return nil, err
+	}
+	fis, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	ret := []*lispPackage{}
+	for _, fi := range fis {
+		if !fi.IsDir() {
+			continue
+		}
+		pkg, err := readPackage(filepath.Join(dir, fi.Name()))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			AddErrorMessage(err.Error())
+			continue
+		}
+		pkg.name = fi.Name()
+		ret = append(ret, pkg)
+	}
+	return ret, nil
+}
+
+// Queues pkg to be loaded. Its directory goes on the load path, so the
+// package can require its other files, and it's provided as a feature.
+func queuePackage(pkg *lispPackage) {
+	loadPath = append(loadPath, pkg.dir)
+	features[pkg.name] = true
+	pendingLoads = append(pendingLoads, pendingLoad{filepath.Join(pkg.dir, pkg.main), pkg.name})
+}
+
+// Queues pkg and loads it, along with anything else waiting to be loaded.
+func loadPackage(env *glisp.Glisp, pkg *lispPackage) error {
+	queuePackage(pkg)
+	return runPendingLoads(env)
+}
+
+// Loads the enabled packages. A package that fails to load is reported and
+// the rest are still loaded.
+func loadPackages(env *glisp.Glisp) {
+	pkgs, err := installedPackages()
+	if err != nil {
+		AddErrorMessage(err.Error())
+		return
+	}
+	for _, pkg := range pkgs {
+		if !pkg.enabled {
+			continue
+		}
+		if err := loadPackage(env, pkg); err != nil {
+			Global.Input = "Error loading package " + pkg.name + ": " + err.Error()
+			AddErrorMessage(Global.Input)
+		}
+	}
+}
+
+func listPackages() {
+	pkgs, err := installedPackages()
+	if err != nil {
+		Global.Input = err.Error()
+		return
+	}
+	dir, _ := packageDir()
+	if len(pkgs) == 0 {
+		showOutput("*Packages*", "No packages installed in "+dir,
+			"M-x install-package installs one from a directory or a tarball.")
+		return
+	}
+	lines := []string{fmt.Sprintf("%-20s %-10s %-9s %s", "Package", "Version", "Status", "Description")}
+	for _, pkg := range pkgs {
+		status := "enabled"
+		if !pkg.enabled {
+			status = "disabled"
+		}
+		lines = append(lines, fmt.Sprintf("%-20s %-10s %-9s %s", pkg.name, pkg.version, status, pkg.description))
+	}
+	showOutput("*Packages*", lines...)
+}
+
+// Prompts for the name of an installed package that is enabled (or
+// disabled, if enabled is false).
+func promptForPackage(prompt string, enabled bool) *lispPackage {
+	pkgs, err := installedPackages()
+	if err != nil {
+		Global.Input = err.Error()
+		return nil
+	}
+	names := []string{}
+	for _, pkg := range pkgs {
+		if pkg.enabled == enabled {
+			names = append(names, pkg.name)
+		}
+	}
+	if len(names) == 0 {
+		if enabled {
+			Global.Input = "No packages are enabled"
+		} else {
+			Global.Input = "No packages are disabled"
+		}
+		return nil
+	}
+	name := tabCompletedEditorPrompt(prompt, func(prefix string) []string {
+		ret := []string{}
+		for _, name := range names {
+			if strings.HasPrefix(name, prefix) {
+				ret = append(ret, name)
+			}
+		}
+		return ret
+	})
+	if name == "" {
+		Global.Input = "Cancelled."
+		return nil
+	}
+	for _, pkg := range pkgs {
+		if pkg.name == name {
+			return pkg
+		}
+	}
+	Global.Input = "No package called " + name
+	return nil
+}
+
+func enablePackage(env *glisp.Glisp) {
+	pkg := promptForPackage("Enable package", false)
+	if pkg == nil {
+		return
+	}
+	if err := os.Remove(filepath.Join(pkg.dir, packageDisabled)); err != nil {
+		Global.Input = err.Error()
+		return
+	}
+	if err := loadPackage(env, pkg); err != nil {
+		Global.Input = "Enabled " + pkg.name + ", but it failed to load: " + err.Error()
+		AddErrorMessage(Global.Input)
+		return
+	}
+	Global.Input = "Enabled and loaded " + pkg.name
+}
+
+func disablePackage() {
+	pkg := promptForPackage("Disable package", true)
+	if pkg == nil {
+		return
+	}
+	if err := ioutil.WriteFile(filepath.Join(pkg.dir, packageDisabled), nil, 0644); err != nil {
+		Global.Input = err.Error()
+		return
+	}
+	Global.Input = "Disabled " + pkg.name + "; it won't be loaded next time"
+}
+
+// Unpacks a tarball (which may be gzipped) into dir. Entries that would end
+// up outside dir are refused.
+func untar(fn, dir string) error {
+	f, err := os.Open(fn)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var r io.Reader = f
+	if strings.HasSuffix(fn, ".gz") || strings.HasSuffix(fn, ".tgz") {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		r = gz
+	}
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		name := filepath.Clean(filepath.FromSlash(hdr.Name))
+		if filepath.IsAbs(name) || name == ".." || strings.HasPrefix(name, ".."+string(filepath.Separator)) {
+			return errors.New("Refusing to unpack " + hdr.Name + " from " + fn)
+		}
+		dest := filepath.Join(dir, name)
+		mode := hdr.FileInfo().Mode()
+		switch {
+		case mode.IsDir():
+			err = os.MkdirAll(dest, 0755)
+		case mode.IsRegular():
+			if err = os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+				return err
+			}
+			var out *os.File
+			out, err = os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode.Perm())
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(out, tr)
+			if cerr := out.Close(); err == nil {
+				err = cerr
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Where the manifest is in an unpacked package: at the top, or in the only
+// directory there, as tarballs usually have.
+func packageRoot(dir string) (string, error) {
+	if _, err := os.Stat(filepath.Join(dir, packageManifest)); err == nil {
+		return dir, nil
+	}
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return "", err
+	}
+	if len(fis) == 1 && fis[0].IsDir() {
+		sub := filepath.Join(dir, fis[0].Name())
+		if _, err := os.Stat(filepath.Join(sub, packageManifest)); err == nil {
+			return sub, nil
+		}
+	}
+	return "", errors.New("No " + packageManifest + " file in the package")
+}
+
+// Installs the package in src, a directory or a tarball, replacing any
+// older version, and returns it.
+func installPackage(src string) (*lispPackage, error) {
+	fi, err := os.Stat(src)
+	if err != nil {
+		return nil, err
+	}
+	dir, err := packageDir()
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	tmp, err := ioutil.TempDir(dir, ".install-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmp)
+	unpacked := filepath.Join(tmp, "package")
+	if fi.IsDir() {
+		err = copyTree(src, unpacked)
+	} else {
+		err = untar(src, unpacked)
+	}
+	if err != nil {
+		return nil, err
+	}
+	root, err := packageRoot(unpacked)
+	if err != nil {
+		return nil, err
+	}
+	pkg, err := readPackage(root)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(filepath.Join(root, pkg.main)); err != nil {
+		return nil, err
+	}
+	dest := filepath.Join(dir, pkg.name)
+	if err := os.RemoveAll(dest); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(root, dest); err != nil {
+		return nil, err
+	}
+	os.Remove(filepath.Join(dest, packageDisabled))
+	return readPackage(dest)
+}
+
+func installPackageCmd(env *glisp.Glisp) {
+	src := tabCompletedEditorPrompt("Install package from directory or tarball", tabCompleteFilename)
+	if src == "" {
+		Global.Input = "Cancelled."
+		return
+	}
+	src, err := homedir.Expand(src)
+	if err != nil {
+		Global.Input = err.Error()
+		return
+	}
+	pkg, err := installPackage(src)
+	if err != nil {
+		Global.Input = "Can't install " + src + ": " + err.Error()
+		AddErrorMessage(Global.Input)
+		return
+	}
+	if err := loadPackage(env, pkg); err != nil {
+		Global.Input = "Installed " + pkg.name + ", but it failed to load: " + err.Error()
+		AddErrorMessage(Global.Input)
+		return
+	}
+	Global.Input = "Installed and loaded " + pkg.name + " " + pkg.version
+}
@@ -6,7 +6,7 @@ func indexPreviousBlankLine() int {
 		return 0
 	}
 	for i := Global.CurrentB.cy - 1; 0 < i; i-- {
-		if Global.CurrentB.Rows[i].Size == 0 {
+		if Global.CurrentB.row(i).Size == 0 {
 			return i
 		}
 	}
@@ -21,7 +21,7 @@ func indexNextBlankLine() int {
 		return Global.CurrentB.NumRows
 	}
 	for i := Global.CurrentB.cy + 1; i < Global.CurrentB.NumRows; i++ {
-		if Global.CurrentB.Rows[i].Size == 0 {
+		if Global.CurrentB.row(i).Size == 0 {
 			return i
 		}
 	}
@@ -52,6 +52,6 @@ func doFillParagraph() {
 	if Global.CurrentB.NumRows == 0 {
 		return
 	} else {
-		transposeRegion(Global.CurrentB, 0, Global.CurrentB.Rows[endl].Size, startl, endl, FillString)
+		transposeRegion(Global.CurrentB, 0, Global.CurrentB.row(endl).Size, startl, endl, FillString)
 	}
 }
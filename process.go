@@ -0,0 +1,474 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/zhemao/glisp/interpreter"
+)
+
+// Work handed to the main goroutine by the goroutines that wait on
+// processes. Nothing but the main goroutine may touch the editor state, so
+// they queue a function here and interrupt the wait for the next key.
+var pendingEvents = make(chan func(), 256)
+
+func runOnMainLoop(f func()) {
+	pendingEvents <- f
+	keysrc.Interrupt()
+}
+
+// Set while the command for a key is running. Prompts wait for keys too, and
+// events run then could change buffers underneath the command, so they're
+// held back until it has finished.
+var commandRunning bool
+
+// Runs everything queued by runOnMainLoop. Called whenever we've been woken
+// up while waiting for a key, and after each command.
+func runPendingEvents() bool {
+	if commandRunning {
+		return false
+	}
+	ran := false
+	for {
+		select {
+		case f := <-pendingEvents:
+			f()
+			ran = true
+		default:
+			return ran
+		}
+	}
+}
+
+// Process is a subprocess running in the background. Its output goes to
+// Filter, or to the end of Buffer if there's no filter; Sentinel is told
+// when it exits. Both are only ever called from the main goroutine.
+type Process struct {
+	Name     string
+	Buffer   *EditorBuffer
+	Filter   func(p *Process, output string)
+	Sentinel func(p *Process, event string)
+	Status   string // "run", "exit" or "signal"
+	ExitCode int
+	cmd      *exec.Cmd
+	stdin    io.WriteCloser
+	// Input waiting for writeInput to write it to stdin, in order. It's
+	// shared with writeInput's goroutine, so only touched with inputMu held.
+	inputMu    sync.Mutex
+	inputReady *sync.Cond // Signalled when there's input, or at EOF
+	queued     []string
+	eof        bool // No more input will be taken
+}
+
+var processes []*Process
+
+// Starts com with args in dir. Standard output and standard error are
+// merged, as they would be on a terminal.
+func startProcess(name string, buf *EditorBuffer, dir string, com string, args ...string) (*Process, error) {
+	return startProcessEnv(name, buf, dir, nil, com, args...)
+}
+
+// Like startProcess, but with extra environment variables ("NAME=value").
+func startProcessEnv(name string, buf *EditorBuffer, dir string, env []string, com string, args ...string) (*Process, error) {
+	cmd := exec.Command(com, args...)
+	cmd.Dir = dir
+	if env != nil {
+		cmd.Env = append(os.Environ(), env...)
+	}
+	setProcessGroup(cmd)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	cmd.Stdout = w
+	cmd.Stderr = w
+	err = cmd.Start()
+	w.Close()
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+	p := &Process{uniqueProcessName(name), buf, nil, nil, "run", 0, cmd, stdin,
+		sync.Mutex{}, nil, nil, false}
+	p.inputReady = sync.NewCond(&p.inputMu)
+	processes = append(processes, p)
+	go p.readOutput(r)
+	go p.writeInput()
+	return p, nil
+}
+
+func uniqueProcessName(name string) string {
+	ret := name
+	for i := 1; getProcess(ret) != nil; i++ {
+		ret = fmt.Sprintf("%s<%d>", name, i)
+	}
+	return ret
+}
+
+func getProcess(name string) *Process {
+	for _, p := range processes {
+		if p.Name == name {
+			return p
+		}
+	}
+	return nil
+}
+
+// Returns the running process whose output goes to buf, if any.
+func getBufferProcess(buf *EditorBuffer) *Process {
+	for _, p := range processes {
+		if p.Buffer == buf {
+			return p
+		}
+	}
+	return nil
+}
+
+func (p *Process) readOutput(r *os.File) {
+	defer r.Close()
+	chunk := make([]byte, 4096)
+	var partial []byte // The start of a character cut off by the last read
+	for {
+		n, err := r.Read(chunk)
+		if n > 0 {
+			data := append(partial, chunk[:n]...)
+			partial = nil
+			if err == nil {
+				cut := incompleteRuneStart(data)
+				partial = append([]byte{}, data[cut:]...)
+				data = data[:cut]
+			}
+			output := string(data)
+			if output != "" {
+				runOnMainLoop(func() { p.output(output) })
+			}
+		}
+		if err != nil {
+			break
+		}
+	}
+	if len(partial) > 0 {
+		output := string(partial)
+		runOnMainLoop(func() { p.output(output) })
+	}
+	err := p.cmd.Wait()
+	runOnMainLoop(func() { p.exited(err) })
+}
+
+// Returns where an incomplete UTF-8 character at the end of data starts, or
+// len(data) if there isn't one.
+func incompleteRuneStart(data []byte) int {
+	// A character is at most utf8.UTFMax bytes, so only the last few can
+	// belong to one that's been cut off.
+	for i := len(data) - 1; i >= 0 && i >= len(data)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(data[i]) {
+			if !utf8.FullRune(data[i:]) {
+				return i
+			}
+			break
+		}
+	}
+	return len(data)
+}
+
+func (p *Process) output(text string) {
+	if p.Filter != nil {
+		p.Filter(p, text)
+	} else if p.Buffer != nil && bufferExists(p.Buffer) {
+		p.Buffer.appendText(text)
+	}
+}
+
+func (p *Process) exited(err error) {
+	p.SendEOF()
+	for i, proc := range processes {
+		if proc == p {
+			processes = append(processes[:i], processes[i+1:]...)
+			break
+		}
+	}
+	event := "finished\n"
+	p.Status = "exit"
+	if exiterr, ok := err.(*exec.ExitError); ok {
+		if signal, num, ok := exitSignal(exiterr); ok {
+			p.Status = "signal"
+			p.ExitCode = num
+			event = signal + "\n"
+		} else {
+			p.ExitCode = exiterr.ExitCode()
+			event = fmt.Sprintf("exited abnormally with code %d\n", p.ExitCode)
+		}
+	} else if err != nil {
+		event = err.Error() + "\n"
+	}
+	if p.Sentinel != nil {
+		p.Sentinel(p, event)
+	} else if p.Buffer != nil && bufferExists(p.Buffer) {
+		p.Buffer.appendText("\nProcess " + p.Name + " " + event)
+	}
+}
+
+// Input is written from its own goroutine so that a process that isn't
+// reading can't hold up the editor.
+func (p *Process) writeInput() {
+	defer p.stdin.Close()
+	for {
+		p.inputMu.Lock()
+		for len(p.queued) == 0 && !p.eof {
+			p.inputReady.Wait()
+		}
+		queued, eof := p.queued, p.eof
+		p.queued = nil
+		p.inputMu.Unlock()
+		for _, text := range queued {
+			if _, err := io.WriteString(p.stdin, text); err != nil {
+				// The process has stopped reading; take no more.
+				p.inputMu.Lock()
+				p.queued = nil
+				p.eof = true
+				p.inputMu.Unlock()
+				return
+			}
+		}
+		if eof {
+			return
+		}
+	}
+}
+
+// Sends text to the process's standard input. It never waits for the
+// process to read it; input piles up until the process gets round to it.
+func (p *Process) Send(text string) error {
+	p.inputMu.Lock()
+	defer p.inputMu.Unlock()
+	if p.eof {
+		return errors.New("Input to " + p.Name + " has been closed")
+	}
+	p.queued = append(p.queued, text)
+	p.inputReady.Signal()
+	return nil
+}
+
+// Closes the process's standard input, once everything sent so far has been
+// written.
+func (p *Process) SendEOF() {
+	p.inputMu.Lock()
+	defer p.inputMu.Unlock()
+	p.eof = true
+	p.inputReady.Signal()
+}
+
+// Kills any process writing to buf, for when buf goes away.
+func killBufferProcesses(buf *EditorBuffer) {
+	for _, p := range processes {
+		if p.Buffer == buf {
+			p.Kill()
+			p.Buffer = nil
+		}
+	}
+}
+
+func processListLines() []string {
+	ret := []string{}
+	for _, p := range processes {
+		bufname := "--"
+		if p.Buffer != nil {
+			bufname = p.Buffer.getRenderName()
+		}
+		ret = append(ret, fmt.Sprintf("%-20s %-6s %-24s %s", p.Name, p.Status, bufname, strings.Join(p.cmd.Args, " ")))
+	}
+	return ret
+}
+
+func listProcesses() {
+	if len(processes) == 0 {
+		Global.Input = "No processes running"
+		return
+	}
+	showOutput("*Process List*", append([]string{fmt.Sprintf("%-20s %-6s %-24s %s", "Process", "Status", "Buffer", "Command")},
+		processListLines()...)...)
+}
+
+func doKillProcess() {
+	if len(processes) == 0 {
+		Global.Input = "No processes running"
+		return
+	}
+	def := 0
+	for i, p := range processes {
+		if p.Buffer == Global.CurrentB {
+			def = i
+		}
+	}
+	i := editorChoiceIndex("Kill process", processListLines(), def)
+	if i < 0 || i >= len(processes) {
+		Global.Input = "Cancelled."
+		return
+	}
+	p := processes[i]
+	if err := p.Kill(); err != nil {
+		Global.Input = err.Error()
+		AddErrorMessage(err.Error())
+		return
+	}
+	Global.Input = "Killed " + p.Name
+}
+
+func lispGetProcess(arg glisp.Sexp) (*Process, error) {
+	switch t := arg.(type) {
+	case glisp.SexpStr:
+		p := getProcess(string(t))
+		if p == nil {
+			return nil, errors.New("No such process: " + string(t))
+		}
+		return p, nil
+	default:
+		return nil, errors.New("Process needs to be given by name")
+	}
+}
+
+// (startprocess name buffer program args...) starts program in the
+// background, with its output going to the end of the buffer called buffer
+// (which is made if need be). Returns the name of the process, which is name
+// unless that was already taken.
+func lispStartProcess(env *glisp.Glisp, name string, args []glisp.Sexp) (glisp.Sexp, error) {
+	if len(args) < 3 {
+		return glisp.SexpNull, glisp.WrongNargs
+	}
+	strs := []string{}
+	for _, arg := range args {
+		switch t := arg.(type) {
+		case glisp.SexpStr:
+			strs = append(strs, string(t))
+		default:
+			return glisp.SexpNull, errors.New("All args need to be strings")
+		}
+	}
+	buf := findBufferByName(strs[1])
+	if buf == nil {
+		buf = getSpecialBuffer(strs[1])
+	}
+	p, err := startProcess(strs[0], buf, currentDirectory(), strs[2], strs[3:]...)
+	if err != nil {
+		return glisp.SexpNull, err
+	}
+	return glisp.SexpStr(p.Name), nil
+}
+
+func lispProcessSendString(env *glisp.Glisp, name string, args []glisp.Sexp) (glisp.Sexp, error) {
+	if len(args) != 2 {
+		return glisp.SexpNull, glisp.WrongNargs
+	}
+	p, err := lispGetProcess(args[0])
+	if err != nil {
+		return glisp.SexpNull, err
+	}
+	switch t := args[1].(type) {
+	case glisp.SexpStr:
+		return glisp.SexpNull, p.Send(string(t))
+	default:
+		return glisp.SexpNull, errors.New("Arg 2 needs to be a string")
+	}
+}
+
+func lispProcessSendEOF(env *glisp.Glisp, name string, args []glisp.Sexp) (glisp.Sexp, error) {
+	if len(args) != 1 {
+		return glisp.SexpNull, glisp.WrongNargs
+	}
+	p, err := lispGetProcess(args[0])
+	if err != nil {
+		return glisp.SexpNull, err
+	}
+	p.SendEOF()
+	return glisp.SexpNull, nil
+}
+
+// Calls a lisp function from a process callback, where there's nobody to
+// hand an error back to.
+func lispProcessCallback(env *glisp.Glisp, fun glisp.SexpFunction, args ...string) {
+	av := []glisp.Sexp{}
+	for _, arg := range args {
+		av = append(av, glisp.SexpStr(arg))
+	}
+	_, err := env.Apply(fun, av)
+	if err != nil {
+		Global.Input = err.Error()
+		AddErrorMessage(err.Error())
+	}
+}
+
+// (setprocesssentinel process func) makes func get called with the process
+// name and a description of what happened, such as "finished\n", when the
+// process exits.
+func lispSetProcessSentinel(env *glisp.Glisp, name string, args []glisp.Sexp) (glisp.Sexp, error) {
+	if len(args) != 2 {
+		return glisp.SexpNull, glisp.WrongNargs
+	}
+	p, err := lispGetProcess(args[0])
+	if err != nil {
+		return glisp.SexpNull, err
+	}
+	switch t := args[1].(type) {
+	case glisp.SexpFunction:
+		p.Sentinel = func(p *Process, event string) {
+			lispProcessCallback(env, t, p.Name, event)
+		}
+	default:
+		return glisp.SexpNull, errors.New("Arg 2 needs to be a function")
+	}
+	return glisp.SexpNull, nil
+}
+
+// (setprocessfilter process func) makes func get called with the process
+// name and each chunk of output, instead of the output going to the buffer.
+func lispSetProcessFilter(env *glisp.Glisp, name string, args []glisp.Sexp) (glisp.Sexp, error) {
+	if len(args) != 2 {
+		return glisp.SexpNull, glisp.WrongNargs
+	}
+	p, err := lispGetProcess(args[0])
+	if err != nil {
+		return glisp.SexpNull, err
+	}
+	switch t := args[1].(type) {
+	case glisp.SexpFunction:
+		p.Filter = func(p *Process, output string) {
+			lispProcessCallback(env, t, p.Name, output)
+		}
+	default:
+		return glisp.SexpNull, errors.New("Arg 2 needs to be a function")
+	}
+	return glisp.SexpNull, nil
+}
+
+func lispKillProcess(env *glisp.Glisp, name string, args []glisp.Sexp) (glisp.Sexp, error) {
+	if len(args) != 1 {
+		return glisp.SexpNull, glisp.WrongNargs
+	}
+	p, err := lispGetProcess(args[0])
+	if err != nil {
+		return glisp.SexpNull, err
+	}
+	return glisp.SexpNull, p.Kill()
+}
+
+// Returns "run" while the process is running, or nil once it has gone.
+func lispProcessStatus(env *glisp.Glisp, name string, args []glisp.Sexp) (glisp.Sexp, error) {
+	if len(args) != 1 {
+		return glisp.SexpNull, glisp.WrongNargs
+	}
+	p, err := lispGetProcess(args[0])
+	if err != nil {
+		return glisp.SexpNull, nil
+	}
+	return glisp.SexpStr(p.Status), nil
+}
@@ -0,0 +1,25 @@
+// +build android plan9 nacl windows
+
+package main
+
+import (
+	"os"
+	"os/exec"
+)
+
+// No process groups here; signals only go to the process itself.
+func setProcessGroup(cmd *exec.Cmd) {}
+
+func (p *Process) Interrupt() error {
+	return p.cmd.Process.Signal(os.Interrupt)
+}
+
+func (p *Process) Kill() error {
+	return p.cmd.Process.Kill()
+}
+
+var fatalSignals = []os.Signal{}
+
+func exitSignal(err *exec.ExitError) (string, int, bool) {
+	return "", 0, false
+}
@@ -0,0 +1,43 @@
+// +build linux darwin dragonfly solaris openbsd netbsd freebsd
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+)
+
+// Each process gets a process group of its own, so that signals reach
+// whatever it has started too (the compiler make ran, the command a shell is
+// running).
+func setProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+func signalProcessGroup(p *Process, sig syscall.Signal) error {
+	return syscall.Kill(-p.cmd.Process.Pid, sig)
+}
+
+func (p *Process) Interrupt() error {
+	return signalProcessGroup(p, syscall.SIGINT)
+}
+
+func (p *Process) Kill() error {
+	return signalProcessGroup(p, syscall.SIGKILL)
+}
+
+// Signals that mean the editor is about to die, such as when its terminal
+// goes away; unsaved work is auto-saved first.
+var fatalSignals = []os.Signal{syscall.SIGHUP, syscall.SIGTERM}
+
+// Returns the name of the signal that killed the process, if that's how it
+// exited.
+func exitSignal(err *exec.ExitError) (string, int, bool) {
+	status, ok := err.Sys().(syscall.WaitStatus)
+	if !ok || !status.Signaled() {
+		return "", 0, false
+	}
+	return strings.ToLower(status.Signal().String()), int(status.Signal()), true
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// A process that never reads its input mustn't make Send wait.
+func TestSendDoesntBlock(t *testing.T) {
+	p, err := startProcess("sleep", nil, ".", "sleep", "5")
+	if err != nil {
+		t.Skip(err)
+	}
+	defer p.Kill()
+	line := strings.Repeat("x", 1000) + "\n"
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < 1000; i++ {
+			p.Send(line)
+		}
+		done <- true
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Send blocked")
+	}
+	p.SendEOF()
+	if err := p.Send("more"); err == nil {
+		t.Error("Send after SendEOF didn't fail")
+	}
+}
+
+func TestIncompleteRuneStart(t *testing.T) {
+	tests := []struct {
+		data string
+		want int
+	}{
+		{"abc", 3},
+		{"ab\xc3", 2},         // First byte of é
+		{"ab\xe2\x82", 2},     // Two bytes of €
+		{"ab\xe2\x82\xac", 5}, // All of €
+		{"\xf0\x9f\x98", 0},   // Three bytes of a four byte emoji
+		{"\x80\x80", 2},       // Not UTF-8 at all; pass it on as it is
+		{"", 0},
+	}
+	for _, tt := range tests {
+		if got := incompleteRuneStart([]byte(tt.data)); got != tt.want {
+			t.Errorf("incompleteRuneStart(%q) = %d, want %d", tt.data, got, tt.want)
+		}
+	}
+}
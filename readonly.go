@@ -0,0 +1,58 @@
+package main
+
+// Reports whether buf can be changed. If it can't, the user is told why.
+// Everything that edits a buffer on the user's behalf checks this first.
+func (buf *EditorBuffer) checkWritable() bool {
+	if buf.ReadOnly {
+		Global.Input = "Buffer is read-only: " + buf.getRenderName()
+		return false
+	}
+	return true
+}
+
+func toggleReadOnly() {
+	buf := Global.CurrentB
+	if buf.large != nil {
+		Global.Input = "Buffers in large-file mode are always read-only"
+		return
+	}
+	buf.ReadOnly = !buf.ReadOnly
+	if buf.ReadOnly {
+		Global.Input = "Read-only mode enabled in " + buf.getRenderName()
+	} else {
+		if buf.hasMode("view-mode") {
+			buf.setMode("view-mode", false)
+			delete(viewModeReadOnly, buf)
+		}
+		Global.Input = "Read-only mode disabled in " + buf.getRenderName()
+	}
+}
+
+// Whether each buffer in view-mode was read-only before, so that leaving it
+// puts it back.
+var viewModeReadOnly = map[*EditorBuffer]bool{}
+
+// view-mode makes the buffer read-only and binds SPC and DEL to page
+// through it and q to leave.
+func viewMode() {
+	buf := Global.CurrentB
+	if buf.hasMode("view-mode") {
+		viewModeExit()
+		return
+	}
+	viewModeReadOnly[buf] = buf.ReadOnly
+	buf.ReadOnly = true
+	buf.setMode("view-mode", true)
+	Global.Input = "View mode: SPC and DEL to page, q to quit"
+}
+
+func viewModeExit() {
+	buf := Global.CurrentB
+	if !buf.hasMode("view-mode") {
+		return
+	}
+	buf.setMode("view-mode", false)
+	buf.ReadOnly = viewModeReadOnly[buf]
+	delete(viewModeReadOnly, buf)
+	Global.Input = "View mode disabled"
+}
@@ -0,0 +1,13 @@
+// +build android plan9 nacl windows
+
+package main
+
+import (
+	"os"
+)
+
+// Reports whether we'd be allowed to write fn, going by its permissions.
+func fileWritable(fn string) bool {
+	fi, err := os.Stat(fn)
+	return err != nil || fi.Mode().Perm()&0200 != 0
+}
@@ -0,0 +1,16 @@
+// +build linux darwin dragonfly solaris openbsd netbsd freebsd
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// Reports whether we'd be allowed to write fn. access(2) asks without
+// opening the file, which could block on a FIFO or have other effects on a
+// device.
+func fileWritable(fn string) bool {
+	err := syscall.Access(fn, 2 /* W_OK */)
+	return err == nil || !(os.IsPermission(err) || err == syscall.EROFS)
+}
@@ -11,6 +11,9 @@ type rectangle struct {
 }
 
 func doStringRectangle() {
+	if !Global.CurrentB.checkWritable() {
+		return
+	}
 	if validMark(Global.CurrentB) {
 		rect := Global.CurrentB.getRectangle()
 		Global.CurrentB.stringRectangle(editorPrompt("String rectangle", nil), rect)
@@ -21,9 +24,12 @@ func doStringRectangle() {
 }
 
 func (buf *EditorBuffer) stringRectangle(rep string, rect rectangle) {
+	if !buf.checkWritable() {
+		return
+	}
 	addRectUndo(false, buf, rect)
 	for i := rect.TopLeftY; i <= rect.BotRightY && i < buf.NumRows; i++ {
-		rectReplace(rect.TopLeftX, rect.BotRightX, buf.Rows[i], buf, rep)
+		rectReplace(rect.TopLeftX, rect.BotRightX, buf.row(i), buf, rep)
 	}
 	if rect.TopLeftX+len(rep) != rect.BotRightX {
 		rect.BotRightX = rect.TopLeftX + len(rep)
@@ -42,13 +48,16 @@ func addRectUndo(ins bool, buf *EditorBuffer, rect rectangle) {
 // HACK: Horrid signature. I need a region struct, but I'm too lazy
 func rectToRegion(buf *EditorBuffer, rect rectangle) (int, int, int, int) {
 	startc, endc, startl, endl := rect.TopLeftX, rect.BotRightX, rect.TopLeftY, rect.BotRightY
-	if endc > buf.Rows[endl].Size {
-		endc = buf.Rows[endl].Size
+	if endc > buf.row(endl).Size {
+		endc = buf.row(endl).Size
 	}
 	return startc, endc, startl, endl
 }
 
 func rectReplace(TopLeftX, BotRightX int, row *EditorRow, buf *EditorBuffer, s string) {
+	if !buf.checkWritable() {
+		return
+	}
 	if TopLeftX > row.Size {
 		var buffer bytes.Buffer
 		buffer.WriteString(row.Data)
@@ -85,8 +94,8 @@ func (buf *EditorBuffer) getRectangle() rectangle {
 
 func doCopyRectangle() {
 	if validMark(Global.CurrentB) {
-		Global.Clipboard = Global.CurrentB.copyRect()
-		Global.Input = "Copied rectangle to clipboard"
+		Global.KillRing.Push(Global.CurrentB.copyRect())
+		Global.Input = "Copied rectangle to kill ring"
 		Global.CurrentB.regionActive = false
 	} else {
 		Global.Input = "Invalid mark position"
@@ -100,7 +109,7 @@ func (buf *EditorBuffer) copyRect() string {
 		if i != rect.TopLeftY {
 			buffer.WriteRune('\n')
 		}
-		row := buf.Rows[i]
+		row := buf.row(i)
 		width := rect.BotRightX - rect.TopLeftX
 		if rect.TopLeftX > row.Size {
 			for i := 0; i < width; i++ {
@@ -132,8 +141,11 @@ func rectToRegister() {
 }
 
 func doKillRectangle() {
+	if !Global.CurrentB.checkWritable() {
+		return
+	}
 	if validMark(Global.CurrentB) {
-		Global.Clipboard = Global.CurrentB.copyRect()
+		Global.KillRing.Push(Global.CurrentB.copyRect())
 		Global.CurrentB.stringRectangle("", Global.CurrentB.getRectangle())
 		Global.Input = "Killed rectangle"
 		Global.CurrentB.regionActive = false
@@ -143,12 +155,15 @@ func doKillRectangle() {
 }
 
 func doYankRectangle() {
-	yankRectangle(Global.CurrentB, Global.Clipboard)
-	Global.Input = "Yanked rectangle from clipboard."
+	yankRectangle(Global.CurrentB, Global.KillRing.Current())
+	Global.Input = "Yanked rectangle from kill ring."
 	Global.CurrentB.regionActive = false
 }
 
 func yankRectangle(buf *EditorBuffer, rect string) {
+	if !buf.checkWritable() {
+		return
+	}
 	if buf.cy >= buf.NumRows {
 		doYankText(rect)
 	} else {
@@ -159,10 +174,10 @@ func yankRectangle(buf *EditorBuffer, rect string) {
 		var endc, endl int
 		if startl+ll >= buf.NumRows {
 			endl = buf.NumRows - 1
-			endc = buf.Rows[endl].Size
+			endc = buf.row(endl).Size
 		} else {
 			endl = startl + ll
-			endc = buf.Rows[endl].Size
+			endc = buf.row(endl).Size
 		}
 		editorAddRegionUndo(false, startc, endc, startl, endl,
 			getRegionText(buf, startc, endc, startl, endl))
@@ -172,14 +187,14 @@ func yankRectangle(buf *EditorBuffer, rect string) {
 			if index >= buf.NumRows {
 				editorAppendRow("")
 			}
-			rectReplace(buf.cx, buf.cx, buf.Rows[index], buf, line)
+			rectReplace(buf.cx, buf.cx, buf.row(index), buf, line)
 		}
 
 		endl = startl + ll
 		if endl >= buf.NumRows {
 			endl = buf.NumRows - 1
 		}
-		endc = buf.Rows[endl].Size
+		endc = buf.row(endl).Size
 		editorAddRegionUndo(true, startc, endc, startl, endl,
 			getRegionText(buf, startc, endc, startl, endl))
 		buf.Undo.paired = true
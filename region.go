@@ -27,13 +27,13 @@ func (buf *EditorBuffer) setRegion(startc, startl, endc, endl int) {
 	region := buf.region
 	region.startl = startl
 	if region.startl < buf.NumRows {
-		region.startc = buf.Rows[region.startl].cxToRx(startc)
+		region.startc = buf.row(region.startl).cxToRx(startc)
 	} else {
 		region.startc = 0
 	}
 	region.endl = endl
 	if region.endl < buf.NumRows {
-		region.endc = buf.Rows[region.endl].cxToRx(endc)
+		region.endc = buf.row(region.endl).cxToRx(endc)
 	} else {
 		region.endc = 0
 	}
@@ -66,7 +66,7 @@ func (buf *EditorBuffer) recalcRegion() {
 }
 
 func validMark(buf *EditorBuffer) bool {
-	return buf.cy < buf.NumRows && buf.MarkY < buf.NumRows && buf.MarkX <= len(buf.Rows[buf.MarkY].Data)
+	return buf.cy < buf.NumRows && buf.MarkY < buf.NumRows && buf.MarkX <= len(buf.row(buf.MarkY).Data)
 }
 
 func doSwapMarkAndCursor(buf *EditorBuffer) {
@@ -82,16 +82,22 @@ func doSwapMarkAndCursor(buf *EditorBuffer) {
 }
 
 func rowDelRange(row *EditorRow, startc, endc int, buf *EditorBuffer) string {
-	editorAddDeleteUndo(startc, endc,
-		row.idx, row.idx, row.Data[startc:endc])
+	if !buf.checkWritable() {
+		return ""
+	}
+	at := row.index()
+	editorAddDeleteUndo(startc, endc, at, at, row.Data[startc:endc])
 	ret := row.Data[startc:endc]
 	editorRowDelChar(row, buf, startc, endc-startc)
 	return ret
 }
 
 func bufKillRegion(buf *EditorBuffer, startc, endc, startl, endl int) string {
+	if !buf.checkWritable() {
+		return ""
+	}
 	var ret string
-	row := buf.Rows[startl]
+	row := buf.row(startl)
 	if startl == endl {
 		ret = row.Data[startc:endc]
 		editorRowDelChar(row, buf, startc, endc-startc)
@@ -105,32 +111,25 @@ func bufKillRegion(buf *EditorBuffer, startc, endc, startl, endl int) string {
 
 		// Collect data from middle rows
 		for i := startl + 1; i < endl; i++ {
-			bb.WriteString(buf.Rows[i].Data)
+			bb.WriteString(buf.row(i).Data)
 			bb.WriteRune('\n')
 		}
 
 		// Collect data from last row
-		row = buf.Rows[endl]
+		row = buf.row(endl)
 		bb.WriteString(row.Data[:endc])
 		row.Data = row.Data[endc:]
 
 		// Append last row's data to first row
-		buf.Rows[startl].Data += row.Data
-		buf.Rows[startl].Size = len(buf.Rows[startl].Data)
-		rowUpdateRender(buf.Rows[startl])
+		buf.row(startl).Data += row.Data
+		buf.row(startl).Size = len(buf.row(startl).Data)
+		rowUpdateRender(buf.row(startl), buf)
 		ret = bb.String()
 
 		// Cut region out of rows
-		i, j := startl+1, endl+1
-		copy(buf.Rows[i:], buf.Rows[j:])
-		for k, n := len(buf.Rows)-j+i, len(buf.Rows); k < n; k++ {
-			buf.Rows[k] = nil // or the zero value of T
-		}
-		buf.Rows = buf.Rows[:len(buf.Rows)-j+i]
-		buf.NumRows = len(buf.Rows)
+		buf.deleteRows(startl+1, endl+1)
 
 		// Update the buffer and return
-		updateLineIndexes()
 		buf.Highlight()
 	}
 	buf.cx = startc
@@ -142,18 +141,18 @@ func bufKillRegion(buf *EditorBuffer, startc, endc, startl, endl int) string {
 
 func getRegionText(buf *EditorBuffer, startc, endc, startl, endl int) string {
 	if startl == endl {
-		return buf.Rows[startl].Data[startc:endc]
+		return buf.row(startl).Data[startc:endc]
 	} else {
 		var bb bytes.Buffer
-		row := buf.Rows[startl]
+		row := buf.row(startl)
 		bb.WriteString(row.Data[startc:])
 		bb.WriteRune('\n')
 		for i := startl + 1; i < endl; i++ {
-			row = buf.Rows[i]
+			row = buf.row(i)
 			bb.WriteString(row.Data)
 			bb.WriteRune('\n')
 		}
-		row = buf.Rows[endl]
+		row = buf.row(endl)
 		bb.WriteString(row.Data[:endc])
 		return bb.String()
 	}
@@ -185,14 +184,17 @@ func regionCmd(c func(*EditorBuffer, int, int, int, int) string) (string, error)
 }
 
 func doKillRegion() {
+	if !Global.CurrentB.checkWritable() {
+		return
+	}
 	res, err := regionCmd(func(buf *EditorBuffer, startc, endc, startl, endl int) string {
 		ret := bufKillRegion(buf, startc, endc, startl, endl)
 		editorAddRegionUndo(false, startc, endc,
-			startl, endl, Global.Clipboard)
+			startl, endl, ret)
 		return ret
 	})
 	if err == nil {
-		Global.Clipboard = res
+		addKill(res, false)
 		Global.CurrentB.regionActive = false
 	}
 }
@@ -200,12 +202,15 @@ func doKillRegion() {
 func doCopyRegion() {
 	res, err := regionCmd(bufCopyRegion)
 	if err == nil {
-		Global.Clipboard = res
+		Global.KillRing.Push(res)
 		Global.CurrentB.regionActive = false
 	}
 }
 
 func spitRegion(cx, cy int, region string) (int, int) {
+	if !Global.CurrentB.checkWritable() {
+		return cx, cy
+	}
 	Global.CurrentB.Dirty = true
 	Global.CurrentB.cx = cx
 	Global.CurrentB.prefcx = cx
@@ -214,7 +219,7 @@ func spitRegion(cx, cy int, region string) (int, int) {
 	if cy == Global.CurrentB.NumRows {
 		editorAppendRow("")
 	}
-	row := Global.CurrentB.Rows[cy]
+	row := Global.CurrentB.row(cy)
 	data := row.Data
 	row.Data = data[:cx] + clipLines[0]
 	row.Size = len(row.Data)
@@ -222,14 +227,14 @@ func spitRegion(cx, cy int, region string) (int, int) {
 	Global.CurrentB.prefcx = row.Size
 	if len(clipLines) > 1 {
 		// Insert more lines...
-		rowUpdateRender(row)
+		rowUpdateRender(row, Global.CurrentB)
 		myrows := make([]*EditorRow, len(clipLines)-1)
 		mrlen := len(myrows)
 		for i := 0; i < mrlen; i++ {
 			newrow := &EditorRow{}
 			newrow.Data = clipLines[i+1]
 			newrow.Size = len(newrow.Data)
-			rowUpdateRender(newrow)
+			rowUpdateRender(newrow, Global.CurrentB)
 			myrows[i] = newrow
 		}
 		Global.CurrentB.cy += mrlen
@@ -238,17 +243,10 @@ func spitRegion(cx, cy int, region string) (int, int) {
 		if cx < len(data) {
 			myrows[mrlen-1].Data += data[cx:]
 			myrows[mrlen-1].Size = len(myrows[mrlen-1].Data)
-			rowUpdateRender(myrows[mrlen-1])
+			rowUpdateRender(myrows[mrlen-1], Global.CurrentB)
 		}
 
-		if cy < Global.CurrentB.NumRows {
-			Global.CurrentB.Rows = append(Global.CurrentB.Rows[:cy+1], append(myrows, Global.CurrentB.Rows[cy+1:]...)...)
-
-		} else {
-			Global.CurrentB.Rows = append(Global.CurrentB.Rows[:cy], myrows...)
-		}
-		Global.CurrentB.NumRows = len(Global.CurrentB.Rows)
-		updateLineIndexes()
+		Global.CurrentB.insertRows(cy+1, myrows...)
 		if Global.CurrentB.Highlighter != nil {
 			Global.CurrentB.Highlighter.HighlightStates(Global.CurrentB)
 			if cy == 0 {
@@ -268,6 +266,9 @@ func spitRegion(cx, cy int, region string) (int, int) {
 }
 
 func doYankText(text string) {
+	if !Global.CurrentB.checkWritable() {
+		return
+	}
 	times := getRepeatTimes()
 	for i := 0; i < times; i++ {
 		cx, cy := spitRegion(Global.CurrentB.cx, Global.CurrentB.cy, text)
@@ -277,11 +278,17 @@ func doYankText(text string) {
 }
 
 func doYankRegion() {
-	doYankText(Global.Clipboard)
+	k := Global.KillRing
+	k.yank = 0
+	k.yankcx, k.yankcy = Global.CurrentB.cx, Global.CurrentB.cy
+	doYankText(k.Current())
 	Global.CurrentB.regionActive = false
 }
 
 func killToEol() {
+	if !Global.CurrentB.checkWritable() {
+		return
+	}
 	cx := Global.CurrentB.cx
 	cy := Global.CurrentB.cy
 	if cy == Global.CurrentB.NumRows {
@@ -290,7 +297,7 @@ func killToEol() {
 	if Global.SetUniversal && Global.Universal != 1 {
 		if Global.Universal == 0 {
 			if 0 < Global.CurrentB.cx && cy < Global.CurrentB.NumRows {
-				Global.Clipboard = rowDelRange(Global.CurrentB.Rows[cy], 0, cx, Global.CurrentB)
+				addKill(rowDelRange(Global.CurrentB.row(cy), 0, cx, Global.CurrentB), true)
 				Global.CurrentB.cx = 0
 			}
 		} else if 1 < Global.Universal {
@@ -298,27 +305,37 @@ func killToEol() {
 			if Global.CurrentB.NumRows < endl {
 				endl = Global.CurrentB.NumRows - 1
 			}
-			Global.Clipboard = bufKillRegion(Global.CurrentB, cx, 0, cy, endl)
-			editorAddRegionUndo(false, cx, 0, cy, endl, Global.Clipboard)
+			killed := bufKillRegion(Global.CurrentB, cx, 0, cy, endl)
+			editorAddRegionUndo(false, cx, 0, cy, endl, killed)
+			addKill(killed, false)
 		} else {
 			startl := cy + Global.Universal
 			if startl < 0 {
 				startl = 0
 			}
-			Global.Clipboard = bufKillRegion(Global.CurrentB, 0, cx, startl, cy)
-			editorAddRegionUndo(false, 0, cx, startl, cy, Global.Clipboard)
+			killed := bufKillRegion(Global.CurrentB, 0, cx, startl, cy)
+			editorAddRegionUndo(false, 0, cx, startl, cy, killed)
+			addKill(killed, true)
 		}
 	} else {
-		if cx >= Global.CurrentB.Rows[cy].Size {
-			Global.CurrentB.MoveCursorRight()
-			editorDelChar()
+		if cx >= Global.CurrentB.row(cy).Size {
+			if cy+1 < Global.CurrentB.NumRows {
+				Global.CurrentB.MoveCursorRight()
+				editorDelChar()
+				addKill("\n", false)
+			} else {
+				Global.Input = "End of buffer"
+			}
 		} else {
-			Global.Clipboard = rowDelRange(Global.CurrentB.Rows[cy], cx, Global.CurrentB.Rows[cy].Size, Global.CurrentB)
+			addKill(rowDelRange(Global.CurrentB.row(cy), cx, Global.CurrentB.row(cy).Size, Global.CurrentB), false)
 		}
 	}
 }
 
 func transposeRegion(buf *EditorBuffer, startc, endc, startl, endl int, trans func(string) string) {
+	if !buf.checkWritable() {
+		return
+	}
 	killed := bufKillRegion(buf, startc, endc, startl, endl)
 	editorAddRegionUndo(false, startc, endc, startl, endl, killed)
 	text := trans(killed)
@@ -348,7 +365,7 @@ func doUntabifyRegion() {
 		lines := strings.Split(s, "\n")
 		newlines := make([]string, 0, len(lines))
 		repstr := ""
-		for i := 0; i < Global.Tabsize; i++ {
+		for i := 0; i < Global.CurrentB.tabWidth(); i++ {
 			repstr += " "
 		}
 		for _, line := range lines {
@@ -375,7 +392,7 @@ func doTabifyRegion() {
 		lines := strings.Split(s, "\n")
 		newlines := make([]string, 0, len(lines))
 		repstr := ""
-		for i := 0; i < Global.Tabsize; i++ {
+		for i := 0; i < Global.CurrentB.tabWidth(); i++ {
 			repstr += " "
 		}
 		for _, line := range lines {
@@ -388,7 +405,7 @@ func doTabifyRegion() {
 						break
 					}
 				}
-				count = count / Global.Tabsize
+				count = count / Global.CurrentB.tabWidth()
 				newlines = append(newlines, strings.Replace(line, repstr, "\t", count))
 			} else {
 				newlines = append(newlines, line)
@@ -419,7 +436,7 @@ func FillString(s string) string {
 				break
 			}
 			ww := termutil.RunewidthStr(word)
-			if lw+ww > Global.Fillcolumn {
+			if lw+ww > Global.CurrentB.fillColumn() {
 				ret.WriteString("\n" + word)
 				lw = ww
 			} else {
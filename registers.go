@@ -108,7 +108,7 @@ func (r *RegisterList) jumpToPositionRegister(regname string) {
 			Global.CurrentB.cx = 0
 		} else {
 			Global.CurrentB.cy = reg.Posy
-			row := Global.CurrentB.Rows[reg.Posy]
+			row := Global.CurrentB.row(reg.Posy)
 			if reg.Posx > row.Size {
 				Global.CurrentB.cx = row.Size
 			} else {
@@ -4,7 +4,6 @@ import (
 	"fmt"
 	"math"
 	"strconv"
-	"strings"
 
 	"github.com/japanoise/termbox-util"
 	"github.com/mattn/go-runewidth"
@@ -18,7 +17,7 @@ func (row *EditorRow) cxToRx(cx int) int {
 			break
 		}
 		if rv == '\t' {
-			rx += Global.Tabsize
+			rx += row.tabsize
 		} else {
 			rx += termutil.Runewidth(rv)
 		}
@@ -26,6 +25,24 @@ func (row *EditorRow) cxToRx(cx int) int {
 	return rx
 }
 
+// Converts a byte offset into row.Data to a rune offset into row.Render.
+func (row *EditorRow) dataToRenderIndex(b int) int {
+	return row.dataToRenderIndexFrom(0, b)
+}
+
+// How many runes of row.Render the bytes of row.Data from a to b take up.
+func (row *EditorRow) dataToRenderIndexFrom(a, b int) int {
+	ret := 0
+	for _, rv := range row.Data[a:b] {
+		if rv == '\t' {
+			ret += row.tabsize
+		} else {
+			ret++
+		}
+	}
+	return ret
+}
+
 func editorRowCxToRx(row *EditorRow) int {
 	return row.cxToRx(Global.CurrentB.cx)
 }
@@ -35,7 +52,7 @@ func editorRowRxToCx(row *EditorRow, rx int) int {
 	var cx int
 	for cx = 0; cx < row.Size; cx++ {
 		if row.Data[cx] == '\t' {
-			cur_rx += Global.Tabsize
+			cur_rx += row.tabsize
 		} else {
 			cur_rx++
 		}
@@ -47,15 +64,16 @@ func editorRowRxToCx(row *EditorRow, rx int) int {
 }
 
 func editorRefreshScreen() {
-	termbox.Clear(termbox.ColorDefault, termbox.ColorDefault)
-	x, y := termbox.Size()
+	largeFilePage(Global.CurrentB)
+	screen.Clear()
+	x, y := screen.Size()
 	yrows := y - 2
 	numwin := len(Global.Windows)
 	winheight := yrows / numwin
 	for i, win := range Global.Windows {
 		gutter := 0
 		if win.hasMode("line-number-mode") && win.NumRows > 0 {
-			gutter = GetGutterWidth(win.NumRows)
+			gutter = GetGutterWidth(win.totalLines())
 		}
 		starth := 0
 		if i >= 1 {
@@ -67,7 +85,7 @@ func editorRefreshScreen() {
 		}
 		if win == Global.CurrentB {
 			Global.CurrentBHeight = winheight
-			termbox.SetCursor(Global.CurrentB.rx-Global.CurrentB.coloff+gutter, starth+Global.CurrentB.cy-Global.CurrentB.rowoff)
+			screen.SetCursor(Global.CurrentB.rx-Global.CurrentB.coloff+gutter, starth+Global.CurrentB.cy-Global.CurrentB.rowoff)
 		}
 		if win.regionActive {
 			win.recalcRegion()
@@ -76,20 +94,32 @@ func editorRefreshScreen() {
 	}
 	editorDrawStatusLine(x, y-2, Global.Windows[numwin-1])
 	editorDrawPrompt(y)
-	termbox.Flush()
+	screen.Flush()
 }
 
-func trimString(s string, coloff int) (string, int) {
-	if coloff == 0 {
-		return s, 0
+// Returns the part of s that fits in width columns starting coloff runes
+// in, and the byte offset it starts at. Only that part of s is looked at, so
+// drawing a line megabytes long costs no more than drawing a short one.
+func trimString(s string, coloff, width int) (string, int) {
+	start, end := -1, len(s)
+	n, w := 0, 0
+	for i, ru := range s {
+		if n == coloff {
+			start = i
+		}
+		if start >= 0 {
+			if w >= width {
+				end = i
+				break
+			}
+			w += termutil.Runewidth(ru)
+		}
+		n++
 	}
-	sr := []rune(s)
-	if coloff < len(sr) {
-		ret := string(sr[coloff:])
-		return ret, strings.Index(s, ret)
-	} else {
+	if start < 0 {
 		return "", 0
 	}
+	return s[start:end], start
 }
 
 func editorDrawRows(starty, sy int, buf *EditorBuffer, gutsize int) {
@@ -97,23 +127,24 @@ func editorDrawRows(starty, sy int, buf *EditorBuffer, gutsize int) {
 		filerow := (y - starty) + buf.rowoff
 		if filerow >= buf.NumRows {
 			if buf.coloff == 0 && buf.hasMode("tilde-mode") {
-				termbox.SetCell(gutsize, y, '~', termbox.ColorBlue, termbox.ColorDefault)
+				screen.SetCell(gutsize, y, '~', termbox.ColorBlue, termbox.ColorDefault)
 			}
 		} else {
 			if gutsize > 0 {
 				if buf.hasMode("gdi") {
-					termutil.Printstring(string(buf.Rows[filerow].idx), 0, y)
+					printString(string(rune(filerow)), 0, y)
 				} else {
-					termutil.Printstring(runewidth.FillLeft(LineNrToString(buf.Rows[filerow].idx+1), gutsize-2), 0, y)
+					printString(runewidth.FillLeft(LineNrToString(buf.lineOffset()+filerow+1), gutsize-2), 0, y)
 				}
-				termutil.PrintRune(gutsize-2, y, '│', termbox.ColorDefault)
+				printRune(gutsize-2, y, '│', termbox.ColorDefault)
 				if buf.coloff > 0 {
-					termutil.PrintRune(gutsize-1, y, '←', termbox.ColorDefault)
+					printRune(gutsize-1, y, '←', termbox.ColorDefault)
 				}
 			}
-			row := buf.Rows[filerow]
+			row := buf.row(filerow)
 			if buf.coloff < row.RenderSize {
-				ts, off := trimString(row.Render, buf.coloff)
+				sx, _ := screen.Size()
+				ts, off := trimString(row.Render, buf.coloff, sx-gutsize)
 				row.Print(gutsize, y, buf.coloff, off, ts, buf)
 			}
 		}
@@ -126,67 +157,75 @@ func editorUpdateStatus(buf *EditorBuffer) string {
 	if buf.Dirty {
 		dc = '*'
 	}
-	return fmt.Sprintf("-%c %s - (%s) %d:%d", dc, fn, buf.MajorMode,
-		buf.cy+1, buf.cx)
+	if buf.ReadOnly {
+		dc = '%'
+	}
+	coding := ""
+	if c := buf.codingSystem(); c != defaultCoding {
+		coding = " [" + c.String() + "]"
+	}
+	return fmt.Sprintf("-%c %s - (%s)%s %d:%d", dc, fn, buf.MajorMode, coding,
+		buf.lineOffset()+buf.cy+1, buf.cx)
 }
 
 func GetScreenSize() (int, int) {
-	x, _ := termbox.Size()
+	x, _ := screen.Size()
 	return x, Global.CurrentBHeight
 }
 
 func editorDrawStatusLine(x, y int, buf *EditorBuffer) {
 	line := editorUpdateStatus(buf)
 	if buf == Global.CurrentB && buf.hasMode("terminal-title-mode") {
-		terminalTitle(buf)
+		screen.SetTitle(buf.getRenderName() + " - gomacs")
 	}
 	var ru rune
 	rx := 0
 	for _, ru = range line {
-		termbox.SetCell(rx, y, ru, termbox.ColorDefault|termbox.AttrReverse, termbox.ColorDefault)
+		screen.SetCell(rx, y, ru, termbox.ColorDefault|termbox.AttrReverse, termbox.ColorDefault)
 		rx += termutil.Runewidth(ru)
 	}
-	termbox.SetCell(rx, y, ' ', termbox.ColorDefault|termbox.AttrReverse, termbox.ColorDefault)
+	screen.SetCell(rx, y, ' ', termbox.ColorDefault|termbox.AttrReverse, termbox.ColorDefault)
 	var ix int
 	for ix = rx + 1; ix < x-7; ix++ {
 		if buf == Global.CurrentB {
-			termbox.SetCell(ix, y, '-', termbox.ColorDefault|termbox.AttrReverse, termbox.ColorDefault)
+			screen.SetCell(ix, y, '-', termbox.ColorDefault|termbox.AttrReverse, termbox.ColorDefault)
 		} else {
-			termbox.SetCell(ix, y, ' ', termbox.ColorDefault|termbox.AttrReverse, termbox.ColorDefault)
+			screen.SetCell(ix, y, ' ', termbox.ColorDefault|termbox.AttrReverse, termbox.ColorDefault)
 		}
 	}
 	el := calcEndLabel(buf)
 	for _, ru := range el {
-		termbox.SetCell(ix, y, ru, termbox.ColorDefault|termbox.AttrReverse, termbox.ColorDefault)
+		screen.SetCell(ix, y, ru, termbox.ColorDefault|termbox.AttrReverse, termbox.ColorDefault)
 		ix++
 	}
 	for ix < x {
 		if buf == Global.CurrentB {
-			termbox.SetCell(ix, y, '-', termbox.ColorDefault|termbox.AttrReverse, termbox.ColorDefault)
+			screen.SetCell(ix, y, '-', termbox.ColorDefault|termbox.AttrReverse, termbox.ColorDefault)
 		} else {
-			termbox.SetCell(ix, y, ' ', termbox.ColorDefault|termbox.AttrReverse, termbox.ColorDefault)
+			screen.SetCell(ix, y, ' ', termbox.ColorDefault|termbox.AttrReverse, termbox.ColorDefault)
 		}
 		ix++
 	}
 }
 
 func calcEndLabel(buf *EditorBuffer) string {
-	if buf.NumRows == 0 {
+	rowoff, lines := buf.lineOffset()+buf.rowoff, buf.totalLines()
+	if lines == 0 {
 		return " Emp "
-	} else if Global.CurrentBHeight >= buf.NumRows {
+	} else if Global.CurrentBHeight >= lines {
 		return " All "
-	} else if buf.rowoff+Global.CurrentBHeight >= buf.NumRows {
+	} else if rowoff+Global.CurrentBHeight >= lines {
 		return " Bot "
-	} else if buf.rowoff == 0 {
+	} else if rowoff == 0 {
 		return " Top "
 	} else {
-		perc := float64(buf.rowoff) / float64(buf.NumRows)
+		perc := float64(rowoff) / float64(lines)
 		return fmt.Sprintf(" %2d%% ", int(perc*100))
 	}
 }
 
 func editorDrawPrompt(y int) {
-	termutil.Printstring(Global.Prompt+"-> "+Global.Input, 0, y-1)
+	printString(Global.Prompt+"-> "+Global.Input, 0, y-1)
 }
 
 func NumStrWidth(num int) int {
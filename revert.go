@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// What a file on disk looked like when we last read or wrote it, so that we
+// can tell if something else has changed it since.
+type fileStamp struct {
+	exists  bool
+	modTime time.Time
+	size    int64
+	hash    [sha256.Size]byte
+}
+
+func newFileStamp(fi os.FileInfo, hash []byte) fileStamp {
+	ret := fileStamp{true, fi.ModTime(), fi.Size(), [sha256.Size]byte{}}
+	copy(ret.hash[:], hash)
+	return ret
+}
+
+func statFileStamp(fn string) (fileStamp, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return fileStamp{}, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return fileStamp{}, err
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return fileStamp{}, err
+	}
+	return newFileStamp(fi, h.Sum(nil)), nil
+}
+
+// Reports whether the buffer's file has been changed by something else since
+// we read or wrote it. The contents are only hashed if the time or size
+// differ, so touching a file doesn't count as changing it.
+func (buf *EditorBuffer) changedOnDisk() bool {
+	if buf.Filename == "" {
+		return false
+	}
+	fi, err := os.Stat(buf.Filename)
+	if err != nil {
+		// It's gone; there's nothing to lose by writing it.
+		return false
+	}
+	if !buf.disk.exists {
+		return true
+	}
+	if fi.ModTime().Equal(buf.disk.modTime) && fi.Size() == buf.disk.size {
+		return false
+	}
+	if buf.large != nil {
+		// Too big to hash every time it changes.
+		return true
+	}
+	stamp, err := statFileStamp(buf.Filename)
+	if err != nil {
+		return false
+	}
+	if bytes.Equal(stamp.hash[:], buf.disk.hash[:]) {
+		buf.disk = stamp
+		return false
+	}
+	return true
+}
+
+// Reads the buffer's file again, as one undoable change so that point stays
+// on the same text.
+func revertBuffer(buf *EditorBuffer) error {
+	if buf.large != nil {
+		return revertLargeFile(buf)
+	}
+	lines, coding, stamp, err := readFileLines(buf.Filename)
+	if err != nil {
+		return err
+	}
+	cur, readOnly := Global.CurrentB, buf.ReadOnly
+	Global.CurrentB, buf.ReadOnly = buf, false
+	bufReplaceText(strings.Join(lines, "\n"))
+	Global.CurrentB, buf.ReadOnly = cur, readOnly
+	if buf.cy < buf.NumRows {
+		editorRowCxToRx(buf.row(buf.cy))
+	}
+	buf.coding = coding
+	buf.disk = stamp
+	buf.Dirty = false
+	buf.SaveUndo = buf.Undo
+	return nil
+}
+
+func doRevertBuffer() {
+	buf := Global.CurrentB
+	if buf.Filename == "" {
+		Global.Input = "Buffer is not visiting a file"
+		return
+	}
+	if buf.Dirty {
+		ok, err := editorYesNoPrompt("Discard edits and reread "+buf.getRenderName()+"?", false)
+		if err != nil || !ok {
+			return
+		}
+	}
+	if err := revertBuffer(buf); err != nil {
+		Global.Input = err.Error()
+		AddErrorMessage(err.Error())
+		return
+	}
+	Global.Input = "Reverted " + buf.getRenderName()
+}
+
+// How often buffers in auto-revert-mode look at their files.
+var autoRevertInterval = 2 * time.Second
+
+// Closed to stop the goroutine that polls for auto-revert-mode; nil when it
+// isn't running.
+var autoRevertStop chan struct{}
+
+// Starts polling files when the first buffer turns auto-revert-mode on, and
+// stops when no buffer has it on, so that the editor isn't woken up for
+// nothing. Called after every command, since that's when modes change.
+func updateAutoRevert() {
+	on := false
+	for _, buf := range Global.Buffers {
+		if buf.hasMode("auto-revert-mode") {
+			on = true
+			break
+		}
+	}
+	if on == (autoRevertStop != nil) {
+		return
+	}
+	if !on {
+		close(autoRevertStop)
+		autoRevertStop = nil
+		return
+	}
+	stop := make(chan struct{})
+	autoRevertStop = stop
+	go func() {
+		t := time.NewTicker(autoRevertInterval)
+		defer t.Stop()
+		// Holds a token while a poll is waiting to run, so that a long
+		// command doesn't leave a pile of them queued behind it.
+		queued := make(chan struct{}, 1)
+		for {
+			select {
+			case <-stop:
+				return
+			case <-t.C:
+				select {
+				case queued <- struct{}{}:
+					runOnMainLoop(func() {
+						<-queued
+						autoRevertBuffers()
+					})
+				default:
+				}
+			}
+		}
+	}()
+}
+
+// Rereads the files of unmodified buffers in auto-revert-mode that have
+// changed on disk. Buffers with edits are left alone; saving them will warn.
+func autoRevertBuffers() {
+	if commandRunning {
+		// Not under a command or its prompts; the next poll will do.
+		return
+	}
+	for _, buf := range Global.Buffers {
+		if buf.Filename == "" || buf.Dirty || !buf.hasMode("auto-revert-mode") {
+			continue
+		}
+		if !buf.changedOnDisk() {
+			continue
+		}
+		if err := revertBuffer(buf); err != nil {
+			AddErrorMessage(err.Error())
+			continue
+		}
+		Global.Input = "Reverted " + buf.getRenderName()
+	}
+}
@@ -0,0 +1,288 @@
+package main
+
+// A buffer's rows are kept in a rope: a balanced tree whose leaves hold runs
+// of rows and whose inner nodes know how many rows there are under them.
+// Getting, inserting or deleting a row costs the height of the tree rather
+// than the length of the buffer, and a row's index is worked out from where
+// it sits in the tree, so nothing is renumbered after an edit. The rows are
+// only ever reached through the methods in this file.
+
+const (
+	ropeLeafMax = 128 // Rows in a leaf before it's split
+	ropeNodeMax = 32  // Children of an inner node before it's split
+)
+
+type ropeNode struct {
+	parent   *ropeNode
+	count    int          // How many rows there are under this node
+	children []*ropeNode  // Set in inner nodes
+	rows     []*EditorRow // Set in leaves
+}
+
+type rowRope struct {
+	root *ropeNode
+	// The leaf last looked at and the index of its first row, so that going
+	// through the rows in order doesn't go down from the root for every one.
+	// Any change to the shape of the tree clears it.
+	leaf  *ropeNode
+	start int
+}
+
+func (n *ropeNode) isLeaf() bool {
+	return n.children == nil
+}
+
+// The number of rows in a leaf, or of children of an inner node.
+func (n *ropeNode) size() int {
+	if n.isLeaf() {
+		return len(n.rows)
+	}
+	return len(n.children)
+}
+
+func (n *ropeNode) maxSize() int {
+	if n.isLeaf() {
+		return ropeLeafMax
+	}
+	return ropeNodeMax
+}
+
+// Adds d to the count of n and of every node above it.
+func (n *ropeNode) addCount(d int) {
+	for ; n != nil; n = n.parent {
+		n.count += d
+	}
+}
+
+// Finds the leaf that holds row i, or that row i would be added to if i is
+// the number of rows, and the index of the first row in it.
+func (r *rowRope) find(i int) (*ropeNode, int) {
+	if r.leaf != nil && i >= r.start && i < r.start+len(r.leaf.rows) {
+		return r.leaf, r.start
+	}
+	if r.root == nil {
+		r.root = &ropeNode{}
+	}
+	n, start := r.root, 0
+	for !n.isLeaf() {
+		for j, child := range n.children {
+			if i < start+child.count || j == len(n.children)-1 {
+				n = child
+				break
+			}
+			start += child.count
+		}
+	}
+	r.leaf, r.start = n, start
+	return n, start
+}
+
+// Splits n into as many nodes as it takes for none of them to be more than
+// half full, so that there's room to add more before splitting again.
+func (r *rowRope) split(n *ropeNode) {
+	max := n.maxSize()
+	size := n.size()
+	if size <= max {
+		return
+	}
+	pieces := (size + max/2 - 1) / (max / 2)
+	nodes := make([]*ropeNode, pieces)
+	for p := range nodes {
+		lo, hi := size*p/pieces, size*(p+1)/pieces
+		m := &ropeNode{n.parent, 0, nil, nil}
+		if n.isLeaf() {
+			m.rows = append([]*EditorRow{}, n.rows[lo:hi]...)
+			for _, row := range m.rows {
+				row.leaf = m
+			}
+			m.count = len(m.rows)
+		} else {
+			m.children = append([]*ropeNode{}, n.children[lo:hi]...)
+			for _, child := range m.children {
+				child.parent = m
+				m.count += child.count
+			}
+		}
+		nodes[p] = m
+	}
+	parent := n.parent
+	if parent == nil {
+		parent = &ropeNode{nil, n.count, nodes, nil}
+		for _, m := range nodes {
+			m.parent = parent
+		}
+		r.root = parent
+	} else {
+		i := parent.childIndex(n)
+		children := make([]*ropeNode, 0, len(parent.children)+pieces-1)
+		children = append(children, parent.children[:i]...)
+		children = append(children, nodes...)
+		parent.children = append(children, parent.children[i+1:]...)
+	}
+	r.split(parent)
+}
+
+func (n *ropeNode) childIndex(child *ropeNode) int {
+	for i, c := range n.children {
+		if c == child {
+			return i
+		}
+	}
+	return -1
+}
+
+// Leaves an inner node with no children an inner node, so that shrink takes
+// it out of the tree too.
+func (n *ropeNode) removeChild(i int) {
+	copy(n.children[i:], n.children[i+1:])
+	n.children[len(n.children)-1] = nil
+	n.children = n.children[:len(n.children)-1]
+}
+
+// Takes n out of the tree if it's empty, or joins it onto its neighbour if
+// they're both small enough to fit in one node.
+func (r *rowRope) shrink(n *ropeNode) {
+	parent := n.parent
+	if parent == nil {
+		// Only the root can have a single child; take it out.
+		for !n.isLeaf() && len(n.children) == 1 {
+			n = n.children[0]
+			n.parent = nil
+		}
+		r.root = n
+		if n.size() == 0 {
+			r.root = nil
+		}
+		return
+	}
+	i := parent.childIndex(n)
+	if n.size() == 0 {
+		parent.removeChild(i)
+		r.shrink(parent)
+		return
+	}
+	if n.size() >= n.maxSize()/4 {
+		return
+	}
+	j := i + 1
+	if j == len(parent.children) {
+		i, j = i-1, i
+	}
+	if i < 0 {
+		r.shrink(parent)
+		return
+	}
+	left, right := parent.children[i], parent.children[j]
+	if left.size()+right.size() > left.maxSize() {
+		return
+	}
+	if left.isLeaf() {
+		for _, row := range right.rows {
+			row.leaf = left
+		}
+		left.rows = append(left.rows, right.rows...)
+	} else {
+		for _, child := range right.children {
+			child.parent = left
+		}
+		left.children = append(left.children, right.children...)
+	}
+	left.count += right.count
+	parent.removeChild(j)
+	r.shrink(parent)
+}
+
+// The row at index i of buf.
+func (buf *EditorBuffer) row(i int) *EditorRow {
+	leaf, start := buf.rows.find(i)
+	return leaf.rows[i-start]
+}
+
+// The index of row in its buffer, or -1 if it isn't in one.
+func (row *EditorRow) index() int {
+	if row.leaf == nil {
+		return -1
+	}
+	i := 0
+	for i < len(row.leaf.rows) && row.leaf.rows[i] != row {
+		i++
+	}
+	for n := row.leaf; n.parent != nil; n = n.parent {
+		for _, child := range n.parent.children {
+			if child == n {
+				break
+			}
+			i += child.count
+		}
+	}
+	return i
+}
+
+// Inserts rows into buf so that the first of them is at index at.
+func (buf *EditorBuffer) insertRows(at int, rows ...*EditorRow) {
+	if len(rows) == 0 {
+		return
+	}
+	r := &buf.rows
+	leaf, start := r.find(at)
+	off := at - start
+	all := make([]*EditorRow, 0, len(leaf.rows)+len(rows))
+	all = append(all, leaf.rows[:off]...)
+	all = append(all, rows...)
+	leaf.rows = append(all, leaf.rows[off:]...)
+	for _, row := range rows {
+		row.leaf = leaf
+	}
+	leaf.addCount(len(rows))
+	r.leaf = nil
+	r.split(leaf)
+	buf.NumRows = r.root.count
+}
+
+// Deletes the rows of buf from index from up to, but not including, to.
+func (buf *EditorBuffer) deleteRows(from, to int) {
+	r := &buf.rows
+	if to > buf.NumRows {
+		to = buf.NumRows
+	}
+	for from < to {
+		r.leaf = nil
+		leaf, start := r.find(from)
+		off, end := from-start, to-start
+		if end > len(leaf.rows) {
+			end = len(leaf.rows)
+		}
+		for _, row := range leaf.rows[off:end] {
+			row.leaf = nil
+		}
+		n := copy(leaf.rows[off:], leaf.rows[end:])
+		for i := off + n; i < len(leaf.rows); i++ {
+			leaf.rows[i] = nil
+		}
+		leaf.rows = leaf.rows[:off+n]
+		leaf.addCount(off - end)
+		to -= end - off
+		r.shrink(leaf)
+	}
+	r.leaf = nil
+	buf.NumRows = 0
+	if r.root != nil {
+		buf.NumRows = r.root.count
+	}
+}
+
+// Replaces all the rows of buf.
+func (buf *EditorBuffer) setRows(rows []*EditorRow) {
+	buf.rows = rowRope{}
+	buf.NumRows = 0
+	buf.insertRows(0, rows...)
+}
+
+// The text of each row of buf.
+func (buf *EditorBuffer) lines() []string {
+	ret := make([]string, buf.NumRows)
+	for i := range ret {
+		ret[i] = buf.row(i).Data
+	}
+	return ret
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"math/rand"
+	"strconv"
+	"testing"
+)
+
+// Makes the same random edits to a buffer and to a plain slice, and checks
+// that they stay the same.
+func TestRowRope(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	buf := &EditorBuffer{}
+	var want []string
+	n := 0
+	mkrows := func(k int) ([]*EditorRow, []string) {
+		rows := make([]*EditorRow, k)
+		lines := make([]string, k)
+		for i := range rows {
+			n++
+			lines[i] = strconv.Itoa(n)
+			rows[i] = &EditorRow{Data: lines[i]}
+		}
+		return rows, lines
+	}
+	for step := 0; step < 3000; step++ {
+		if r.Intn(2) == 0 || len(want) == 0 {
+			at := r.Intn(len(want) + 1)
+			rows, lines := mkrows(1 + r.Intn(300))
+			buf.insertRows(at, rows...)
+			want = append(want[:at], append(lines, want[at:]...)...)
+		} else {
+			from := r.Intn(len(want))
+			to := from + r.Intn(len(want)-from+1)
+			buf.deleteRows(from, to)
+			want = append(want[:from], want[to:]...)
+		}
+		if buf.NumRows != len(want) {
+			t.Fatalf("step %d: %d rows, want %d", step, buf.NumRows, len(want))
+		}
+		for i := 0; i < len(want); i += 1 + r.Intn(50) {
+			row := buf.row(i)
+			if row.Data != want[i] || row.index() != i {
+				t.Fatalf("step %d: row %d is %q at %d, want %q", step, i, row.Data, row.index(), want[i])
+			}
+		}
+	}
+	buf.setRows(nil)
+	if buf.NumRows != 0 {
+		t.Errorf("%d rows after setRows(nil)", buf.NumRows)
+	}
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/zhemao/glisp/interpreter"
+)
+
+// Backup settings, set from lisp. The first time a buffer is saved, the file
+// as it was is copied to file~, or with numbered backups to file.~1~,
+// file.~2~ and so on. versionControl is "never" for file~, "numbered" for
+// numbered backups, or "existing" for numbered backups of files that already
+// have them.
+var makeBackupFiles = false
+var backupDirectory = "" // Put backups here rather than next to the file
+var versionControl = "existing"
+
+// Writes data to fn by way of a temporary file in the same directory, so
+// that fn always holds either the old contents or the new ones. If fn is a
+// symlink, the file it points to is the one written.
+func saveFile(buf *EditorBuffer, fn string, data []byte) error {
+	target := fn
+	if resolved, err := filepath.EvalSymlinks(fn); err == nil {
+		target = resolved
+	} else if link, err := os.Readlink(fn); err == nil {
+		// A symlink to a file that doesn't exist yet.
+		if !filepath.IsAbs(link) {
+			link = filepath.Join(filepath.Dir(fn), link)
+		}
+		target = link
+	}
+	fi, err := os.Stat(target)
+	if err != nil {
+		fi = nil
+	}
+	if makeBackupFiles && !buf.backedUp && fi != nil && fi.Mode().IsRegular() {
+		if err := makeBackup(target, fi); err != nil {
+			AddErrorMessage("Couldn't make a backup of " + target + ": " + err.Error())
+		}
+		buf.backedUp = true
+	}
+	return writeFileAtomic(target, data, fi)
+}
+
+// The new contents are written to a temporary file that's then renamed over
+// fn. That would break fn away from its other hard links, or leave it owned
+// by us rather than its owner, so in those cases fn is written in place.
+func writeFileAtomic(fn string, data []byte, fi os.FileInfo) error {
+	if fi != nil && hasOtherLinks(fi) {
+		return writeFileInPlace(fn, data)
+	}
+	dir, base := filepath.Split(fn)
+	var f *os.File
+	var tmp string
+	var err error
+	for i := 0; ; i++ {
+		tmp = filepath.Join(dir, fmt.Sprintf(".%s.%d-%d.tmp", base, os.Getpid(), i))
+		f, err = os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+		if !os.IsExist(err) {
+			break
+		}
+	}
+	if err != nil {
+		if os.IsPermission(err) && fi != nil {
+			// We can write the file but not the directory it's in.
+			return writeFileInPlace(fn, data)
+		}
+		return err
+	}
+	if fi != nil {
+		if copyOwner(f, fi) != nil {
+			f.Close()
+			os.Remove(tmp)
+			return writeFileInPlace(fn, data)
+		}
+		// After the chown, which clears the setuid and setgid bits.
+		err = f.Chmod(fi.Mode() & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky))
+	}
+	if err == nil {
+		_, err = f.Write(data)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, fn)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	// Make sure the rename itself is on disk.
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	return nil
+}
+
+func writeFileInPlace(fn string, data []byte) error {
+	f, err := os.OpenFile(fn, os.O_WRONLY|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// Returns where backups of fn go, without the ~ or .~N~ on the end.
+func backupPrefix(fn string) (string, error) {
+	if backupDirectory == "" {
+		return fn, nil
+	}
+	dir, err := AbsPath(backupDirectory)
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	// The whole path goes into the name, so files with the same name in
+	// different directories don't clash.
+	return filepath.Join(dir, strings.Replace(fn, string(filepath.Separator), "!", -1)), nil
+}
+
+var backupVersionRegexp = regexp.MustCompile(`\.~([0-9]+)~$`)
+var globMetaRegexp = regexp.MustCompile(`[*?\[\\]`)
+
+// Returns the highest N of the numbered backups prefix.~N~ there are.
+func lastBackupVersion(prefix string) int {
+	matches, _ := filepath.Glob(globMetaRegexp.ReplaceAllString(prefix, `\$0`) + ".~*~")
+	ret := 0
+	for _, m := range matches {
+		if sub := backupVersionRegexp.FindStringSubmatch(m); sub != nil {
+			if n, _ := strconv.Atoi(sub[1]); n > ret {
+				ret = n
+			}
+		}
+	}
+	return ret
+}
+
+func makeBackup(fn string, fi os.FileInfo) error {
+	prefix, err := backupPrefix(fn)
+	if err != nil {
+		return err
+	}
+	name := prefix + "~"
+	last := lastBackupVersion(prefix)
+	if versionControl == "numbered" || (versionControl == "existing" && last > 0) {
+		name = fmt.Sprintf("%s.~%d~", prefix, last+1)
+	}
+	return copyFile(fn, name, fi.Mode())
+}
+
+func lispSetMakeBackupFiles(env *glisp.Glisp, name string, args []glisp.Sexp) (glisp.Sexp, error) {
+	if len(args) != 1 {
+		return glisp.SexpNull, glisp.WrongNargs
+	}
+	switch t := args[0].(type) {
+	case glisp.SexpBool:
+		makeBackupFiles = bool(t)
+	default:
+		return glisp.SexpNull, errors.New("Arg 1 needs to be a bool")
+	}
+	return glisp.SexpNull, nil
+}
+
+func lispSetBackupDirectory(env *glisp.Glisp, name string, args []glisp.Sexp) (glisp.Sexp, error) {
+	if len(args) != 1 {
+		return glisp.SexpNull, glisp.WrongNargs
+	}
+	switch t := args[0].(type) {
+	case glisp.SexpStr:
+		backupDirectory = string(t)
+	default:
+		return glisp.SexpNull, errors.New("Arg 1 needs to be a string")
+	}
+	return glisp.SexpNull, nil
+}
+
+func lispSetVersionControl(env *glisp.Glisp, name string, args []glisp.Sexp) (glisp.Sexp, error) {
+	if len(args) != 1 {
+		return glisp.SexpNull, glisp.WrongNargs
+	}
+	switch t := args[0].(type) {
+	case glisp.SexpStr:
+		switch string(t) {
+		case "never", "existing", "numbered":
+			versionControl = string(t)
+		default:
+			return glisp.SexpNull, errors.New("version-control needs to be \"never\", \"existing\" or \"numbered\"")
+		}
+	default:
+		return glisp.SexpNull, errors.New("Arg 1 needs to be a string")
+	}
+	return glisp.SexpNull, nil
+}
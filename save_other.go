@@ -0,0 +1,16 @@
+// +build android plan9 nacl windows
+
+package main
+
+import (
+	"os"
+)
+
+// Files have no owners to keep here.
+func copyOwner(f *os.File, fi os.FileInfo) error {
+	return nil
+}
+
+func hasOtherLinks(fi os.FileInfo) bool {
+	return false
+}
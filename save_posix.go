@@ -0,0 +1,24 @@
+// +build linux darwin dragonfly solaris openbsd netbsd freebsd
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// Gives f the owner and group of the file fi describes, so that saving a
+// file someone else owns (as root, say) doesn't take it over.
+func copyOwner(f *os.File, fi os.FileInfo) error {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return nil
+	}
+	return f.Chown(int(st.Uid), int(st.Gid))
+}
+
+// Reports whether the file fi describes has other names besides this one.
+func hasOtherLinks(fi os.FileInfo) bool {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	return ok && st.Nlink > 1
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/japanoise/termbox-util"
+	"github.com/nsf/termbox-go"
+)
+
+// Screen is everything the editor needs from the display. The real editor
+// draws on the terminal through termbox; the headless harness draws on a
+// VirtualScreen so that the rendered cells can be inspected.
+type Screen interface {
+	Init() error
+	Close()
+	Size() (int, int)
+	Clear()
+	SetCell(x, y int, ru rune, fg, bg termbox.Attribute)
+	SetCursor(x, y int)
+	HideCursor()
+	Flush()
+	SetTitle(title string)
+}
+
+// KeySource is where the editor gets its key presses from. Keys are strings
+// in the usual emacs notation (see HACKING.md); PollKey returns "" when the
+// screen has been resized and needs redrawing, or when it was woken up by
+// Interrupt.
+type KeySource interface {
+	PollKey() string
+	Interrupt()
+}
+
+var screen Screen = &termboxScreen{}
+var keysrc KeySource = termboxKeys{}
+
+// The termbox-backed screen and keyboard used when running in a terminal.
+type termboxScreen struct{}
+
+func (t *termboxScreen) Init() error {
+	err := termbox.Init()
+	if err != nil {
+		return err
+	}
+	termbox.SetInputMode(termbox.InputAlt | termbox.InputMouse)
+	return nil
+}
+
+func (t *termboxScreen) Close() {
+	termbox.Close()
+}
+
+func (t *termboxScreen) Size() (int, int) {
+	return termbox.Size()
+}
+
+func (t *termboxScreen) Clear() {
+	termbox.Clear(termbox.ColorDefault, termbox.ColorDefault)
+}
+
+func (t *termboxScreen) SetCell(x, y int, ru rune, fg, bg termbox.Attribute) {
+	termbox.SetCell(x, y, ru, fg, bg)
+}
+
+func (t *termboxScreen) SetCursor(x, y int) {
+	termbox.SetCursor(x, y)
+}
+
+func (t *termboxScreen) HideCursor() {
+	termbox.HideCursor()
+}
+
+func (t *termboxScreen) Flush() {
+	termbox.Flush()
+}
+
+func (t *termboxScreen) SetTitle(title string) {
+	terminalTitle(title)
+}
+
+type termboxKeys struct{}
+
+// Interrupt may be called from any goroutine.
+func (t termboxKeys) Interrupt() {
+	termbox.Interrupt()
+}
+
+func (t termboxKeys) PollKey() string {
+	for {
+		ev := termbox.PollEvent()
+		if ev.Type == termbox.EventResize || ev.Type == termbox.EventInterrupt {
+			return ""
+		} else if ev.Type == termbox.EventKey {
+			return ParseTermboxEvent(ev)
+		} else if ev.Type == termbox.EventMouse {
+			return ParseMouseEvent(ev)
+		}
+	}
+}
+
+// VirtualScreen is an in-memory Screen. Nothing is shown anywhere; the cells
+// are kept so they can be compared against what was expected.
+type VirtualScreen struct {
+	Width, Height    int
+	Cells            []termbox.Cell
+	CursorX, CursorY int
+	Title            string
+}
+
+func NewVirtualScreen(width, height int) *VirtualScreen {
+	ret := &VirtualScreen{Width: width, Height: height}
+	ret.Cells = make([]termbox.Cell, width*height)
+	ret.Clear()
+	return ret
+}
+
+func (v *VirtualScreen) Init() error {
+	return nil
+}
+
+func (v *VirtualScreen) Close() {}
+
+func (v *VirtualScreen) Size() (int, int) {
+	return v.Width, v.Height
+}
+
+func (v *VirtualScreen) Clear() {
+	for i := range v.Cells {
+		v.Cells[i] = termbox.Cell{Ch: ' ', Fg: termbox.ColorDefault, Bg: termbox.ColorDefault}
+	}
+}
+
+func (v *VirtualScreen) SetCell(x, y int, ru rune, fg, bg termbox.Attribute) {
+	if x < 0 || x >= v.Width || y < 0 || y >= v.Height {
+		return
+	}
+	v.Cells[y*v.Width+x] = termbox.Cell{Ch: ru, Fg: fg, Bg: bg}
+}
+
+func (v *VirtualScreen) SetCursor(x, y int) {
+	v.CursorX, v.CursorY = x, y
+}
+
+func (v *VirtualScreen) HideCursor() {
+	v.CursorX, v.CursorY = -1, -1
+}
+
+func (v *VirtualScreen) Flush() {}
+
+func (v *VirtualScreen) SetTitle(title string) {
+	v.Title = title
+}
+
+// CellAt returns the cell at x, y.
+func (v *VirtualScreen) CellAt(x, y int) termbox.Cell {
+	return v.Cells[y*v.Width+x]
+}
+
+// Line returns row y of the screen as a string with trailing spaces removed.
+func (v *VirtualScreen) Line(y int) string {
+	var buffer bytes.Buffer
+	for x := 0; x < v.Width; x++ {
+		buffer.WriteRune(v.CellAt(x, y).Ch)
+	}
+	return strings.TrimRight(buffer.String(), " ")
+}
+
+// String returns the whole screen, one line per row; handy for golden files.
+func (v *VirtualScreen) String() string {
+	lines := make([]string, v.Height)
+	for y := range lines {
+		lines[y] = v.Line(y)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// ScriptedKeys is a KeySource that plays back a fixed key sequence.
+type ScriptedKeys struct {
+	Keys []string
+	pos  int
+}
+
+// NewScriptedKeys parses a sequence like "C-x C-f foo RET C-k". Tokens that
+// are key names (C-x, M-%, RET, f1, a single character...) are used as they
+// are; any other word is typed out one character at a time. SPC is a space.
+// Text in double quotes is always typed out, spaces and all, so `"RET"`
+// types the three letters rather than pressing return; \" and \\ in it are a
+// quote and a backslash.
+func NewScriptedKeys(seq string) *ScriptedKeys {
+	ret := &ScriptedKeys{}
+	for len(seq) > 0 {
+		seq = strings.TrimLeft(seq, " \t\n")
+		if seq == "" {
+			break
+		}
+		if seq[0] == '"' {
+			var text string
+			text, seq = scanQuoted(seq[1:])
+			ret.typeText(text)
+			continue
+		}
+		tok := seq
+		if i := strings.IndexAny(seq, " \t\n"); i >= 0 {
+			tok, seq = seq[:i], seq[i:]
+		} else {
+			seq = ""
+		}
+		if tok == "SPC" {
+			ret.Keys = append(ret.Keys, " ")
+		} else if isKeyName(tok) {
+			ret.Keys = append(ret.Keys, tok)
+		} else {
+			ret.typeText(tok)
+		}
+	}
+	return ret
+}
+
+// Returns the text up to the closing quote of a quoted string that has had
+// its opening quote taken off, and whatever comes after it.
+func scanQuoted(s string) (string, string) {
+	var buffer bytes.Buffer
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '"':
+			return buffer.String(), s[i+1:]
+		case '\\':
+			if i+1 < len(s) {
+				i++
+			}
+		}
+		buffer.WriteByte(s[i])
+	}
+	return buffer.String(), ""
+}
+
+func (s *ScriptedKeys) typeText(text string) {
+	for _, ru := range text {
+		s.Keys = append(s.Keys, string(ru))
+	}
+}
+
+var namedKeys = map[string]bool{
+	"RET": true, "TAB": true, "DEL": true, "ESC": true, "LEFT": true,
+	"RIGHT": true, "UP": true, "DOWN": true, "Home": true, "End": true,
+	"next": true, "prior": true, "deletechar": true, "insert": true,
+}
+
+func isKeyName(tok string) bool {
+	if utf8.RuneCountInString(tok) == 1 || namedKeys[tok] {
+		return true
+	}
+	if strings.HasPrefix(tok, "C-") || strings.HasPrefix(tok, "M-") {
+		return true
+	}
+	return tok[0] == 'f' && len(tok) <= 3 && strings.Trim(tok[1:], "0123456789") == ""
+}
+
+// PollKey returns the next scripted key. Once the script runs dry it returns
+// C-g, so that a prompt waiting for more input is cancelled instead of
+// blocking forever.
+func (s *ScriptedKeys) PollKey() string {
+	if s.Done() {
+		return "C-g"
+	}
+	s.pos++
+	return s.Keys[s.pos-1]
+}
+
+// Interrupt does nothing; PollKey never waits.
+func (s *ScriptedKeys) Interrupt() {}
+
+// Done reports whether every key in the script has been read.
+func (s *ScriptedKeys) Done() bool {
+	return s.pos >= len(s.Keys)
+}
+
+func printString(s string, x, y int) {
+	printStringColored(termbox.ColorDefault, s, x, y)
+}
+
+func printStringColored(color termbox.Attribute, s string, x, y int) {
+	for _, ru := range s {
+		printRune(x, y, ru, color)
+		x += termutil.Runewidth(ru)
+	}
+}
+
+func printRune(x, y int, ru rune, color termbox.Attribute) {
+	screen.SetCell(x, y, ru, color, termbox.ColorDefault)
+}
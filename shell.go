@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 	"io"
+	"os"
 	"os/exec"
 	"strings"
 
@@ -13,28 +14,69 @@ func shellCmd(com string, args []string) (string, error) {
 	cmd := exec.Command(com, args...)
 	out, err := cmd.CombinedOutput()
 	// Gomacs doesn't like trailing newlines; strip 'em
-	if out[len(out)-1] == '\n' {
+	if len(out) > 0 && out[len(out)-1] == '\n' {
 		out = out[:len(out)-1]
 	}
 	return string(out), err
 }
 
 func shellCmdAction(com string, args []string) {
+	if !Global.SetUniversal {
+		startShellCommand(com, args, nil)
+		return
+	}
 	result, err := shellCmd(com, args)
 	if err == nil {
-		if Global.SetUniversal {
-			spitRegion(Global.CurrentB.cx, Global.CurrentB.cy, result)
-		} else {
-			showMessages(result)
-		}
+		spitRegion(Global.CurrentB.cx, Global.CurrentB.cy, result)
 	} else {
-		if Global.SetUniversal {
-			spitRegion(Global.CurrentB.cx, Global.CurrentB.cy, err.Error()+"\n"+result)
-		} else {
-			showMessages(err.Error() + "\n" + result)
+		spitRegion(Global.CurrentB.cx, Global.CurrentB.cy, err.Error()+"\n"+result)
+		AddErrorMessage(err.Error())
+	}
+}
+
+// Runs com in the background, showing its output in the *Shell Command
+// Output* buffer as it arrives. If input isn't nil it is fed to the command.
+func startShellCommand(com string, args []string, input *string) {
+	buf := getOutputBuffer("*Shell Command Output*")
+	if p := getBufferProcess(buf); p != nil {
+		kill, _ := editorYesNoPrompt("A command is running in the shell command output buffer; kill it?", false)
+		if !kill {
+			return
 		}
+		p.Sentinel = nil
+		p.Buffer = nil
+		p.Kill()
+	}
+	dir := currentDirectory()
+	buf.Dir = dir
+	buf.setLines([]string{})
+	p, err := startProcess("Shell", buf, dir, com, args...)
+	if err != nil {
+		Global.Input = err.Error()
 		AddErrorMessage(err.Error())
+		return
 	}
+	if input != nil {
+		p.Send(*input)
+	}
+	p.SendEOF()
+	p.Sentinel = func(p *Process, event string) {
+		if p.Buffer == nil || !bufferExists(p.Buffer) {
+			return
+		}
+		if p.ExitCode == 0 && p.Status == "exit" {
+			if BufferString(p.Buffer) == "" {
+				Global.Input = "(Shell command succeeded with no output)"
+			} else {
+				Global.Input = "Shell command finished"
+			}
+		} else {
+			Global.Input = "Shell command " + strings.TrimSpace(event)
+			AddErrorMessage(Global.Input)
+		}
+	}
+	displayBuffer(buf)
+	Global.Input = "Running " + com
 }
 
 func doShellCmd() {
@@ -60,7 +102,7 @@ func shellCmdWithInput(input, com string, args []string) (string, error) {
 		io.WriteString(stdin, input)
 	}()
 	out, err := cmd.CombinedOutput()
-	if out[len(out)-1] == '\n' {
+	if len(out) > 0 && out[len(out)-1] == '\n' {
 		out = out[:len(out)-1]
 	}
 	return string(out), err
@@ -78,12 +120,8 @@ func shellCmdRegion(com string, args []string) {
 		})
 	} else {
 		regionCmd(func(buf *EditorBuffer, startc, endc, startl, endl int) string {
-			result, err := shellCmdWithInput(getRegionText(buf, startc, endc, startl, endl), com, args)
-			if err == nil {
-				showMessages(result)
-			} else {
-				showMessages(err.Error() + "\n" + result)
-			}
+			input := getRegionText(buf, startc, endc, startl, endl)
+			startShellCommand(com, args, &input)
 			return ""
 		})
 	}
@@ -104,34 +142,241 @@ func replaceBufferWithShellCommand(buf *EditorBuffer, com string, args []string,
 	if buf.NumRows == 0 {
 		return
 	}
-	output, err := shellCmdWithInput(getRegionText(buf, 0, buf.Rows[buf.NumRows-1].Size, 0, buf.NumRows-1), com, args)
+	output, err := shellCmdWithInput(getRegionText(buf, 0, buf.row(buf.NumRows-1).Size, 0, buf.NumRows-1), com, args)
 	if err != nil {
-		showMessages(err.Error(), output)
+		showOutput("*Shell Command Output*", err.Error(), output)
 		return
 	}
-	lines := strings.Split(output, "\n")
-	ll := len(lines)
-	buf.Rows = make([]*EditorRow, ll)
-	buf.NumRows = ll
-	for i, line := range lines {
-		newrow := &EditorRow{}
-		newrow.Data = line
-		newrow.idx = i
-		newrow.Size = len(line)
-		rowUpdateRender(newrow)
-		buf.Rows[i] = newrow
-	}
-	if buf.Highlighter != nil {
-		buf.Highlight()
-	}
-	buf.Undo = nil
-	buf.Redo = nil
-	if buf.cy >= buf.NumRows {
-		buf.cy = buf.NumRows - 1
-	}
-	if buf.cx >= buf.Rows[buf.cy].Size {
-		buf.cx = buf.Rows[buf.cy].Size
-	}
-	editorRowCxToRx(buf.Rows[buf.cy])
+	cur := Global.CurrentB
+	Global.CurrentB = buf
+	bufReplaceText(output)
+	Global.CurrentB = cur
+	if buf.cy < buf.NumRows {
+		editorRowCxToRx(buf.row(buf.cy))
+	}
 	editorBufSave(buf, env)
 }
+
+// A comint buffer runs an interactive process. Its output is added to the
+// buffer before the input being typed; everything after the end of the last
+// output is input, sent with RET.
+type comint struct {
+	proc    *Process
+	buf     *EditorBuffer
+	markx   int // Where the last output ended and the input starts
+	marky   int
+	history []string
+	histpos int
+}
+
+var comints = map[*EditorBuffer]*comint{}
+
+// Keeps the input start within the buffer, in case text before it has been
+// deleted.
+func (c *comint) clampMark() {
+	buf := c.buf
+	if buf.NumRows == 0 {
+		c.markx, c.marky = 0, 0
+		return
+	}
+	if c.marky >= buf.NumRows {
+		c.marky = buf.NumRows - 1
+		c.markx = buf.row(c.marky).Size
+	}
+	if c.markx > buf.row(c.marky).Size {
+		c.markx = buf.row(c.marky).Size
+	}
+}
+
+// Returns the input typed after the last output.
+func (c *comint) pendingInput() string {
+	c.clampMark()
+	buf := c.buf
+	if buf.NumRows == 0 {
+		return ""
+	}
+	return getRegionText(buf, c.markx, buf.row(buf.NumRows-1).Size, c.marky, buf.NumRows-1)
+}
+
+// Removes the pending input from the buffer.
+func (c *comint) cutInput() {
+	c.clampMark()
+	buf := c.buf
+	if buf.NumRows == 0 {
+		return
+	}
+	buf.deleteRows(c.marky+1, buf.NumRows)
+	row := buf.row(c.marky)
+	row.Data = row.Data[:c.markx]
+	row.Size = len(row.Data)
+	rowUpdateRender(row, buf)
+}
+
+// Replaces the pending input with text, leaving point at the end of it.
+func (c *comint) setInput(text string) {
+	c.cutInput()
+	c.buf.appendText(text)
+	c.buf.cy = c.buf.NumRows - 1
+	c.buf.cx = c.buf.row(c.buf.cy).Size
+	c.buf.prefcx = c.buf.cx
+}
+
+func (c *comint) output(text string) {
+	buf := c.buf
+	if !bufferExists(buf) {
+		return
+	}
+	input := c.pendingInput()
+	// Where point is, relative to the start of the input.
+	ininput := buf.cy > c.marky || (buf.cy == c.marky && buf.cx >= c.markx)
+	dy := buf.cy - c.marky
+	dx := buf.cx
+	if dy == 0 {
+		dx -= c.markx
+	}
+	c.cutInput()
+	oldy, oldx := c.marky, c.markx
+	buf.appendText(text)
+	if buf.NumRows > 0 {
+		c.marky = buf.NumRows - 1
+		c.markx = buf.row(c.marky).Size
+	}
+	buf.appendText(input)
+	if ininput {
+		buf.cy = c.marky + dy
+		buf.cx = dx
+		if dy == 0 {
+			buf.cx += c.markx
+		}
+		buf.prefcx = buf.cx
+	}
+	// The input has moved, and so have the edits made to it.
+	buf.shiftUndo(oldy, oldx, c.marky, c.markx)
+	buf.Dirty = false
+}
+
+// Sends the input after the last output, or if point is back in the output,
+// the line point is on.
+func (c *comint) sendInput() {
+	buf := c.buf
+	c.clampMark()
+	var input string
+	if buf.cy < c.marky || (buf.cy == c.marky && buf.cx < c.markx) {
+		input = buf.row(buf.cy).Data
+		if buf.cy == c.marky {
+			input = input[:c.markx]
+		}
+		c.setInput(input)
+	} else {
+		input = c.pendingInput()
+	}
+	buf.appendText("\n")
+	c.marky = buf.NumRows - 1
+	c.markx = 0
+	buf.cy, buf.cx, buf.prefcx = c.marky, 0, 0
+	buf.Dirty = false
+	if input != "" && (len(c.history) == 0 || c.history[len(c.history)-1] != input) {
+		c.history = append(c.history, input)
+	}
+	c.histpos = 0
+	if err := c.proc.Send(input + "\n"); err != nil {
+		Global.Input = err.Error()
+	}
+}
+
+// Steps through the input history; dir is 1 for older, -1 for newer.
+func (c *comint) recallInput(dir int) {
+	pos := c.histpos + dir
+	if pos < 0 || pos > len(c.history) {
+		Global.Input = "No more history"
+		return
+	}
+	c.histpos = pos
+	if pos == 0 {
+		c.setInput("")
+	} else {
+		c.setInput(c.history[len(c.history)-pos])
+	}
+}
+
+// Starts an interactive shell in the buffer called name, or switches to it if
+// it already has one running.
+func startShell(name string) {
+	buf := findBufferByName(name)
+	if buf != nil {
+		if c := comints[buf]; c != nil && getBufferProcess(buf) == c.proc {
+			switchToBuffer(buf)
+			return
+		}
+	} else {
+		buf = getSpecialBuffer(name)
+	}
+	shell := os.Getenv("SHELL")
+	if shell == "" {
+		shell = "/bin/sh"
+	}
+	dir := currentDirectory()
+	buf.MajorMode = "shell"
+	buf.Dir = dir
+	buf.setLines([]string{})
+	p, err := startProcessEnv(strings.Trim(name, "*"), buf, dir, []string{"TERM=dumb", "PAGER=cat"}, shell, "-i")
+	if err != nil {
+		Global.Input = err.Error()
+		AddErrorMessage(err.Error())
+		return
+	}
+	c := &comint{p, buf, 0, 0, []string{}, 0}
+	comints[buf] = c
+	p.Filter = func(p *Process, output string) { c.output(output) }
+	p.Sentinel = func(p *Process, event string) {
+		c.output("\nProcess " + p.Name + " " + event)
+		delete(comints, c.buf)
+	}
+	switchToBuffer(buf)
+}
+
+func doShell() {
+	name := "*shell*"
+	if Global.SetUniversal {
+		name = editorPrompt("Shell buffer (blank for *shell*)", nil)
+		if name == "" {
+			name = "*shell*"
+		}
+	}
+	startShell(name)
+}
+
+// Runs f with the comint of the current buffer, if it has one with a live
+// process.
+func withComint(f func(c *comint)) {
+	c := comints[Global.CurrentB]
+	if c == nil || getBufferProcess(Global.CurrentB) != c.proc {
+		Global.Input = "Current buffer has no process"
+		return
+	}
+	f(c)
+}
+
+func comintSendInput() {
+	withComint(func(c *comint) { c.sendInput() })
+}
+
+func comintPreviousInput() {
+	withComint(func(c *comint) { c.recallInput(1) })
+}
+
+func comintNextInput() {
+	withComint(func(c *comint) { c.recallInput(-1) })
+}
+
+func comintInterrupt() {
+	withComint(func(c *comint) {
+		if err := c.proc.Interrupt(); err != nil {
+			Global.Input = err.Error()
+		}
+	})
+}
+
+func comintSendEOF() {
+	withComint(func(c *comint) { c.proc.SendEOF() })
+}
@@ -4,13 +4,11 @@ package main
 
 import (
 	"syscall"
-
-	"github.com/nsf/termbox-go"
 )
 
 func suspend() {
 	// finalize termbox
-	termbox.Close()
+	screen.Close()
 
 	// suspend the process
 	pid := syscall.Getpid()
@@ -20,10 +18,9 @@ func suspend() {
 	}
 
 	// reset the state so we can get back to work again
-	err = termbox.Init()
+	err = screen.Init()
 	if err != nil {
 		panic(err)
 	}
-	termbox.SetInputMode(termbox.InputAlt)
 	editorRefreshScreen()
 }
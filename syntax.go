@@ -1,6 +1,7 @@
 package main
 
 import (
+	"sort"
 	"strings"
 
 	"github.com/japanoise/termbox-util"
@@ -13,7 +14,7 @@ var defs []*highlight.Def
 
 // These functions implement highlight's LineStates interface for EditorBuffer
 func (buf *EditorBuffer) Line(n int) string {
-	return buf.Rows[n].Render
+	return buf.row(n).Render
 }
 
 func (buf *EditorBuffer) LinesNum() int {
@@ -21,15 +22,15 @@ func (buf *EditorBuffer) LinesNum() int {
 }
 
 func (buf *EditorBuffer) State(n int) highlight.State {
-	return buf.Rows[n].HlState
+	return buf.row(n).HlState
 }
 
 func (buf *EditorBuffer) SetState(n int, s highlight.State) {
-	buf.Rows[n].HlState = s
+	buf.row(n).HlState = s
 }
 
 func (buf *EditorBuffer) SetMatch(n int, m highlight.LineMatch) {
-	buf.Rows[n].HlMatches = m
+	buf.row(n).HlMatches = m
 }
 
 // End interface functions
@@ -69,21 +70,26 @@ func getColorForGroup(group highlight.Group) termbox.Attribute {
 }
 
 func (row *EditorRow) Print(x, y, offset, runeoff int, ts string, buf *EditorBuffer) {
-	if buf.regionActive && buf.region.startl <= row.idx && row.idx < buf.region.endl {
-		sx, _ := termbox.Size()
+	at := row.index()
+	if buf.regionActive && buf.region.startl <= at && at < buf.region.endl {
+		sx, _ := screen.Size()
 		for i := x; i <= sx; i++ {
-			termbox.SetCell(i, y, ' ', termbox.AttrReverse, termbox.ColorDefault)
+			screen.SetCell(i, y, ' ', termbox.AttrReverse, termbox.ColorDefault)
 		}
-		if buf.region.startl < row.idx {
-			termutil.PrintstringColored(termbox.AttrReverse, ts, x, y)
+		if buf.region.startl < at {
+			printStringColored(termbox.AttrReverse, ts, x, y)
 			return
 		}
 	}
+	var hits [][]int
+	if isearch != nil && buf == Global.CurrentB {
+		hits = isearch.renderMatches(row)
+	}
 	color := termbox.ColorDefault
 	os := 0
 	ri := 0
 	for in, ru := range ts {
-		if Global.NoSyntax || buf.Highlighter == nil {
+		if buf.syntaxOff() || buf.Highlighter == nil {
 			color = termbox.ColorDefault
 		} else if group, ok := row.HlMatches[ri+offset]; ok {
 			color = getColorForGroup(group)
@@ -100,17 +106,25 @@ func (row *EditorRow) Print(x, y, offset, runeoff int, ts string, buf *EditorBuf
 		// 2nd line is "If the start & end are the same, and we're in between the first and last character"
 		// 3rd line is "If the start & end are not the same and we're within the region"
 		if buf.regionActive &&
-			((row.idx == buf.region.startl && buf.region.startl == buf.region.endl && offset+os < buf.region.endc && offset+os >= buf.region.startc) ||
-				(buf.region.startl != buf.region.endl && ((row.idx == buf.region.startl && offset+os >= buf.region.startc) || (row.idx == buf.region.endl && offset+os < buf.region.endc)))) {
-			termutil.PrintRune(x+os, y, ru, termbox.AttrReverse)
+			((at == buf.region.startl && buf.region.startl == buf.region.endl && offset+os < buf.region.endc && offset+os >= buf.region.startc) ||
+				(buf.region.startl != buf.region.endl && ((at == buf.region.startl && offset+os >= buf.region.startc) || (at == buf.region.endl && offset+os < buf.region.endc)))) {
+			printRune(x+os, y, ru, termbox.AttrReverse)
+		} else if inSearchHit(hits, ri+offset) {
+			printRune(x+os, y, ru, getColorForGroup(255))
 		} else {
-			termutil.PrintRune(x+os, y, ru, color)
+			printRune(x+os, y, ru, color)
 		}
 		os += termutil.Runewidth(ru)
 		ri++
 	}
 }
 
+// hits are in order, so a long line full of them can be searched quickly.
+func inSearchHit(hits [][]int, ri int) bool {
+	i := sort.Search(len(hits), func(i int) bool { return hits[i][1] > ri })
+	return i < len(hits) && hits[i][0] <= ri
+}
+
 func LoadSyntaxDefs() {
 	for _, fname := range AssetNames() {
 		if strings.HasSuffix(fname, ".yaml") {
@@ -128,7 +142,7 @@ func LoadSyntaxDefs() {
 func editorSelectSyntaxHighlight(buf *EditorBuffer, env *glisp.Glisp) {
 	var first []byte
 	if buf.NumRows > 0 {
-		first = []byte(buf.Rows[0].Data)
+		first = []byte(buf.row(0).Data)
 	}
 	buf.Highlighter = highlight.NewHighlighter(highlight.DetectFiletype(defs, buf.Filename, first))
 	if buf.Highlighter != nil {
@@ -137,5 +151,24 @@ func editorSelectSyntaxHighlight(buf *EditorBuffer, env *glisp.Glisp) {
 	} else {
 		buf.MajorMode = "Unknown"
 	}
+	if buf.Highlighter != nil && buf.hasLongLines() {
+		// The highlighter's regexps would take too long on lines like these.
+		buf.Highlighter = nil
+		Global.Input = buf.getRenderName() + " has very long lines; syntax highlighting is off"
+	}
 	buf.Highlight()
 }
+
+// Lines longer than this (in bytes) turn syntax highlighting off; minified
+// files can be a single line of megabytes.
+var longLineLimit = 10000
+
+func (buf *EditorBuffer) hasLongLines() bool {
+	for i := 0; i < buf.NumRows; i++ {
+		row := buf.row(i)
+		if row.Size > longLineLimit {
+			return true
+		}
+	}
+	return false
+}
@@ -3,4 +3,4 @@
 package main
 
 // Do nothing - no guarantee it will work outside of losenix
-func terminalTitle(buf *EditorBuffer) {}
+func terminalTitle(title string) {}
@@ -2,6 +2,6 @@ package main
 
 import "fmt"
 
-func terminalTitle(buf *EditorBuffer) {
-	fmt.Printf("\033]0;%s - gomacs\a", buf.getRenderName())
+func terminalTitle(title string) {
+	fmt.Printf("\033]0;%s\a", title)
 }
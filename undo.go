@@ -1,35 +1,126 @@
 package main
 
 import (
+	"fmt"
 	"strings"
 
 	"github.com/zhemao/glisp/interpreter"
 )
 
+// Undos form a tree. prev is the edit that came before this one; an edit made
+// after undoing starts a new branch rather than throwing away the redos.
 type EditorUndo struct {
-	ins    bool
-	region bool
-	startl int
-	endl   int
-	startc int
-	endc   int
-	str    string
-	prev   *EditorUndo
-	paired bool
+	ins      bool
+	region   bool
+	startl   int
+	endl     int
+	startc   int
+	endc     int
+	str      string
+	prev     *EditorUndo
+	paired   bool
+	next     *EditorUndo   // The branch that redo will follow
+	children []*EditorUndo // Every branch made after this edit
+}
+
+// Returns the node whose children are the edits made after u. The edits made
+// on the unmodified buffer hang off buf.UndoRoot, which stands in for nil.
+func (buf *EditorBuffer) undoNode(u *EditorUndo) *EditorUndo {
+	if u != nil {
+		return u
+	}
+	if buf.UndoRoot == nil {
+		buf.UndoRoot = new(EditorUndo)
+	}
+	return buf.UndoRoot
+}
+
+// Adds u as a new branch after the current undo and makes it current.
+func (buf *EditorBuffer) pushUndo(u *EditorUndo) {
+	u.prev = buf.Undo
+	parent := buf.undoNode(buf.Undo)
+	parent.children = append(parent.children, u)
+	parent.next = u
+	buf.Undo = u
 }
 
 // Discards the last undo. Useful for the region functions, as they're made of
 // regular insertion functions (which take care of their own undo)
 func editorPopUndo() {
-	old := Global.CurrentB.Undo
+	buf := Global.CurrentB
+	old := buf.Undo
 	if old == nil {
 		return
 	}
-	Global.CurrentB.Undo = old.prev
+	buf.Undo = old.prev
+	parent := buf.undoNode(buf.Undo)
+	for i, child := range parent.children {
+		if child == old {
+			parent.children = append(parent.children[:i], parent.children[i+1:]...)
+			break
+		}
+	}
+	if parent.next == old {
+		parent.next = nil
+		if len(parent.children) > 0 {
+			parent.next = parent.children[len(parent.children)-1]
+		}
+	}
+}
+
+// Forgets all undo information for buf.
+func (buf *EditorBuffer) clearUndo() {
+	buf.Undo = nil
+	buf.UndoRoot = nil
+	buf.SaveUndo = nil
+}
+
+// Moves the positions in buf's undo history that are at or after line ml,
+// column mc to where that text is after being pushed along to line nl, column
+// nc by something added without undo, like process output. If an edit spans
+// (ml, mc) it can't be moved, and the whole history is forgotten instead.
+func (buf *EditorBuffer) shiftUndo(ml, mc, nl, nc int) {
+	if buf.UndoRoot == nil || (ml == nl && mc == nc) {
+		return
+	}
+	after := func(l, c int) bool {
+		return l > ml || (l == ml && c >= mc)
+	}
+	shift := func(l, c *int) {
+		if *l == ml {
+			*c += nc - mc
+		}
+		*l += nl - ml
+	}
+	var nodes []*EditorUndo
+	var walk func(u *EditorUndo) bool
+	walk = func(u *EditorUndo) bool {
+		for _, child := range u.children {
+			start := after(child.startl, child.startc)
+			end := after(child.endl, child.endc) && (start || child.endl != ml || child.endc != mc)
+			if end && !start {
+				return false
+			}
+			if start {
+				nodes = append(nodes, child)
+			}
+			if !walk(child) {
+				return false
+			}
+		}
+		return true
+	}
+	if !walk(buf.UndoRoot) {
+		buf.clearUndo()
+		return
+	}
+	for _, u := range nodes {
+		shift(&u.startl, &u.startc)
+		shift(&u.endl, &u.endc)
+	}
 }
 
 func editorAddRegionUndo(ins bool, startc, endc, startl, endl int, str string) {
-	old := Global.CurrentB.Undo
 	ret := new(EditorUndo)
 	ret.endl = endl
 	ret.startl = startl
@@ -38,14 +129,7 @@ func editorAddRegionUndo(ins bool, startc, endc, startl, endl int, str string) {
 	ret.str = str
 	ret.ins = ins
 	ret.region = true
-
-	if old == nil {
-		ret.prev = nil
-	} else {
-		ret.prev = old
-	}
-	Global.CurrentB.Undo = ret
-	Global.CurrentB.Redo = nil
+	Global.CurrentB.pushUndo(ret)
 }
 
 func editorAddInsertUndo(startc, startl int, str string) {
@@ -55,7 +139,7 @@ func editorAddInsertUndo(startc, startl int, str string) {
 	if 0 < newlines {
 		lastnl = strings.LastIndex(str, "\n") + 1
 	}
-	if old != nil && old != Global.CurrentB.SaveUndo &&
+	if old != nil && old != Global.CurrentB.SaveUndo && len(old.children) == 0 &&
 		old.ins && old.endc == startc && old.endl == startl {
 		old.str += str
 		old.endl += newlines
@@ -79,10 +163,8 @@ func editorAddInsertUndo(startc, startl int, str string) {
 			ret.endl = startl + newlines
 			ret.endc = len(str[lastnl:])
 		}
-		ret.prev = old
-		Global.CurrentB.Undo = ret
+		Global.CurrentB.pushUndo(ret)
 	}
-	Global.CurrentB.Redo = nil
 }
 
 func editorAddDeleteUndo(startc, endc, startl, endl int, str string) {
@@ -90,7 +172,8 @@ func editorAddDeleteUndo(startc, endc, startl, endl int, str string) {
 	ins := false
 	app := false
 	if old != nil {
-		app = old.startl == startl && old.endl == endl && old.ins == ins && old != Global.CurrentB.SaveUndo
+		app = old.startl == startl && old.endl == endl && old.ins == ins &&
+			old != Global.CurrentB.SaveUndo && len(old.children) == 0
 		if app {
 			if ins {
 				app = old.endc == startc
@@ -100,7 +183,6 @@ func editorAddDeleteUndo(startc, endc, startl, endl int, str string) {
 		}
 	}
 	if app {
-		Global.CurrentB.Redo = nil
 		//append to group things together, ala gnu
 		if ins {
 			old.str += str
@@ -118,14 +200,7 @@ func editorAddDeleteUndo(startc, endc, startl, endl int, str string) {
 		ret.str = str
 		ret.ins = ins
 		ret.region = false
-
-		if old == nil {
-			ret.prev = nil
-		} else {
-			ret.prev = old
-		}
-		Global.CurrentB.Undo = ret
-		Global.CurrentB.Redo = nil
+		Global.CurrentB.pushUndo(ret)
 	}
 }
 
@@ -145,7 +220,7 @@ func editorDoUndo(tree *EditorUndo) bool {
 		// Insertion
 		if tree.startl == tree.endl {
 			// Basic string insertion
-			editorRowDelChar(Global.CurrentB.Rows[tree.startl], Global.CurrentB,
+			editorRowDelChar(Global.CurrentB.row(tree.startl), Global.CurrentB,
 				tree.startc, len(tree.str))
 			Global.CurrentB.cx = tree.startc
 			Global.CurrentB.cy = tree.startl
@@ -160,7 +235,7 @@ func editorDoUndo(tree *EditorUndo) bool {
 			// inserting a line
 			Global.CurrentB.cx = tree.startc
 			Global.CurrentB.cy = tree.startl
-			editorRowAppendStr(Global.CurrentB.Rows[tree.startl], Global.CurrentB, tree.str)
+			editorRowAppendStr(Global.CurrentB.row(tree.startl), Global.CurrentB, tree.str)
 			editorDelRow(tree.endl)
 			return true
 		}
@@ -168,20 +243,20 @@ func editorDoUndo(tree *EditorUndo) bool {
 		// Deletion
 		if tree.startl == tree.endl {
 			// Character or word deletion
-			editorRowInsertStr(Global.CurrentB.Rows[tree.startl], Global.CurrentB,
+			editorRowInsertStr(Global.CurrentB.row(tree.startl), Global.CurrentB,
 				tree.startc, tree.str)
 			Global.CurrentB.cx = tree.endc
 			Global.CurrentB.cy = tree.startl
 			return true
 		} else {
 			// deleting a line
-			editorInsertRow(tree.startl, Global.CurrentB.Rows[tree.startl].Data[:tree.endc])
-			row := Global.CurrentB.Rows[tree.endl]
+			editorInsertRow(tree.startl, Global.CurrentB.row(tree.startl).Data[:tree.endc])
+			row := Global.CurrentB.row(tree.endl)
 			row.Data = tree.str
 			row.Size = len(row.Data)
-			Global.CurrentB.Rows[tree.startl].Size = len(Global.CurrentB.Rows[tree.startl].Data)
+			Global.CurrentB.row(tree.startl).Size = len(Global.CurrentB.row(tree.startl).Data)
 			editorUpdateRow(row, Global.CurrentB)
-			editorUpdateRow(Global.CurrentB.Rows[tree.startl], Global.CurrentB)
+			editorUpdateRow(Global.CurrentB.row(tree.startl), Global.CurrentB)
 			return true
 		}
 	}
@@ -222,37 +297,45 @@ func editorDoRedo(tree *EditorUndo) {
 }
 
 func editorUndoAction() {
-	r := Global.CurrentB.Redo
-	succ := editorDoUndo(Global.CurrentB.Undo)
-	paired := Global.CurrentB.Undo != nil && Global.CurrentB.Undo.paired
+	buf := Global.CurrentB
+	if !buf.checkWritable() {
+		return
+	}
+	u := buf.Undo
+	succ := editorDoUndo(u)
 	if succ {
-		Global.CurrentB.Redo = Global.CurrentB.Undo
-		Global.CurrentB.Undo = Global.CurrentB.Undo.prev
-		Global.CurrentB.Redo.prev = r
-		if paired {
+		buf.Undo = u.prev
+		buf.undoNode(buf.Undo).next = u
+		if u.paired {
 			editorUndoAction()
 		}
 	} else {
 		Global.Input = "No further undo information."
 	}
-	if Global.CurrentB.Undo == Global.CurrentB.SaveUndo {
-		Global.CurrentB.Dirty = false
+	if buf.Undo == buf.SaveUndo {
+		buf.Dirty = false
 	}
 }
 
 func doOneRedo(env *glisp.Glisp) {
-	if Global.CurrentB.Redo == nil {
+	buf := Global.CurrentB
+	if !buf.checkWritable() {
+		return
+	}
+	parent := buf.undoNode(buf.Undo)
+	r := parent.next
+	if r == nil {
 		Global.Input = "No further redo information."
 	} else {
-		r := Global.CurrentB.Redo
-		editorDoRedo(Global.CurrentB.Redo)
-		Global.CurrentB.Redo = r.prev
-		r.prev = Global.CurrentB.Undo
-		Global.CurrentB.Undo = r
-		if r == Global.CurrentB.SaveUndo {
-			Global.CurrentB.Dirty = false
+		editorDoRedo(r)
+		// Redoing may have pushed and popped undos of its own; put the
+		// branch back the way it was.
+		parent.next = r
+		buf.Undo = r
+		if r == buf.SaveUndo {
+			buf.Dirty = false
 		}
-		if Global.CurrentB.Redo != nil && Global.CurrentB.Redo.paired {
+		if r.next != nil && r.next.paired {
 			doOneRedo(env)
 		}
 	}
@@ -261,3 +344,171 @@ func doOneRedo(env *glisp.Glisp) {
 func editorRedoAction(env *glisp.Glisp) {
 	micromode("C-_", "Press C-_ or C-/ to redo again", env, doOneRedo)
 }
+
+// Reports whether a is u or comes before it in the tree. nil (the unmodified
+// buffer) comes before everything.
+func undoIsAncestor(a, u *EditorUndo) bool {
+	for n := u; n != nil; n = n.prev {
+		if n == a {
+			return true
+		}
+	}
+	return a == nil
+}
+
+// Moves buf to the state just after target by undoing back to the branch
+// point and redoing down target's branch.
+func undoTreeJump(buf *EditorBuffer, target *EditorUndo, env *glisp.Glisp) {
+	if !buf.checkWritable() {
+		return
+	}
+	for buf.Undo != nil && !undoIsAncestor(buf.Undo, target) {
+		editorUndoAction()
+	}
+	for n := target; n != nil && n != buf.Undo; n = n.prev {
+		buf.undoNode(n.prev).next = n
+	}
+	for !undoIsAncestor(target, buf.Undo) && buf.undoNode(buf.Undo).next != nil {
+		doOneRedo(env)
+	}
+}
+
+func describeUndo(u *EditorUndo) string {
+	what := "delete"
+	if u.ins {
+		what = "insert"
+	}
+	str := u.str
+	if len(str) > 30 {
+		str = str[:30] + "..."
+	}
+	return fmt.Sprintf("%s %q at %d:%d", what, str, u.startl+1, u.startc)
+}
+
+// Draws buf's undo tree, one edit per line. A branch is only indented where
+// the history forks. The nodes slice gives the edit shown on each line.
+func undoTreeLines(buf *EditorBuffer) ([]string, []*EditorUndo) {
+	lines := []string{"o (unmodified)"}
+	nodes := []*EditorUndo{nil}
+	if buf.Undo == nil {
+		lines[0] = "@ (unmodified)"
+	}
+	var walk func(children []*EditorUndo, prefix string)
+	walk = func(children []*EditorUndo, prefix string) {
+		for i, child := range children {
+			mark := "o "
+			if child == buf.Undo {
+				mark = "@ "
+			} else if !undoIsAncestor(child, buf.Undo) && buf.undoNode(child.prev).next != child {
+				mark = ". "
+			}
+			if len(children) == 1 {
+				lines = append(lines, prefix+mark+describeUndo(child))
+				nodes = append(nodes, child)
+				walk(child.children, prefix)
+			} else if i < len(children)-1 {
+				lines = append(lines, prefix+"|-"+mark+describeUndo(child))
+				nodes = append(nodes, child)
+				walk(child.children, prefix+"| ")
+			} else {
+				lines = append(lines, prefix+"`-"+mark+describeUndo(child))
+				nodes = append(nodes, child)
+				walk(child.children, prefix+"  ")
+			}
+		}
+	}
+	walk(buf.undoNode(nil).children, "")
+	return lines, nodes
+}
+
+// Switches the branch that redo will follow from the current state.
+func undoTreeSwitchBranch(buf *EditorBuffer, dir int) {
+	parent := buf.undoNode(buf.Undo)
+	if len(parent.children) < 2 {
+		Global.Input = "No other branch here"
+		return
+	}
+	for i, child := range parent.children {
+		if child == parent.next {
+			i = (i + dir + len(parent.children)) % len(parent.children)
+			parent.next = parent.children[i]
+			return
+		}
+	}
+	parent.next = parent.children[0]
+}
+
+// The buffer whose undo tree is shown in *undo-tree*.
+var undoTreeSource *EditorBuffer
+
+// The edit shown on each line of *undo-tree*, after the heading.
+var undoTreeNodes []*EditorUndo
+
+// Shows the undo tree of the current buffer in the *undo-tree* buffer and
+// selects it. In there p/n undo and redo, b/f pick the branch redo follows,
+// RET jumps to the state on the line point is on, and q leaves.
+func undoTreeVisualize(env *glisp.Glisp) {
+	src := Global.CurrentB
+	if src.MajorMode == "undo-tree" {
+		return
+	}
+	undoTreeSource = src
+	buf := getOutputBuffer("*undo-tree*")
+	buf.MajorMode = "undo-tree"
+	undoTreeRefresh(buf)
+	callFunOtherWindow(func() { switchToBuffer(buf) })
+	Global.Input = "p/n undo/redo, b/f branch, RET jump, q quit"
+}
+
+// Redraws the tree into buf, with point on the source's current state.
+func undoTreeRefresh(buf *EditorBuffer) {
+	lines, nodes := undoTreeLines(undoTreeSource)
+	undoTreeNodes = nodes
+	buf.setLines(append([]string{"Undo tree for " + undoTreeSource.getRenderName()}, lines...))
+	for i, n := range nodes {
+		if n == undoTreeSource.Undo {
+			buf.cy = i + 1
+		}
+	}
+}
+
+// Runs f with the buffer the tree belongs to as the current buffer, then
+// redraws the tree.
+func undoTreeDo(f func(src *EditorBuffer)) {
+	buf := Global.CurrentB
+	if buf.MajorMode != "undo-tree" {
+		return
+	}
+	src := undoTreeSource
+	if src == nil || !bufferExists(src) {
+		Global.Input = "The buffer this undo tree belongs to has been killed"
+		return
+	}
+	Global.CurrentB = src
+	f(src)
+	Global.CurrentB = buf
+	undoTreeRefresh(buf)
+}
+
+func undoTreeUndo() {
+	undoTreeDo(func(*EditorBuffer) { editorUndoAction() })
+}
+
+func undoTreeRedo(env *glisp.Glisp) {
+	undoTreeDo(func(*EditorBuffer) { doOneRedo(env) })
+}
+
+func undoTreeBranch(dir int) {
+	undoTreeDo(func(src *EditorBuffer) { undoTreeSwitchBranch(src, dir) })
+}
+
+// Moves the source buffer to the state on the line point is on.
+func undoTreeSelect(env *glisp.Glisp) {
+	i := Global.CurrentB.cy - 1
+	if i < 0 || i >= len(undoTreeNodes) {
+		Global.Input = "No undo state on this line"
+		return
+	}
+	target := undoTreeNodes[i]
+	undoTreeDo(func(src *EditorBuffer) { undoTreeJump(src, target, env) })
+}
@@ -0,0 +1,385 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/zhemao/glisp/interpreter"
+)
+
+// A setting that can be changed from Lisp or with customize-variable. Its
+// default value is kept in a field of Global, where code that doesn't care
+// about buffers can still find it; any buffer can override it with a value
+// of its own.
+type editorVariable struct {
+	name    string
+	doc     string
+	value   interface{}             // An *int, *bool or *string holding the default
+	check   func(interface{}) error // Rejects bad values, or nil
+	changed func(buf *EditorBuffer) // Called when buf's value changes, or nil
+}
+
+var editorVariables = map[string]*editorVariable{}
+
+func defineVariable(v *editorVariable) {
+	editorVariables[v.name] = v
+}
+
+func positiveInt(val interface{}) error {
+	if val.(int) <= 0 {
+		return errors.New("must be more than 0")
+	}
+	return nil
+}
+
+func loadDefaultVariables() {
+	defineVariable(&editorVariable{"tab-width",
+		"How many columns a tab takes up, and how many spaces TAB inserts with soft-tab.",
+		&Global.Tabsize, positiveInt, rerenderBuffer})
+	defineVariable(&editorVariable{"soft-tab",
+		"Whether TAB inserts spaces (true) or a tab character (false).",
+		&Global.SoftTab, nil, nil})
+	defineVariable(&editorVariable{"fill-column",
+		"The column the fill commands wrap lines at.",
+		&Global.Fillcolumn, positiveInt, nil})
+	defineVariable(&editorVariable{"disable-syntax",
+		"Whether syntax highlighting is turned off.",
+		&Global.NoSyntax, nil, nil})
+}
+
+func (v *editorVariable) typeName() string {
+	switch v.value.(type) {
+	case *int:
+		return "integer"
+	case *bool:
+		return "boolean"
+	}
+	return "string"
+}
+
+func (v *editorVariable) defaultValue() interface{} {
+	switch p := v.value.(type) {
+	case *int:
+		return *p
+	case *bool:
+		return *p
+	case *string:
+		return *p
+	}
+	return nil
+}
+
+// Checks that val is the right type and acceptable for v.
+func (v *editorVariable) validate(val interface{}) error {
+	ok := false
+	switch v.value.(type) {
+	case *int:
+		_, ok = val.(int)
+	case *bool:
+		_, ok = val.(bool)
+	case *string:
+		_, ok = val.(string)
+	}
+	if !ok {
+		return fmt.Errorf("%s needs to be of type %s", v.name, v.typeName())
+	}
+	if v.check != nil {
+		if err := v.check(val); err != nil {
+			return fmt.Errorf("%s %s", v.name, err.Error())
+		}
+	}
+	return nil
+}
+
+// Parses the text of a value for v, as typed into customize-variable.
+func (v *editorVariable) parse(s string) (interface{}, error) {
+	s = strings.TrimSpace(s)
+	switch v.value.(type) {
+	case *int:
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return nil, fmt.Errorf("%s needs to be an integer", v.name)
+		}
+		return n, nil
+	case *bool:
+		switch strings.ToLower(s) {
+		case "t", "true", "yes", "on", "1":
+			return true, nil
+		case "nil", "false", "no", "off", "0":
+			return false, nil
+		}
+		return nil, fmt.Errorf("%s needs to be true or false", v.name)
+	}
+	return s, nil
+}
+
+func formatValue(val interface{}) string {
+	if s, ok := val.(string); ok {
+		return strconv.Quote(s)
+	}
+	return fmt.Sprint(val)
+}
+
+func lookupVariable(name string) (*editorVariable, error) {
+	v := editorVariables[name]
+	if v == nil {
+		return nil, errors.New("No variable called " + name)
+	}
+	return v, nil
+}
+
+// The value of the variable called name in buf: its own, if it has one, or
+// the default.
+func (buf *EditorBuffer) variable(name string) interface{} {
+	if val, ok := buf.locals[name]; ok {
+		return val
+	}
+	return editorVariables[name].defaultValue()
+}
+
+func (buf *EditorBuffer) tabWidth() int {
+	return buf.variable("tab-width").(int)
+}
+
+func (buf *EditorBuffer) softTab() bool {
+	return buf.variable("soft-tab").(bool)
+}
+
+func (buf *EditorBuffer) fillColumn() int {
+	return buf.variable("fill-column").(int)
+}
+
+func (buf *EditorBuffer) syntaxOff() bool {
+	return buf.variable("disable-syntax").(bool)
+}
+
+// Gives buf its own value for v.
+func setLocalVariable(buf *EditorBuffer, v *editorVariable, val interface{}) error {
+	if err := v.validate(val); err != nil {
+		return err
+	}
+	if buf.locals == nil {
+		buf.locals = map[string]interface{}{}
+	}
+	buf.locals[v.name] = val
+	if v.changed != nil {
+		v.changed(buf)
+	}
+	return nil
+}
+
+// Sets the default value of v, which every buffer without its own value
+// uses.
+func setDefaultVariable(v *editorVariable, val interface{}) error {
+	if err := v.validate(val); err != nil {
+		return err
+	}
+	switch p := v.value.(type) {
+	case *int:
+		*p = val.(int)
+	case *bool:
+		*p = val.(bool)
+	case *string:
+		*p = val.(string)
+	}
+	if v.changed != nil {
+		for _, buf := range Global.Buffers {
+			if _, ok := buf.locals[v.name]; !ok {
+				v.changed(buf)
+			}
+		}
+	}
+	return nil
+}
+
+// Makes buf use the default value of v again.
+func killLocalVariable(buf *EditorBuffer, v *editorVariable) {
+	if _, ok := buf.locals[v.name]; !ok {
+		return
+	}
+	delete(buf.locals, v.name)
+	if v.changed != nil {
+		v.changed(buf)
+	}
+}
+
+// Redraws the rows of buf, for when the tab width has changed.
+func rerenderBuffer(buf *EditorBuffer) {
+	for i := 0; i < buf.NumRows; i++ {
+		row := buf.row(i)
+		rowUpdateRender(row, buf)
+	}
+	buf.Highlight()
+}
+
+func variableNames() []string {
+	ret := make([]string, 0, len(editorVariables))
+	for name := range editorVariables {
+		ret = append(ret, name)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+func promptForVariable(prompt string) *editorVariable {
+	name := tabCompletedEditorPrompt(prompt, func(prefix string) []string {
+		ret := []string{}
+		for _, name := range variableNames() {
+			if strings.HasPrefix(name, prefix) {
+				ret = append(ret, name)
+			}
+		}
+		return ret
+	})
+	if name == "" {
+		Global.Input = "Cancelled."
+		return nil
+	}
+	v, err := lookupVariable(name)
+	if err != nil {
+		Global.Input = err.Error()
+		return nil
+	}
+	return v
+}
+
+func describeVariable() {
+	v := promptForVariable("Describe variable")
+	if v == nil {
+		return
+	}
+	buf := Global.CurrentB
+	lines := []string{v.name + " (" + v.typeName() + ")", ""}
+	if val, ok := buf.locals[v.name]; ok {
+		lines = append(lines,
+			"Its value in "+buf.getRenderName()+" is "+formatValue(val)+".",
+			"Its default value is "+formatValue(v.defaultValue())+".")
+	} else {
+		lines = append(lines, "Its value is "+formatValue(v.defaultValue())+".")
+	}
+	lines = append(lines, "", v.doc, "",
+		"Set it with M-x customize-variable, or in Lisp with",
+		"(set-default '"+v.name+" value) or, for this buffer only,",
+		"(setq-local '"+v.name+" value).")
+	showMessages(lines...)
+}
+
+// Prompts for a variable and a new value for it, and sets its default value,
+// or its value in this buffer only with a universal argument.
+func customizeVariable() {
+	v := promptForVariable("Customize variable")
+	if v == nil {
+		return
+	}
+	buf := Global.CurrentB
+	local := Global.SetUniversal
+	where := "default"
+	if local {
+		where = "value in " + buf.getRenderName()
+	}
+	s := editorPrompt(fmt.Sprintf("Set %s %s (%s, now %s)", v.name, where, v.typeName(),
+		formatValue(buf.variable(v.name))), nil)
+	if s == "" {
+		Global.Input = "Cancelled."
+		return
+	}
+	val, err := v.parse(s)
+	if err == nil {
+		if local {
+			err = setLocalVariable(buf, v, val)
+		} else {
+			err = setDefaultVariable(v, val)
+		}
+	}
+	if err != nil {
+		Global.Input = err.Error()
+		return
+	}
+	Global.Input = fmt.Sprintf("Set %s %s to %s", v.name, where, formatValue(val))
+}
+
+// Turns a Lisp value into the Go value for a variable.
+func lispToValue(sexp glisp.Sexp) interface{} {
+	switch t := sexp.(type) {
+	case glisp.SexpInt:
+		return int(t)
+	case glisp.SexpBool:
+		return bool(t)
+	case glisp.SexpStr:
+		return string(t)
+	}
+	return nil
+}
+
+func valueToLisp(val interface{}) glisp.Sexp {
+	switch t := val.(type) {
+	case int:
+		return glisp.SexpInt(t)
+	case bool:
+		return glisp.SexpBool(t)
+	case string:
+		return glisp.SexpStr(t)
+	}
+	return glisp.SexpNull
+}
+
+func lispVariableArg(args []glisp.Sexp, nargs int) (*editorVariable, error) {
+	if len(args) != nargs {
+		return nil, glisp.WrongNargs
+	}
+	name, err := lispNameArg(args[0])
+	if err != nil {
+		return nil, err
+	}
+	return lookupVariable(name)
+}
+
+func lispSetqLocal(env *glisp.Glisp, name string, args []glisp.Sexp) (glisp.Sexp, error) {
+	v, err := lispVariableArg(args, 2)
+	if err != nil {
+		return glisp.SexpNull, err
+	}
+	if err := setLocalVariable(Global.CurrentB, v, lispToValue(args[1])); err != nil {
+		return glisp.SexpNull, err
+	}
+	return args[1], nil
+}
+
+func lispSetDefault(env *glisp.Glisp, name string, args []glisp.Sexp) (glisp.Sexp, error) {
+	v, err := lispVariableArg(args, 2)
+	if err != nil {
+		return glisp.SexpNull, err
+	}
+	if err := setDefaultVariable(v, lispToValue(args[1])); err != nil {
+		return glisp.SexpNull, err
+	}
+	return args[1], nil
+}
+
+func lispSymbolValue(env *glisp.Glisp, name string, args []glisp.Sexp) (glisp.Sexp, error) {
+	v, err := lispVariableArg(args, 1)
+	if err != nil {
+		return glisp.SexpNull, err
+	}
+	return valueToLisp(Global.CurrentB.variable(v.name)), nil
+}
+
+func lispDefaultValue(env *glisp.Glisp, name string, args []glisp.Sexp) (glisp.Sexp, error) {
+	v, err := lispVariableArg(args, 1)
+	if err != nil {
+		return glisp.SexpNull, err
+	}
+	return valueToLisp(v.defaultValue()), nil
+}
+
+func lispKillLocalVariable(env *glisp.Glisp, name string, args []glisp.Sexp) (glisp.Sexp, error) {
+	v, err := lispVariableArg(args, 1)
+	if err != nil {
+		return glisp.SexpNull, err
+	}
+	killLocalVariable(Global.CurrentB, v)
+	return glisp.SexpNull, nil
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/zhemao/glisp/interpreter"
+)
+
+// The names of the files on each line of a dired buffer when it was made
+// editable, keyed by buffer. "" for lines that aren't files.
+var wdiredNames = map[*EditorBuffer][]string{}
+
+// Makes the dired buffer (or a new one, if we're not in one) editable, so
+// that files are renamed by changing their names in the listing.
+func wdired(env *glisp.Glisp) {
+	if Global.CurrentB.MajorMode != "dired" {
+		DiredMode(env)
+		if Global.CurrentB.MajorMode != "dired" {
+			return
+		}
+	}
+	buf := Global.CurrentB
+	names := make([]string, buf.NumRows)
+	for i := range names {
+		names[i], _ = diredNameAt(buf, i)
+	}
+	wdiredNames[buf] = names
+	buf.MajorMode = "wdired"
+	buf.setMode("no-self-insert-mode", false)
+	Global.Input = "Edit the file names, then C-c C-c to rename the files or C-c C-k to give up"
+}
+
+// A file to rename, and the name it has while it's out of the way.
+type wdiredRename struct {
+	from, to, tmp string
+}
+
+// Works out the renames asked for by the edits to buf. Anything that can't
+// be done is reported in the messages and left alone.
+func wdiredRenames(buf *EditorBuffer, names []string) ([]*wdiredRename, int) {
+	failed := 0
+	fail := func(msg string) {
+		AddErrorMessage("wdired: " + msg)
+		failed++
+	}
+	ret := []*wdiredRename{}
+	targets := map[string]string{}
+	from := map[string]bool{}
+	for i, old := range names {
+		if old == "" || old == ".." {
+			continue
+		}
+		name, _ := diredNameAt(buf, i)
+		if name == old {
+			continue
+		}
+		if name == "" {
+			fail(fmt.Sprintf("line %d: can't find a file name in %q", i+1, buf.row(i).Data))
+			continue
+		}
+		to := filepath.Join(buf.Dir, name)
+		if other, ok := targets[to]; ok {
+			fail(fmt.Sprintf("%s and %s would both be renamed to %s", other, old, name))
+			continue
+		}
+		targets[to] = old
+		from[filepath.Join(buf.Dir, old)] = true
+		ret = append(ret, &wdiredRename{filepath.Join(buf.Dir, old), to, ""})
+	}
+	// A name can only be reused if the file that has it is being renamed.
+	ok := ret[:0]
+	for _, r := range ret {
+		if _, err := os.Lstat(r.to); err == nil && !from[r.to] {
+			fail(fmt.Sprintf("can't rename %s to %s: file exists", r.from, r.to))
+			continue
+		}
+		ok = append(ok, r)
+	}
+	return ok, failed
+}
+
+// Renames every file whose name was changed. Files are moved to temporary
+// names first, so that names can be swapped round.
+func wdiredFinishEdit() {
+	buf := Global.CurrentB
+	names := wdiredNames[buf]
+	if buf.MajorMode != "wdired" || names == nil {
+		Global.Input = "Not in a wdired buffer"
+		return
+	}
+	if buf.NumRows != len(names) {
+		Global.Input = "Lines have been added or removed; C-c C-k to start again"
+		return
+	}
+	renames, failed := wdiredRenames(buf, names)
+	moved := []*wdiredRename{}
+	for i, r := range renames {
+		r.tmp = filepath.Join(filepath.Dir(r.from), fmt.Sprintf(".wdired-%d-%d", os.Getpid(), i))
+		if err := os.Rename(r.from, r.tmp); err != nil {
+			AddErrorMessage("wdired: " + err.Error())
+			failed++
+			continue
+		}
+		moved = append(moved, r)
+	}
+	done := 0
+	for _, r := range moved {
+		var err error
+		if _, serr := os.Lstat(r.to); serr == nil {
+			// Its owner wasn't moved out of the way after all.
+			err = &os.LinkError{Op: "rename", Old: r.tmp, New: r.to, Err: os.ErrExist}
+		} else {
+			err = os.Rename(r.tmp, r.to)
+		}
+		if err == nil {
+			if b := findFileBuffer(r.from); b != nil {
+				b.Filename = r.to
+				b.UpdateRenderName()
+			}
+			done++
+			continue
+		}
+		if le, ok := err.(*os.LinkError); ok {
+			// Report it with the real name, not the temporary one.
+			le.Old = r.from
+		}
+		AddErrorMessage("wdired: " + err.Error())
+		failed++
+		if err := os.Rename(r.tmp, r.from); err != nil {
+			AddErrorMessage("wdired: couldn't put back " + r.from + "; it is now " + r.tmp)
+		}
+	}
+	wdiredQuit(buf)
+	if failed > 0 {
+		Global.Input = fmt.Sprintf("Renamed %d files; %d failed, see *Messages*", done, failed)
+	} else {
+		Global.Input = fmt.Sprintf("Renamed %d files", done)
+	}
+}
+
+// Goes back to dired, showing what's really on disk.
+func wdiredQuit(buf *EditorBuffer) {
+	delete(wdiredNames, buf)
+	line := buf.cy
+	if err := diredRead(buf, buf.Dir); err != nil {
+		Global.Input = err.Error()
+		AddErrorMessage(err.Error())
+		return
+	}
+	diredGoto(buf, "", line)
+}
+
+func wdiredAbortChanges() {
+	buf := Global.CurrentB
+	if buf.MajorMode != "wdired" {
+		Global.Input = "Not in a wdired buffer"
+		return
+	}
+	wdiredQuit(buf)
+	Global.Input = "Changes aborted"
+}
@@ -1,6 +1,10 @@
 package main
 
 import (
+	"os"
+	"path/filepath"
+	"strings"
+
 	"github.com/zhemao/glisp/interpreter"
 )
 
@@ -95,6 +99,16 @@ func editorFindFile(env *glisp.Glisp) {
 }
 
 func openFile(fn string, env *glisp.Glisp) {
+	allowLarge := true
+	if fpath, err := AbsPath(fn); err == nil {
+		if large, size := isLargeFile(fpath); large {
+			ok, err := editorYesNoPrompt(filepath.Base(fpath)+" is "+formatSize(size)+"; open it read-only in large-file mode?", false)
+			if err != nil {
+				return
+			}
+			allowLarge = ok
+		}
+	}
 	buffer := &EditorBuffer{}
 	Global.Buffers = append(Global.Buffers, buffer)
 	i := getCurrentWindow()
@@ -104,11 +118,17 @@ func openFile(fn string, env *glisp.Glisp) {
 		Global.Windows[i] = buffer
 	}
 	Global.CurrentB = buffer
-	EditorOpen(fn, env)
+	if err := editorOpenFile(fn, env, allowLarge); err != nil && !os.IsNotExist(err) {
+		Global.Input = err.Error()
+		AddErrorMessage(err.Error())
+	}
 }
 
 func (e *EditorBuffer) getFilename() string {
 	if e.Filename == "" {
+		if e.Rendername != "" {
+			return e.Rendername
+		}
 		return "*unnamed buffer*"
 	}
 	return e.Filename
@@ -116,6 +136,9 @@ func (e *EditorBuffer) getFilename() string {
 
 func (e *EditorBuffer) getRenderName() string {
 	if e.Filename == "" {
+		if e.Rendername != "" {
+			return e.Rendername
+		}
 		return "*unnamed buffer*"
 	}
 	return e.Rendername
@@ -141,14 +164,129 @@ func editorSwitchBuffer() {
 	choices, def := bufferChoiceList()
 	in := editorChoiceIndex("Switch buffer", append([]string{"View Messages"}, choices...), def+1)
 	if in == 0 {
-		showMessages(Global.messages...)
+		showMessagesBuffer()
 	} else {
-		i := getCurrentWindow()
-		Global.Windows[i] = Global.Buffers[in-1]
-		Global.CurrentB = Global.Buffers[in-1]
+		switchToBuffer(Global.Buffers[in-1])
 	}
 }
 
+// Shows buf in the current window.
+func switchToBuffer(buf *EditorBuffer) {
+	i := getCurrentWindow()
+	if i < 0 {
+		Global.Windows = []*EditorBuffer{buf}
+	} else {
+		Global.Windows[i] = buf
+	}
+	Global.CurrentB = buf
+}
+
+// Shows buf in the other window, splitting if there's only one, but leaves
+// the current window selected. If buf is already on screen, nothing changes.
+func displayBuffer(buf *EditorBuffer) {
+	for _, win := range Global.Windows {
+		if win == buf {
+			return
+		}
+	}
+	callFunOtherWindowAndGoBack(func() { switchToBuffer(buf) })
+}
+
+func bufferExists(buf *EditorBuffer) bool {
+	for _, b := range Global.Buffers {
+		if b == buf {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the buffer whose name (as shown on the status line) is name, or nil.
+func findBufferByName(name string) *EditorBuffer {
+	for _, buf := range Global.Buffers {
+		if buf.getRenderName() == name {
+			return buf
+		}
+	}
+	return nil
+}
+
+// Returns the buffer for a file that is already open, or nil.
+func findFileBuffer(fn string) *EditorBuffer {
+	for _, buf := range Global.Buffers {
+		if buf.Filename == fn {
+			return buf
+		}
+	}
+	return nil
+}
+
+// Returns the buffer called name that isn't visiting a file, such as *grep*,
+// making a new one if it doesn't exist yet.
+func getSpecialBuffer(name string) *EditorBuffer {
+	for _, buf := range Global.Buffers {
+		if buf.Filename == "" && buf.Rendername == name {
+			return buf
+		}
+	}
+	buf := &EditorBuffer{}
+	buf.Rendername = name
+	buf.MajorMode = "Unknown"
+	Global.Buffers = append(Global.Buffers, buf)
+	return buf
+}
+
+// Replaces the text of buf with lines, without recording any undo.
+func (buf *EditorBuffer) setLines(lines []string) {
+	rows := make([]*EditorRow, len(lines))
+	for i, line := range lines {
+		rows[i] = newRow(buf, line)
+	}
+	buf.setRows(rows)
+	buf.cx, buf.cy, buf.rowoff, buf.coloff, buf.prefcx = 0, 0, 0, 0, 0
+	buf.regionActive = false
+	buf.clearUndo()
+	buf.Dirty = false
+}
+
+// Adds text to the end of buf, continuing its last line, without recording
+// any undo. If point was at the end it stays there, so that the window
+// follows the output.
+func (buf *EditorBuffer) appendText(text string) {
+	text = strings.Replace(text, "\r\n", "\n", -1)
+	lines := strings.Split(text, "\n")
+	follow := buf.NumRows == 0 || (buf.cy == buf.NumRows-1 && buf.cx == buf.row(buf.cy).Size)
+	if buf.NumRows == 0 {
+		buf.appendLine("")
+	}
+	last := buf.row(buf.NumRows - 1)
+	last.Data += lines[0]
+	last.Size = len(last.Data)
+	rowUpdateRender(last, buf)
+	rows := make([]*EditorRow, len(lines)-1)
+	for i, line := range lines[1:] {
+		rows[i] = newRow(buf, line)
+	}
+	buf.insertRows(buf.NumRows, rows...)
+	if follow {
+		buf.cy = buf.NumRows - 1
+		buf.cx = buf.row(buf.cy).Size
+		buf.prefcx = buf.cx
+	}
+}
+
+// Adds a line to the end of buf, without recording any undo.
+func (buf *EditorBuffer) appendLine(line string) {
+	buf.insertRows(buf.NumRows, newRow(buf, line))
+}
+
+// Makes a row holding line, rendered for buf.
+func newRow(buf *EditorBuffer, line string) *EditorRow {
+	row := &EditorRow{len(line), line, 0, "", nil, nil, 0, nil}
+	rowUpdateRender(row, buf)
+	return row
+}
+
 func killGivenBuffer(i int) {
 	// Deleting the last buffer will result in painful death!
 	if len(Global.Buffers) == 1 {
@@ -183,6 +321,8 @@ func killGivenBuffer(i int) {
 		Global.CurrentB = rb
 	}
 
+	killBufferProcesses(kb)
+
 	// Delete the killed buffer.
 	copy(Global.Buffers[i:], Global.Buffers[i+1:])
 	Global.Buffers[len(Global.Buffers)-1] = nil
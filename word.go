@@ -15,7 +15,7 @@ func indexEndOfBackwardWord() int {
 	pre := true
 	for cx > 0 {
 		r, rs :=
-			utf8.DecodeLastRuneInString(Global.CurrentB.Rows[icy].Data[:cx])
+			utf8.DecodeLastRuneInString(Global.CurrentB.row(icy).Data[:cx])
 		if !termutil.WordCharacter(r) && !pre {
 			return cx
 		} else {
@@ -31,10 +31,10 @@ func indexEndOfForwardWord() int {
 	if icy >= Global.CurrentB.NumRows {
 		return cx
 	}
-	l := Global.CurrentB.Rows[icy].Size
+	l := Global.CurrentB.row(icy).Size
 	pre := true
 	for cx < l {
-		r, rs := utf8.DecodeRuneInString(Global.CurrentB.Rows[icy].Data[cx:])
+		r, rs := utf8.DecodeRuneInString(Global.CurrentB.row(icy).Data[cx:])
 		if !termutil.WordCharacter(r) && !pre {
 			return cx
 		} else {
@@ -46,6 +46,9 @@ func indexEndOfForwardWord() int {
 }
 
 func delBackWord() {
+	if !Global.CurrentB.checkWritable() {
+		return
+	}
 	times := getRepeatTimes()
 	for i := 0; i < times; i++ {
 		icx, icy := Global.CurrentB.cx, Global.CurrentB.cy
@@ -54,7 +57,7 @@ func delBackWord() {
 		}
 		ncx := indexEndOfBackwardWord()
 		if ncx < icx {
-			Global.Clipboard = rowDelRange(Global.CurrentB.Rows[icy], ncx, icx, Global.CurrentB)
+			addKill(rowDelRange(Global.CurrentB.row(icy), ncx, icx, Global.CurrentB), true)
 			Global.CurrentB.cx = ncx
 		}
 	}
@@ -72,6 +75,9 @@ func moveBackWord() {
 }
 
 func delForwardWord() {
+	if !Global.CurrentB.checkWritable() {
+		return
+	}
 	times := getRepeatTimes()
 	for i := 0; i < times; i++ {
 		icx, icy := Global.CurrentB.cx, Global.CurrentB.cy
@@ -80,7 +86,7 @@ func delForwardWord() {
 		}
 		ncx := indexEndOfForwardWord()
 		if ncx > icx {
-			Global.Clipboard = rowDelRange(Global.CurrentB.Rows[icy], icx, ncx, Global.CurrentB)
+			addKill(rowDelRange(Global.CurrentB.row(icy), icx, ncx, Global.CurrentB), false)
 		}
 	}
 }
@@ -92,7 +98,7 @@ func moveForwardWord() {
 		if icy >= Global.CurrentB.NumRows {
 			return
 		}
-		if Global.CurrentB.cx == Global.CurrentB.Rows[icy].Size {
+		if Global.CurrentB.cx == Global.CurrentB.row(icy).Size {
 			Global.CurrentB.MoveCursorRight()
 		}
 		Global.CurrentB.cx = indexEndOfForwardWord()